@@ -1,12 +1,75 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"code.leif.uk/lwg/unus/internal/unus"
+	"code.leif.uk/lwg/unus/internal/unus/config"
 )
 
+const usage = `usage:
+  unus [serve] [flags]             serve unus, see unus serve -h
+  unus send [flags] [file]         share a file, or stdin, as a secret
+  unus recv [flags] <id> <passphrase>
+  unus recv [flags] <url>          retrieve a secret
+  unus rekey [flags]               rewrap stored secrets with the newest master key
+`
+
 func main() {
+	command, arguments := "serve", os.Args[1:]
+	if len(arguments) > 0 && arguments[0] != "" && arguments[0][0] != '-' {
+		command, arguments = arguments[0], arguments[1:]
+	}
+
+	var err error
+	switch command {
+	case "serve":
+		err = serve(arguments)
+	case "send":
+		err = send(arguments)
+	case "recv":
+		err = recv(arguments)
+	case "rekey":
+		err = rekey(arguments)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unus %s: %s\n", command, err)
+		os.Exit(1)
+	}
+}
+
+// serves unus until asked to stop
+func serve(arguments []string) error {
 	log.Println("Unus: One time secret sharing.")
-	log.Fatal(unus.Serve(":8080"))
+
+	cfg, err := config.Load("unus serve", arguments)
+	if err != nil {
+		return err
+	}
+
+	// shut down cleanly when asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// unus has disposed of everything by the time Serve returns
+	if err := unus.Serve(ctx, cfg); err != nil {
+		return err
+	}
+
+	log.Println("Unus: stopped.")
+	return nil
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"code.leif.uk/lwg/unus/pkg/client"
+)
+
+// retrieves a secret, writing it to stdout or a file
+func recv(arguments []string) error {
+	flags := flag.NewFlagSet("unus recv", flag.ContinueOnError)
+	server := flags.String("server", default_server(), "unus server to retrieve from ("+SERVER_ENV+")")
+	output := flags.String("o", "", "file to write the secret to, instead of stdout")
+	if err := flags.Parse(arguments); err != nil {
+		return err
+	}
+
+	var id_text, passphrase string
+	switch flags.NArg() {
+	case 1:
+		var err error
+		*server, id_text, passphrase, err = parse_secret_url(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+	case 2:
+		id_text, passphrase = flags.Arg(0), flags.Arg(1)
+	default:
+		return errors.New("recv takes an id and passphrase, or a url")
+	}
+
+	id, err := strconv.ParseInt(id_text, 10, 64)
+	if err != nil {
+		return errors.New("badly-formed secret id")
+	}
+
+	c, err := client.NewClient(*server, nil)
+	if err != nil {
+		return err
+	}
+
+	_, secret, err := c.Retrieve(context.Background(), id, passphrase)
+	if err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err = os.Stdout.Write(secret)
+		return err
+	}
+
+	// only the recipient should be able to read the secret
+	return ioutil.WriteFile(*output, secret, 0600)
+}
+
+// splits a url printed by unus send -url into the server, id and passphrase
+func parse_secret_url(raw string) (string, string, string, error) {
+	secret_url, err := url.Parse(raw)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	// tolerates a single trailing slash, as pasted urls often have one
+	secret_path := strings.TrimSuffix(secret_url.Path, "/")
+	id := path.Base(secret_path)
+	server_path, named := strings.CutSuffix(secret_path, client.SECRETS_PATH+"/"+id)
+
+	passphrase, ok := secret_url.User.Password()
+	if !ok || passphrase == "" || !named {
+		return "", "", "", errors.New("url does not name a secret and passphrase")
+	}
+
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return "", "", "", errors.New("badly-formed secret id")
+	}
+
+	secret_url.User = nil
+	secret_url.Path = server_path
+	return secret_url.String(), id, passphrase, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"code.leif.uk/lwg/unus/internal/unus"
+	"code.leif.uk/lwg/unus/internal/unus/config"
+)
+
+// rewraps every stored secret with the last of the configured master keys
+func rekey(arguments []string) error {
+	cfg, err := config.Load("unus rekey", arguments)
+	if err != nil {
+		return err
+	}
+
+	rewrapped, err := unus.Rekey(cfg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "rewrapped %d secrets\n", rewrapped)
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"code.leif.uk/lwg/unus/pkg/client"
+	ecies "code.leif.uk/lwg/unus/pkg/go-ecies"
+)
+
+const (
+	DEFAULT_SERVER = "http://127.0.0.1:8080"
+	SERVER_ENV     = "UNUS_SERVER"
+)
+
+// returns the server to talk to, unless overridden by -server
+func default_server() string {
+	if server, ok := os.LookupEnv(SERVER_ENV); ok {
+		return server
+	}
+	return DEFAULT_SERVER
+}
+
+// shares a file, or stdin, as a secret and prints how to retrieve it
+func send(arguments []string) error {
+	flags := flag.NewFlagSet("unus send", flag.ContinueOnError)
+	server := flags.String("server", default_server(), "unus server to send to ("+SERVER_ENV+")")
+	ttl := flags.Duration("ttl", 0, "how long the secret lives for, if not the server's default")
+	content_type := flags.String("content-type", "", "content type of the secret, if not detected")
+	server_encrypted := flags.Bool("server-encrypted", false, "let the server encrypt the secret, rather than sealing it locally")
+	recipients := flags.Int("recipients", 1, "number of passphrases to give a server-encrypted secret, any one of which retrieves it")
+	signing_key_path := flags.String("signing-key", "", "path to a PEM private key to sign the secret with, for servers which only accept trusted senders")
+	as_url := flags.Bool("url", false, "print a single url to retrieve the secret with")
+	as_json := flags.Bool("json", false, "print the server's json response")
+	if err := flags.Parse(arguments); err != nil {
+		return err
+	}
+
+	var input io.Reader = os.Stdin
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	default:
+		return errors.New("send takes at most one file")
+	}
+
+	content, err := ioutil.ReadAll(input)
+	if err != nil {
+		return err
+	}
+
+	if *content_type == "" {
+		*content_type = detect_content_type(content)
+	}
+
+	var signing_key crypto.Signer
+	if *signing_key_path != "" {
+		signing_key, err = load_signing_key(*signing_key_path)
+		if err != nil {
+			return err
+		}
+	}
+
+	c, err := client.NewClient(*server, nil)
+	if err != nil {
+		return err
+	}
+
+	receipt, err := c.Create(context.Background(), *content_type, bytes.NewReader(content), &client.CreateOptions{
+		TTL:             *ttl,
+		ServerEncrypted: *server_encrypted,
+		Recipients:      *recipients,
+		SigningKey:      signing_key,
+	})
+	if err != nil {
+		return err
+	}
+
+	// one for each recipient
+	passphrases := receipt.Passphrases
+	if len(passphrases) == 0 {
+		passphrases = []string{receipt.Passphrase}
+	}
+
+	switch {
+	case *as_json:
+		return json.NewEncoder(os.Stdout).Encode(receipt)
+	case *as_url:
+		for _, passphrase := range passphrases {
+			fmt.Println(secret_url(*server, receipt.Id, passphrase))
+		}
+	default:
+		fmt.Printf("id:         %d\n", receipt.Id)
+		for _, passphrase := range passphrases {
+			fmt.Printf("passphrase: %s\n", passphrase)
+		}
+		fmt.Printf("expires:    %s\n", receipt.ExpiresAt.Local())
+	}
+	return nil
+}
+
+// loads the key to sign secrets with from a PEM file
+func load_signing_key(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signing_key, err := ecies.ParseSigningKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return signing_key, nil
+}
+
+// guesses the content type of the secret, falling back to plain text
+func detect_content_type(content []byte) string {
+	if json.Valid(content) {
+		return "application/json"
+	}
+
+	media_type, _, err := mime.ParseMediaType(http.DetectContentType(content))
+	if err != nil || media_type == "application/octet-stream" {
+		return "text/plain"
+	}
+	return media_type
+}
+
+// builds a url holding everything needed to retrieve the secret, with the
+// passphrase as the basic auth password
+func secret_url(server string, id int64, passphrase string) string {
+	secret_url, err := url.Parse(server)
+	if err != nil {
+		return ""
+	}
+
+	secret_url.User = url.UserPassword("", passphrase)
+	secret_url.Path = strings.TrimSuffix(secret_url.Path, "/") + client.SECRETS_PATH + "/" + strconv.FormatInt(id, 10)
+	return secret_url.String()
+}
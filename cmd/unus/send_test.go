@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSecretURL(t *testing.T) {
+	tests := []struct {
+		server     string
+		id         int64
+		passphrase string
+		want       string
+	}{
+		{"https://unus.example.com", 1, "correct-horse", "https://:correct-horse@unus.example.com/api/v1/secrets/1"},
+		{"https://unus.example.com/", 2, "correct-horse", "https://:correct-horse@unus.example.com/api/v1/secrets/2"},
+		{"https://unus.example.com/prefix", 3, "correct-horse", "https://:correct-horse@unus.example.com/prefix/api/v1/secrets/3"},
+		{"https://unus.example.com/prefix/", 4, "correct-horse", "https://:correct-horse@unus.example.com/prefix/api/v1/secrets/4"},
+		{"http://127.0.0.1:8080", 9223372036854775807, "correct-horse", "http://:correct-horse@127.0.0.1:8080/api/v1/secrets/9223372036854775807"},
+		{"https://unus.example.com", 5, "a b/c@d:e", "https://:a%20b%2Fc%40d%3Ae@unus.example.com/api/v1/secrets/5"},
+		{"://unus.example.com", 6, "correct-horse", ""},
+	}
+
+	for _, test := range tests {
+		if got := secret_url(test.server, test.id, test.passphrase); got != test.want {
+			t.Errorf("secret_url(%q, %d, %q) gave %q, want %q", test.server, test.id, test.passphrase, got, test.want)
+		}
+	}
+}
+
+func TestSecretURLRoundTrip(t *testing.T) {
+	for _, server := range []string{"https://unus.example.com", "https://unus.example.com/prefix/", "http://127.0.0.1:8080"} {
+		raw := secret_url(server, 42, "a b/c@d:e")
+
+		got_server, id, passphrase, err := parse_secret_url(raw)
+		if err != nil {
+			t.Fatalf("%q: %v", raw, err)
+		}
+
+		want_server := server
+		if want_server[len(want_server)-1] == '/' {
+			want_server = want_server[:len(want_server)-1]
+		}
+		if got_server != want_server || id != "42" || passphrase != "a b/c@d:e" {
+			t.Errorf("%q gave server %q, id %q and passphrase %q", raw, got_server, id, passphrase)
+		}
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"empty", []byte{}, "text/plain"},
+		{"text", []byte("hunter2"), "text/plain"},
+		{"text with a json prefix", []byte("{not json"), "text/plain"},
+		{"json object", []byte(`{"user": "admin", "password": "hunter2"}`), "application/json"},
+		{"json string", []byte(`"hunter2"`), "application/json"},
+		{"json number", []byte("42"), "application/json"},
+		{"html", []byte("<!DOCTYPE html><p>hunter2</p>"), "text/html"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), "image/png"},
+		{"pdf", []byte("%PDF-1.7\n"), "application/pdf"},
+		{"binary", []byte{0x00, 0x01, 0x02, 0xfe, 0xff}, "text/plain"},
+	}
+
+	for _, test := range tests {
+		if got := detect_content_type(test.content); got != test.want {
+			t.Errorf("%s: detected %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -1,13 +1,15 @@
 module code.leif.uk/lwg/unus
 
-go 1.17
+go 1.24
 
 require github.com/tjarratt/babble v0.0.0-20210505082055-cbca2a4833c1
 
-require golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3 // indirect
+require golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/mattn/go-sqlite3 v1.14.10
 	github.com/onsi/ginkgo v1.16.5 // indirect
 	github.com/onsi/gomega v1.17.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
 )
@@ -0,0 +1,146 @@
+package unus
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// _certificate serves a tls certificate loaded from disk, reloading it when
+// either file changes or the process receives SIGHUP. connections already
+// established keep the certificate they were given.
+type _certificate struct {
+	certificate_path string
+	key_path         string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	modified    time.Time
+
+	ticker  *time.Ticker
+	hangups chan os.Signal
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// loads the certificate and key pair, then checks them for changes every
+// interval. an error is returned if the pair cannot be loaded.
+func newCertificate(certificate_path, key_path string, interval time.Duration) (*_certificate, error) {
+	certificate := &_certificate{
+		certificate_path: certificate_path,
+		key_path:         key_path,
+		ticker:           time.NewTicker(interval),
+		hangups:          make(chan os.Signal, 1),
+		done:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+	}
+
+	if err := certificate.load(); err != nil {
+		certificate.ticker.Stop()
+		return nil, err
+	}
+
+	signal.Notify(certificate.hangups, syscall.SIGHUP)
+
+	go func() {
+		defer close(certificate.stopped)
+
+		for {
+			select {
+			case <-certificate.done:
+				return
+			case <-certificate.hangups:
+				certificate.reload(true)
+			case <-certificate.ticker.C:
+				certificate.reload(false)
+			}
+		}
+	}()
+
+	return certificate, nil
+}
+
+// returns the last modification time of whichever file changed most recently
+func (c *_certificate) last_modified() (time.Time, error) {
+	var modified time.Time
+	for _, path := range []string{c.certificate_path, c.key_path} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+// loads the certificate and key pair from disk, replacing the current pair
+// only if the new one is valid
+func (c *_certificate) load() error {
+	modified, err := c.last_modified()
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.certificate_path, c.key_path)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.certificate = &certificate
+	c.modified = modified
+	return nil
+}
+
+// reloads the certificate if forced or if either file has changed since it
+// was last loaded. failures are logged and the current certificate is kept.
+func (c *_certificate) reload(force bool) {
+	if !force {
+		modified, err := c.last_modified()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		c.mutex.RLock()
+		unchanged := modified.Equal(c.modified)
+		c.mutex.RUnlock()
+
+		if unchanged {
+			return
+		}
+	}
+
+	if err := c.load(); err != nil {
+		log.Printf("keeping current certificate: %s\n", err)
+		return
+	}
+
+	log.Println("reloaded tls certificate")
+}
+
+// returns the current certificate, for use in tls.Config
+func (c *_certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.certificate, nil
+}
+
+// stops watching for changes to the certificate, waiting for any reload in
+// progress to finish
+func (c *_certificate) Dispose() {
+	signal.Stop(c.hangups)
+	c.ticker.Stop()
+	close(c.done)
+	<-c.stopped
+}
@@ -0,0 +1,317 @@
+package unus
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"code.leif.uk/lwg/unus/internal/unus/config"
+)
+
+// test_pki is a self-signed certificate authority, which issues certificates
+// for localhost into a directory
+type test_pki struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pool        *x509.CertPool
+
+	certificate_path string
+	key_path         string
+}
+
+func new_test_pki(t *testing.T) *test_pki {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "unus test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+
+	dir := t.TempDir()
+	return &test_pki{
+		certificate:      certificate,
+		key:              key,
+		pool:             pool,
+		certificate_path: filepath.Join(dir, "certificate.pem"),
+		key_path:         filepath.Join(dir, "key.pem"),
+	}
+}
+
+// issue writes a new certificate for localhost with the given serial number,
+// and its key, over the last. both files are dated serial seconds from now, so
+// that every issue is seen as a change.
+func (p *test_pki) issue(t *testing.T, serial int64) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.certificate, &key.PublicKey, p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key_der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.write(t, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key_der}), serial)
+}
+
+// write replaces the certificate and key files, dated serial seconds from now
+func (p *test_pki) write(t *testing.T, certificate []byte, key []byte, serial int64) {
+	t.Helper()
+
+	modified := time.Now().Add(time.Duration(serial) * time.Second)
+	for path, data := range map[string][]byte{p.key_path: key, p.certificate_path: certificate} {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// handshake connects to address over tls, trusting only the test ca, and
+// returns the serial number of the leaf certificate presented
+func (p *test_pki) handshake(t *testing.T, address string) int64 {
+	t.Helper()
+
+	connection, err := tls.Dial("tcp", address, &tls.Config{RootCAs: p.pool, ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+
+	return connection.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+// served_serial returns the serial number of the certificate being served
+func served_serial(t *testing.T, certificate *_certificate) int64 {
+	t.Helper()
+
+	served, err := certificate.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(served.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+// eventually polls check until it returns true, failing the test if it
+// hasn't within five seconds
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// free_address returns a local address nothing is listening on
+func free_address(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+func TestServeTLS(t *testing.T) {
+	pki := new_test_pki(t)
+	pki.issue(t, 2)
+
+	cfg := config.Default()
+	cfg.Storage = config.STORAGE_MEMORY
+	cfg.ListenAddress = free_address(t)
+	cfg.RedirectAddress = free_address(t)
+	cfg.TLSCertificate = pki.certificate_path
+	cfg.TLSKey = pki.key_path
+	cfg.TLSReloadInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, cfg)
+	}()
+
+	// wait for it to start listening
+	eventually(t, "unus to listen", func() bool {
+		connection, err := net.Dial("tcp", cfg.ListenAddress)
+		if err == nil {
+			connection.Close()
+		}
+		return err == nil
+	})
+
+	if serial := pki.handshake(t, cfg.ListenAddress); serial != 2 {
+		t.Fatalf("handshake saw certificate %d, want 2", serial)
+	}
+
+	// new handshakes see the new certificate once it is noticed
+	pki.issue(t, 3)
+	eventually(t, "the new certificate", func() bool {
+		return pki.handshake(t, cfg.ListenAddress) == 3
+	})
+
+	// plain http is redirected to https on the listen address
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err := client.Get("http://" + cfg.RedirectAddress + "/api/v1/secrets?ttl=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	_, port, _ := net.SplitHostPort(cfg.ListenAddress)
+	want := "https://127.0.0.1:" + port + "/api/v1/secrets?ttl=1h"
+	if response.StatusCode != http.StatusPermanentRedirect || response.Header.Get("Location") != want {
+		t.Fatalf("redirect gave %d to %q, want %d to %q", response.StatusCode, response.Header.Get("Location"), http.StatusPermanentRedirect, want)
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateReloadOnHangup(t *testing.T) {
+	pki := new_test_pki(t)
+	pki.issue(t, 2)
+
+	// too long to ever tick during the test
+	certificate, err := newCertificate(pki.certificate_path, pki.key_path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer certificate.Dispose()
+
+	pki.issue(t, 3)
+	if serial := served_serial(t, certificate); serial != 2 {
+		t.Fatalf("serving certificate %d before SIGHUP, want 2", serial)
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the new certificate", func() bool {
+		return served_serial(t, certificate) == 3
+	})
+}
+
+func TestCertificateKeptOnBadReload(t *testing.T) {
+	pki := new_test_pki(t)
+	pki.issue(t, 2)
+
+	certificate, err := newCertificate(pki.certificate_path, pki.key_path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer certificate.Dispose()
+
+	pki.write(t, []byte("not a certificate"), []byte("not a key"), 3)
+
+	// give it a few chances to load the broken pair
+	time.Sleep(100 * time.Millisecond)
+	if serial := served_serial(t, certificate); serial != 2 {
+		t.Fatalf("serving certificate %d after a bad reload, want 2", serial)
+	}
+
+	// and it recovers once the pair is fixed
+	pki.issue(t, 4)
+	eventually(t, "the fixed certificate", func() bool {
+		return served_serial(t, certificate) == 4
+	})
+}
+
+func TestNewCertificateMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newCertificate(filepath.Join(dir, "certificate.pem"), filepath.Join(dir, "key.pem"), time.Minute); err == nil {
+		t.Fatal("loaded a certificate which doesn't exist")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		https_address string
+		host          string
+		want          string
+	}{
+		{":443", "unus.example.com", "https://unus.example.com/api/v1/secrets/1?a=b"},
+		{":443", "unus.example.com:80", "https://unus.example.com/api/v1/secrets/1?a=b"},
+		{":8443", "unus.example.com:8080", "https://unus.example.com:8443/api/v1/secrets/1?a=b"},
+		{"127.0.0.1:8443", "[::1]:8080", "https://[::1]:8443/api/v1/secrets/1?a=b"},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodDelete, "http://"+test.host+"/api/v1/secrets/1?a=b", nil)
+		response := serve(newRedirectHandler(test.https_address), request)
+
+		if response.Code != http.StatusPermanentRedirect || response.Header().Get("Location") != test.want {
+			t.Errorf("redirect from %s to %s gave %d to %q, want %d to %q", test.host, test.https_address, response.Code, response.Header().Get("Location"), http.StatusPermanentRedirect, test.want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	ENV_PREFIX  = "UNUS_"
+	CONFIG_FLAG = "config"
+
+	STORAGE_SQLITE3 = "sqlite3"
+	STORAGE_MEMORY  = "memory"
+)
+
+// Config holds every setting the unus server can be given. Settings are read
+// from, in increasing order of precedence, the defaults, an optional TOML
+// file, UNUS_* environment variables and command-line flags.
+type Config struct {
+	ListenAddress   string        `toml:"listen_address"`
+	Storage         string        `toml:"storage"`
+	DatabasePath    string        `toml:"database_path"`
+	MaxSecretSize   int64         `toml:"max_secret_size"`
+	DefaultTTL      time.Duration `toml:"default_ttl"`
+	MaxTTL          time.Duration `toml:"max_ttl"`
+	ReapInterval    time.Duration `toml:"reap_interval"`
+	MaxAttempts     int           `toml:"max_attempts"`
+	PassphraseWords int           `toml:"passphrase_words"`
+	MaxRecipients   int           `toml:"max_recipients"`
+	MaxDerivations  int           `toml:"max_derivations"`
+	ContentTypes    []string      `toml:"content_types"`
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout"`
+	TrustedSenders  string        `toml:"trusted_senders"`
+	MasterKeys      string        `toml:"master_keys"`
+	MasterKeysFile  string        `toml:"master_keys_file"`
+
+	TLSCertificate    string        `toml:"tls_certificate"`
+	TLSKey            string        `toml:"tls_key"`
+	TLSReloadInterval time.Duration `toml:"tls_reload_interval"`
+	RedirectAddress   string        `toml:"redirect_address"`
+}
+
+// option describes a single setting, named as a flag. Its environment variable
+// is the name in upper case with dashes replaced by underscores, prefixed with
+// UNUS_, and its TOML key is the name with dashes replaced by underscores.
+type option struct {
+	name  string
+	usage string
+	set   func(config *Config, value string) error
+}
+
+var options = []option{
+	{"listen-address", "address to listen on for http", func(c *Config, v string) error {
+		c.ListenAddress = v
+		return nil
+	}},
+	{"storage", "where to keep secrets, one of sqlite3 or memory", func(c *Config, v string) error {
+		c.Storage = v
+		return nil
+	}},
+	{"database-path", "path to the sqlite3 database", func(c *Config, v string) error {
+		c.DatabasePath = v
+		return nil
+	}},
+	{"max-secret-size", "largest secret accepted, in bytes", func(c *Config, v string) error {
+		return parse_int64(v, &c.MaxSecretSize)
+	}},
+	{"default-ttl", "how long secrets live if no ttl is requested", func(c *Config, v string) error {
+		return parse_duration(v, &c.DefaultTTL)
+	}},
+	{"max-ttl", "longest ttl a secret may request", func(c *Config, v string) error {
+		return parse_duration(v, &c.MaxTTL)
+	}},
+	{"reap-interval", "how often expired secrets are purged", func(c *Config, v string) error {
+		return parse_duration(v, &c.ReapInterval)
+	}},
+	{"max-attempts", "wrong passphrases allowed before a secret is destroyed", func(c *Config, v string) error {
+		return parse_int(v, &c.MaxAttempts)
+	}},
+	{"passphrase-words", "number of words in generated passphrases", func(c *Config, v string) error {
+		return parse_int(v, &c.PassphraseWords)
+	}},
+	{"max-recipients", "most passphrases a server-encrypted secret may be given", func(c *Config, v string) error {
+		return parse_int(v, &c.MaxRecipients)
+	}},
+	{"max-derivations", "most passphrase key derivations run at once, beyond which requests are refused", func(c *Config, v string) error {
+		return parse_int(v, &c.MaxDerivations)
+	}},
+	{"content-types", "comma-separated list of accepted content types", func(c *Config, v string) error {
+		c.ContentTypes = parse_list(v)
+		return nil
+	}},
+	{"shutdown-timeout", "how long in-flight requests are given to finish on shutdown", func(c *Config, v string) error {
+		return parse_duration(v, &c.ShutdownTimeout)
+	}},
+	{"trusted-senders", "path to PEM public keys, secrets must then be signed by one of them", func(c *Config, v string) error {
+		c.TrustedSenders = v
+		return nil
+	}},
+	{"master-keys", "master keys to wrap stored secrets with, as comma-separated id:base64 pairs, the last wraps new secrets", func(c *Config, v string) error {
+		c.MasterKeys = v
+		return nil
+	}},
+	{"master-keys-file", "path to a file of master keys, one id:base64 pair per line", func(c *Config, v string) error {
+		c.MasterKeysFile = v
+		return nil
+	}},
+	{"tls-certificate", "path to a PEM certificate chain, enables https", func(c *Config, v string) error {
+		c.TLSCertificate = v
+		return nil
+	}},
+	{"tls-key", "path to the PEM private key for the certificate", func(c *Config, v string) error {
+		c.TLSKey = v
+		return nil
+	}},
+	{"tls-reload-interval", "how often the certificate and key are checked for changes", func(c *Config, v string) error {
+		return parse_duration(v, &c.TLSReloadInterval)
+	}},
+	{"redirect-address", "address to listen on for http, redirecting to https", func(c *Config, v string) error {
+		c.RedirectAddress = v
+		return nil
+	}},
+}
+
+// Default returns the configuration unus uses when given no other settings
+func Default() *Config {
+	return &Config{
+		ListenAddress:   ":8080",
+		Storage:         STORAGE_SQLITE3,
+		DatabasePath:    "unus.db",
+		MaxSecretSize:   1048576,
+		DefaultTTL:      24 * time.Hour,
+		MaxTTL:          7 * 24 * time.Hour,
+		ReapInterval:    time.Minute,
+		MaxAttempts:     5,
+		PassphraseWords: 4,
+		MaxRecipients:   5,
+		MaxDerivations:  4,
+		ContentTypes:    []string{"text/plain", "image/png", "image/jpeg", "application/json"},
+		ShutdownTimeout: 30 * time.Second,
+
+		TLSReloadInterval: time.Minute,
+	}
+}
+
+// Load builds the configuration from the defaults, the TOML file named by the
+// -config flag or UNUS_CONFIG, UNUS_* environment variables and the given
+// command-line arguments, each overriding the last. An error is returned if
+// any setting cannot be parsed, or if the result is not valid.
+func Load(name string, arguments []string) (*Config, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	config_path := flags.String(CONFIG_FLAG, os.Getenv(env_name(CONFIG_FLAG)), "path to an optional TOML configuration file (UNUS_CONFIG)")
+
+	// flags are applied last, so hold on to them until then
+	type setting struct {
+		option option
+		value  string
+	}
+	var pending []setting
+	for _, o := range options {
+		o := o
+		usage := fmt.Sprintf("%s (%s)", o.usage, env_name(o.name))
+		flags.Func(o.name, usage, func(value string) error {
+			pending = append(pending, setting{option: o, value: value})
+			return o.set(&Config{}, value)
+		})
+	}
+
+	if err := flags.Parse(arguments); err != nil {
+		return nil, err
+	}
+
+	config := Default()
+
+	if *config_path != "" {
+		metadata, err := toml.DecodeFile(*config_path, config)
+		if err != nil {
+			return nil, err
+		}
+
+		if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("%s: unknown setting %q", *config_path, undecoded[0].String())
+		}
+	}
+
+	for _, o := range options {
+		value, ok := os.LookupEnv(env_name(o.name))
+		if !ok {
+			continue
+		}
+
+		if err := o.set(config, value); err != nil {
+			return nil, fmt.Errorf("%s: %v", env_name(o.name), err)
+		}
+	}
+
+	for _, s := range pending {
+		// already validated during parsing
+		s.option.set(config, s.value)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Validate returns an error describing the first setting found to be invalid
+func (c *Config) Validate() error {
+	switch {
+	case c.ListenAddress == "":
+		return errors.New("listen address must be set")
+	case c.Storage != STORAGE_SQLITE3 && c.Storage != STORAGE_MEMORY:
+		return fmt.Errorf("storage must be %s or %s", STORAGE_SQLITE3, STORAGE_MEMORY)
+	case c.Storage == STORAGE_SQLITE3 && c.DatabasePath == "":
+		return errors.New("database path must be set to use sqlite3")
+	case c.MaxSecretSize <= 0:
+		return errors.New("max secret size must be greater than 0")
+	case c.DefaultTTL <= 0:
+		return errors.New("default ttl must be greater than 0s")
+	case c.MaxTTL < c.DefaultTTL:
+		return errors.New("max ttl must be at least the default ttl")
+	case c.ReapInterval <= 0:
+		return errors.New("reap interval must be greater than 0s")
+	case c.MaxAttempts <= 0:
+		return errors.New("max attempts must be greater than 0")
+	case c.PassphraseWords <= 0:
+		return errors.New("passphrase words must be greater than 0")
+	case c.MaxRecipients <= 0:
+		return errors.New("max recipients must be greater than 0")
+	case c.MaxDerivations <= 0:
+		return errors.New("max derivations must be greater than 0")
+	case len(c.ContentTypes) == 0:
+		return errors.New("at least one content type must be accepted")
+	case !media_types(c.ContentTypes):
+		return errors.New("content types must each be a lower case type/subtype, without parameters")
+	case c.ShutdownTimeout <= 0:
+		return errors.New("shutdown timeout must be greater than 0s")
+	case c.MasterKeys != "" && c.MasterKeysFile != "":
+		return errors.New("master keys and master keys file can't be set together")
+	case (c.TLSCertificate == "") != (c.TLSKey == ""):
+		return errors.New("tls certificate and key must be set together")
+	case c.TLSCertificate != "" && c.TLSReloadInterval <= 0:
+		return errors.New("tls reload interval must be greater than 0s")
+	case c.RedirectAddress != "" && c.TLSCertificate == "":
+		return errors.New("redirect address requires a tls certificate")
+	}
+
+	return nil
+}
+
+// AllowsContentType returns true if secrets of the given content type are
+// accepted
+func (c *Config) AllowsContentType(content_type string) bool {
+	for _, allowed := range c.ContentTypes {
+		if content_type == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// media_types returns true if every content type is a bare media type, as
+// AllowsContentType compares them exactly
+func media_types(content_types []string) bool {
+	for _, content_type := range content_types {
+		media_type, params, err := mime.ParseMediaType(content_type)
+		if err != nil || len(params) > 0 || media_type != content_type || !strings.Contains(media_type, "/") {
+			return false
+		}
+	}
+	return true
+}
+
+// env_name returns the environment variable for the named option
+func env_name(name string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func parse_int(value string, into *int) error {
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+
+	*into = parsed
+	return nil
+}
+
+func parse_int64(value string, into *int64) error {
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	*into = parsed
+	return nil
+}
+
+func parse_duration(value string, into *time.Duration) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*into = parsed
+	return nil
+}
+
+// splits a comma-separated list, dropping any empty entries
+func parse_list(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
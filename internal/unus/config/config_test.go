@@ -0,0 +1,273 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// write_config writes the TOML to a file, returning its path
+func write_config(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "unus.toml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// clear_env unsets every UNUS_* variable for the duration of the test, so
+// that the environment running the tests can't change their outcome
+func clear_env(t *testing.T) {
+	t.Helper()
+
+	for _, name := range append([]string{CONFIG_FLAG}, option_names()...) {
+		t.Setenv(env_name(name), "")
+		os.Unsetenv(env_name(name))
+	}
+}
+
+func option_names() []string {
+	names := make([]string, len(options))
+	for i, o := range options {
+		names[i] = o.name
+	}
+	return names
+}
+
+func TestLoadDefaults(t *testing.T) {
+	clear_env(t)
+
+	config, err := Load("unus", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(config, Default()) {
+		t.Fatalf("loaded %+v, want the defaults %+v", config, Default())
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	toml := `
+listen_address = ":1000"
+max_attempts = 10
+default_ttl = "2h"
+reap_interval = "2m"
+content_types = ["text/plain"]
+`
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		arguments []string
+		want      func(config *Config)
+	}{
+		{"file over defaults", nil, nil, func(c *Config) {
+			c.ListenAddress = ":1000"
+			c.MaxAttempts = 10
+			c.DefaultTTL = 2 * time.Hour
+			c.ReapInterval = 2 * time.Minute
+			c.ContentTypes = []string{"text/plain"}
+		}},
+		{"environment over file", map[string]string{
+			"UNUS_LISTEN_ADDRESS": ":2000",
+			"UNUS_MAX_ATTEMPTS":   "20",
+			"UNUS_CONTENT_TYPES":  "image/png, application/json,",
+		}, nil, func(c *Config) {
+			c.ListenAddress = ":2000"
+			c.MaxAttempts = 20
+			c.DefaultTTL = 2 * time.Hour
+			c.ReapInterval = 2 * time.Minute
+			c.ContentTypes = []string{"image/png", "application/json"}
+		}},
+		{"flags over environment", map[string]string{
+			"UNUS_LISTEN_ADDRESS": ":2000",
+			"UNUS_MAX_ATTEMPTS":   "20",
+		}, []string{"-listen-address", ":3000", "-default-ttl", "3h"}, func(c *Config) {
+			c.ListenAddress = ":3000"
+			c.MaxAttempts = 20
+			c.DefaultTTL = 3 * time.Hour
+			c.ReapInterval = 2 * time.Minute
+			c.ContentTypes = []string{"text/plain"}
+		}},
+		{"last flag wins", nil, []string{"-max-attempts", "30", "-max-attempts", "40"}, func(c *Config) {
+			c.ListenAddress = ":1000"
+			c.MaxAttempts = 40
+			c.DefaultTTL = 2 * time.Hour
+			c.ReapInterval = 2 * time.Minute
+			c.ContentTypes = []string{"text/plain"}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clear_env(t)
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			arguments := append([]string{"-config", write_config(t, toml)}, test.arguments...)
+			config, err := Load("unus", arguments)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := Default()
+			test.want(want)
+			if !reflect.DeepEqual(config, want) {
+				t.Fatalf("loaded %+v, want %+v", config, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFromEnvironment(t *testing.T) {
+	clear_env(t)
+	t.Setenv(env_name(CONFIG_FLAG), write_config(t, `max_recipients = 9`))
+
+	config, err := Load("unus", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxRecipients != 9 {
+		t.Fatalf("max recipients is %d, want 9", config.MaxRecipients)
+	}
+
+	// the flag names another file
+	config, err = Load("unus", []string{"-config", write_config(t, `max_recipients = 7`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxRecipients != 7 {
+		t.Fatalf("max recipients is %d, want 7", config.MaxRecipients)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		toml      string
+		env       map[string]string
+		arguments []string
+	}{
+		{"unknown setting in file", `max_atempts = 3`, nil, nil},
+		{"wrong type in file", `max_attempts = "three"`, nil, nil},
+		{"bad environment value", "", map[string]string{"UNUS_MAX_ATTEMPTS": "three"}, nil},
+		{"bad duration in environment", "", map[string]string{"UNUS_DEFAULT_TTL": "a day"}, nil},
+		{"bad flag value", "", nil, []string{"-max-ttl", "a week"}},
+		{"unknown flag", "", nil, []string{"-max-atempts", "3"}},
+		{"invalid result", "", nil, []string{"-max-attempts", "0"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clear_env(t)
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			arguments := append([]string{"-config", write_config(t, test.toml)}, test.arguments...)
+			if config, err := Load("unus", arguments); err == nil {
+				t.Fatalf("loaded %+v", config)
+			}
+		})
+	}
+
+	clear_env(t)
+	if _, err := Load("unus", []string{"-config", filepath.Join(t.TempDir(), "missing.toml")}); err == nil {
+		t.Fatal("loaded a missing config file")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(c *Config)
+		want      string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"memory storage without a database path", func(c *Config) {
+			c.Storage = STORAGE_MEMORY
+			c.DatabasePath = ""
+		}, ""},
+		{"no listen address", func(c *Config) { c.ListenAddress = "" }, "listen address"},
+		{"unknown storage", func(c *Config) { c.Storage = "postgres" }, "storage"},
+		{"sqlite3 without a database path", func(c *Config) { c.DatabasePath = "" }, "database path"},
+		{"zero max secret size", func(c *Config) { c.MaxSecretSize = 0 }, "max secret size"},
+		{"zero default ttl", func(c *Config) { c.DefaultTTL = 0 }, "default ttl"},
+		{"negative default ttl", func(c *Config) { c.DefaultTTL = -time.Hour }, "default ttl"},
+		{"max ttl below default ttl", func(c *Config) { c.MaxTTL = c.DefaultTTL - time.Second }, "max ttl"},
+		{"zero reap interval", func(c *Config) { c.ReapInterval = 0 }, "reap interval"},
+		{"zero max attempts", func(c *Config) { c.MaxAttempts = 0 }, "max attempts"},
+		{"negative max attempts", func(c *Config) { c.MaxAttempts = -1 }, "max attempts"},
+		{"zero passphrase words", func(c *Config) { c.PassphraseWords = 0 }, "passphrase words"},
+		{"zero max recipients", func(c *Config) { c.MaxRecipients = 0 }, "max recipients"},
+		{"zero max derivations", func(c *Config) { c.MaxDerivations = 0 }, "max derivations"},
+		{"no content types", func(c *Config) { c.ContentTypes = nil }, "content type"},
+		{"content type without a subtype", func(c *Config) { c.ContentTypes = []string{"text/plain", "text"} }, "content types"},
+		{"content type with parameters", func(c *Config) { c.ContentTypes = []string{"text/plain; charset=utf-8"} }, "content types"},
+		{"upper case content type", func(c *Config) { c.ContentTypes = []string{"Text/Plain"} }, "content types"},
+		{"malformed content type", func(c *Config) { c.ContentTypes = []string{"text/plain/extra"} }, "content types"},
+		{"zero shutdown timeout", func(c *Config) { c.ShutdownTimeout = 0 }, "shutdown timeout"},
+		{"master keys and master keys file", func(c *Config) {
+			c.MasterKeys = "1:a2V5"
+			c.MasterKeysFile = "keys"
+		}, "master keys"},
+		{"tls certificate without a key", func(c *Config) { c.TLSCertificate = "cert.pem" }, "tls certificate and key"},
+		{"tls key without a certificate", func(c *Config) { c.TLSKey = "key.pem" }, "tls certificate and key"},
+		{"tls with zero reload interval", func(c *Config) {
+			c.TLSCertificate = "cert.pem"
+			c.TLSKey = "key.pem"
+			c.TLSReloadInterval = 0
+		}, "tls reload interval"},
+		{"redirect without tls", func(c *Config) { c.RedirectAddress = ":80" }, "redirect address"},
+		{"redirect with tls", func(c *Config) {
+			c.TLSCertificate = "cert.pem"
+			c.TLSKey = "key.pem"
+			c.RedirectAddress = ":80"
+		}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := Default()
+			test.configure(config)
+
+			err := config.Validate()
+			switch {
+			case test.want == "" && err != nil:
+				t.Fatalf("invalid: %v", err)
+			case test.want != "" && err == nil:
+				t.Fatal("valid")
+			case test.want != "" && !strings.Contains(err.Error(), test.want):
+				t.Fatalf("gave %q, want it to mention %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestAllowsContentType(t *testing.T) {
+	config := Default()
+	config.ContentTypes = []string{"text/plain", "image/png"}
+
+	tests := map[string]bool{
+		"text/plain":                true,
+		"image/png":                 true,
+		"image/jpeg":                false,
+		"":                          false,
+		"text/plain; charset=utf-8": false,
+		"TEXT/PLAIN":                false,
+		"text/plain ":               false,
+	}
+
+	for content_type, want := range tests {
+		if got := config.AllowsContentType(content_type); got != want {
+			t.Errorf("AllowsContentType(%q) is %t, want %t", content_type, got, want)
+		}
+	}
+}
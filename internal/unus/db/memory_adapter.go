@@ -0,0 +1,181 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type memory struct {
+	mutex       sync.Mutex
+	cryptograms map[int64]Cryptogram
+}
+
+// creates an empty in-memory store, whose contents are lost on disposal
+func NewMemoryStore() *memory {
+	return &memory{cryptograms: make(map[int64]Cryptogram)}
+}
+
+// forgets every cryptogram held
+func (m *memory) Dispose() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.cryptograms = make(map[int64]Cryptogram)
+}
+
+// insert the given cryptogram into the store
+// return the index on success, else an error
+func (m *memory) InsertCryptogram(cryptogram *Cryptogram) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.cryptograms[cryptogram.Id]; ok {
+		return -1, errors.New("secret already exists")
+	}
+
+	stored := *cryptogram
+	stored.Data = append([]byte(nil), cryptogram.Data...)
+	stored.Verifier = append([]byte(nil), cryptogram.Verifier...)
+	m.cryptograms[cryptogram.Id] = stored
+
+	return cryptogram.Id, nil
+}
+
+// fetches the cryptogram by id, deleting it only if open succeeds
+// the attempt is counted, and the cryptogram copied, under the lock. open runs
+// without it, so a slow open never holds up the rest of the store. whoever
+// deletes the cryptogram first wins, so only one caller can ever succeed. if
+// open denies the attempt, the count stands and the cryptogram is deleted once
+// it reaches max_attempts. for any other failure, the attempt is refunded.
+func (m *memory) TakeCryptogram(id int64, max_attempts int, open func(cryptogram *Cryptogram) error) error {
+	cryptogram, err := m.count_attempt(id)
+	if err != nil {
+		return err
+	}
+
+	// attempts made by others in the meantime may have used up the limit
+	if cryptogram.Attempts >= max_attempts {
+		m.DeleteCryptogram(id)
+		return ErrTooManyAttempts
+	}
+
+	err = open(cryptogram)
+	switch {
+	case err == nil:
+		// another caller took it, or used up its attempts, while it was open
+		if deleted, _ := m.DeleteCryptogram(id); deleted == 0 {
+			return ErrNotFound
+		}
+		return nil
+	case !errors.Is(err, ErrDenied):
+		m.refund_attempt(id)
+		return err
+	case cryptogram.Attempts+1 >= max_attempts:
+		m.DeleteCryptogram(id)
+		return ErrTooManyAttempts
+	default:
+		return err
+	}
+}
+
+// counts an attempt against the cryptogram by id and returns a copy of it,
+// with the number of attempts made before this one. expired cryptograms are
+// burned rather than waiting for the reaper.
+func (m *memory) count_attempt(id int64) (*Cryptogram, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored, ok := m.cryptograms[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if stored.expired(time.Now()) {
+		delete(m.cryptograms, id)
+		return nil, ErrExpired
+	}
+
+	cryptogram := stored
+	cryptogram.Data = append([]byte(nil), stored.Data...)
+
+	stored.Attempts++
+	m.cryptograms[id] = stored
+
+	return &cryptogram, nil
+}
+
+// gives back an attempt counted against the cryptogram by id, if it is still
+// held
+func (m *memory) refund_attempt(id int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if stored, ok := m.cryptograms[id]; ok && stored.Attempts > 0 {
+		stored.Attempts--
+		m.cryptograms[id] = stored
+	}
+}
+
+// delete the given cryptogram from the store
+// return the number of cryptograms deleted
+func (m *memory) DeleteCryptogram(id int64) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.cryptograms[id]; !ok {
+		return 0, nil
+	}
+
+	delete(m.cryptograms, id)
+	return 1, nil
+}
+
+// delete every cryptogram which expired at or before now
+// return the number of cryptograms deleted
+func (m *memory) DeleteExpiredCryptograms(now time.Time) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var deleted int64
+	for id, cryptogram := range m.cryptograms {
+		if cryptogram.expired(now) {
+			delete(m.cryptograms, id)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// pass every cryptogram not wrapped by key_id to rewrap, keeping the results
+// only if every one succeeds
+// return the number of cryptograms rewrapped
+func (m *memory) RewrapCryptograms(key_id string, rewrap func(cryptogram *Cryptogram) error) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rewrapped := make(map[int64]Cryptogram)
+	for id, stored := range m.cryptograms {
+		if stored.KeyId == key_id {
+			continue
+		}
+
+		cryptogram := stored
+		cryptogram.Data = append([]byte(nil), stored.Data...)
+		if err := rewrap(&cryptogram); err != nil {
+			return 0, fmt.Errorf("secret %d: %w", id, err)
+		}
+
+		stored.Data = cryptogram.Data
+		stored.KeyId = cryptogram.KeyId
+		rewrapped[id] = stored
+	}
+
+	for id, stored := range rewrapped {
+		m.cryptograms[id] = stored
+	}
+
+	return int64(len(rewrapped)), nil
+}
@@ -0,0 +1,15 @@
+package db
+
+import "testing"
+
+func TestMemoryTakeCryptogramOnce(t *testing.T) {
+	check_take_cryptogram_once(t, NewMemoryStore())
+}
+
+func TestMemorySlowOpenDoesNotBlockWrites(t *testing.T) {
+	check_slow_open_does_not_block_writes(t, NewMemoryStore())
+}
+
+func TestMemoryTakeCryptogramAttempts(t *testing.T) {
+	check_take_cryptogram_attempts(t, NewMemoryStore())
+}
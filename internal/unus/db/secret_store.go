@@ -0,0 +1,75 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound        = errors.New("secret not found")
+	ErrExpired         = errors.New("secret has expired")
+	ErrDenied          = errors.New("passphrase denied")
+	ErrTooManyAttempts = errors.New("too many failed attempts")
+
+	// ErrSQLiteUnavailable is returned by NewDbConnection when unus was built
+	// without cgo, which the sqlite3 driver needs
+	ErrSQLiteUnavailable = errors.New("sqlite3 storage is unavailable, as unus was built without cgo")
+)
+
+// Cryptogram is an encrypted secret as held by a SecretStore, alongside the
+// bookkeeping needed to serve it. Cryptograms sealed by the client carry the
+// SHA-256 of the access token needed to retrieve them as the Verifier, those
+// encrypted by the server carry none. Cryptograms encrypted by the server are
+// bound to their id and ContentType, which is empty for those stored before
+// they were, and for sealed cryptograms. Data is wrapped by the server's
+// master key named by KeyId, or not at all if KeyId is empty.
+type Cryptogram struct {
+	Id          int64
+	Data        []byte
+	ExpiresAt   time.Time
+	Attempts    int
+	Verifier    []byte
+	ContentType string
+	KeyId       string
+}
+
+// SecretStore is implemented by anything able to hold cryptograms for unus
+type SecretStore interface {
+	// InsertCryptogram stores the given cryptogram under its id, returning the
+	// id on success
+	InsertCryptogram(cryptogram *Cryptogram) (int64, error)
+
+	// TakeCryptogram fetches the cryptogram by id and passes it to open. The
+	// cryptogram is deleted if open succeeds, else the error from open is
+	// returned. If open fails with an error wrapping ErrDenied, a failed
+	// attempt is recorded against the cryptogram, and once max_attempts have
+	// failed it is deleted and ErrTooManyAttempts is returned instead.
+	// ErrNotFound is returned if there is no such cryptogram, and ErrExpired
+	// if it has expired, in which case it is deleted. open may be slow, so is
+	// called without holding any lock on the store. If several callers take
+	// the same cryptogram at once, only the first to delete it succeeds, and
+	// the rest get ErrNotFound.
+	TakeCryptogram(id int64, max_attempts int, open func(cryptogram *Cryptogram) error) error
+
+	// DeleteCryptogram deletes the cryptogram by id, returning the number of
+	// cryptograms deleted
+	DeleteCryptogram(id int64) (int64, error)
+
+	// DeleteExpiredCryptograms deletes every cryptogram which expired at or
+	// before now, returning the number of cryptograms deleted
+	DeleteExpiredCryptograms(now time.Time) (int64, error)
+
+	// RewrapCryptograms passes every cryptogram not already wrapped by the
+	// master key key_id to rewrap, then stores the Data and KeyId it leaves
+	// behind. Nothing is stored unless every rewrap succeeds. Returns the
+	// number of cryptograms rewrapped.
+	RewrapCryptograms(key_id string, rewrap func(cryptogram *Cryptogram) error) (int64, error)
+
+	// Dispose releases any resources held by the store
+	Dispose()
+}
+
+// reports whether the cryptogram has expired as of now
+func (c *Cryptogram) expired(now time.Time) bool {
+	return !now.Before(c.ExpiresAt)
+}
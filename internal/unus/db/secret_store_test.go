@@ -0,0 +1,146 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// insert stores a cryptogram which expires in an hour, failing the test if it
+// can't be
+func insert(t *testing.T, store SecretStore, id int64) {
+	t.Helper()
+
+	_, err := store.InsertCryptogram(&Cryptogram{Id: id, Data: []byte("cryptogram"), ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// check_take_cryptogram_once races many callers to take the same cryptogram,
+// checking that exactly one of them succeeds
+func check_take_cryptogram_once(t *testing.T, store SecretStore) {
+	const takers = 16
+
+	for round := int64(1); round <= 5; round++ {
+		insert(t, store, round)
+
+		var wait sync.WaitGroup
+		errs := make(chan error, takers)
+		for i := 0; i < takers; i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				errs <- store.TakeCryptogram(round, takers, func(cryptogram *Cryptogram) error {
+					// as slow as a key derivation, so that the takers overlap
+					time.Sleep(20 * time.Millisecond)
+					return nil
+				})
+			}()
+		}
+		wait.Wait()
+		close(errs)
+
+		succeeded := 0
+		for err := range errs {
+			switch {
+			case err == nil:
+				succeeded++
+			case !errors.Is(err, ErrNotFound):
+				t.Fatalf("round %d: take gave %v, want nil or %v", round, err, ErrNotFound)
+			}
+		}
+
+		if succeeded != 1 {
+			t.Fatalf("round %d: %d takers succeeded, want 1", round, succeeded)
+		}
+	}
+}
+
+// check_slow_open_does_not_block_writes checks that the store can still be
+// written to while a cryptogram is being opened
+func check_slow_open_does_not_block_writes(t *testing.T, store SecretStore) {
+	insert(t, store, 1)
+
+	opening := make(chan struct{})
+	release := make(chan struct{})
+	taken := make(chan error, 1)
+	go func() {
+		taken <- store.TakeCryptogram(1, 5, func(cryptogram *Cryptogram) error {
+			close(opening)
+			<-release
+			return nil
+		})
+	}()
+	<-opening
+
+	inserted := make(chan error, 1)
+	go func() {
+		_, err := store.InsertCryptogram(&Cryptogram{Id: 2, Data: []byte("cryptogram"), ExpiresAt: time.Now().Add(time.Hour)})
+		inserted <- err
+	}()
+
+	select {
+	case err := <-inserted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("insert blocked behind an open cryptogram")
+	}
+
+	close(release)
+	if err := <-taken; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// check_take_cryptogram_attempts checks that denied attempts are counted up to
+// the limit, that other failures are not, and that expired cryptograms are
+// burned
+func check_take_cryptogram_attempts(t *testing.T, store SecretStore) {
+	denied := func(cryptogram *Cryptogram) error { return ErrDenied }
+	failed := func(cryptogram *Cryptogram) error { return errors.New("not the caller's fault") }
+
+	insert(t, store, 1)
+
+	// failures which aren't denials are never counted
+	for i := 0; i < 5; i++ {
+		if err := store.TakeCryptogram(1, 3, failed); err == nil || errors.Is(err, ErrTooManyAttempts) {
+			t.Fatalf("failed open gave %v", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := store.TakeCryptogram(1, 3, denied); !errors.Is(err, ErrDenied) {
+			t.Fatalf("attempt %d gave %v, want %v", i+1, err, ErrDenied)
+		}
+	}
+
+	if err := store.TakeCryptogram(1, 3, denied); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("last attempt gave %v, want %v", err, ErrTooManyAttempts)
+	}
+
+	if err := store.TakeCryptogram(1, 3, denied); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("attempt after the last gave %v, want %v", err, ErrNotFound)
+	}
+
+	_, err := store.InsertCryptogram(&Cryptogram{Id: 2, Data: []byte("cryptogram"), ExpiresAt: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened := false
+	err = store.TakeCryptogram(2, 3, func(cryptogram *Cryptogram) error {
+		opened = true
+		return nil
+	})
+	if !errors.Is(err, ErrExpired) || opened {
+		t.Fatalf("take of an expired cryptogram gave %v, opened %t", err, opened)
+	}
+
+	if deleted, err := store.DeleteCryptogram(2); err != nil || deleted != 0 {
+		t.Fatalf("expired cryptogram was not burned: %d, %v", deleted, err)
+	}
+}
@@ -1,10 +1,12 @@
+//go:build cgo
+
 package db
 
 import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -13,16 +15,50 @@ const (
 	CREATE_STORAGE = `
 	CREATE TABLE IF NOT EXISTS secrets (
 		id INTEGER NOT NULL PRIMARY KEY,
-		data BLOB NOT NULL);`
+		data BLOB NOT NULL,
+		expires_at INTEGER NOT NULL DEFAULT 0,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		verifier BLOB,
+		content_type TEXT NOT NULL DEFAULT '',
+		key_id TEXT NOT NULL DEFAULT '');`
+	SELECT_COLUMN = `
+	SELECT COUNT(*) FROM pragma_table_info('secrets')
+	WHERE name = (?);`
+	ADD_EXPIRY_COLUMN = `
+	ALTER TABLE secrets ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;`
+	ADD_ATTEMPTS_COLUMN = `
+	ALTER TABLE secrets ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;`
+	ADD_VERIFIER_COLUMN = `
+	ALTER TABLE secrets ADD COLUMN verifier BLOB;`
+	ADD_CONTENT_TYPE_COLUMN = `
+	ALTER TABLE secrets ADD COLUMN content_type TEXT NOT NULL DEFAULT '';`
+	ADD_KEY_ID_COLUMN = `
+	ALTER TABLE secrets ADD COLUMN key_id TEXT NOT NULL DEFAULT '';`
+	EXPIRE_LEGACY_CRYPTOGRAMS = `
+	UPDATE secrets SET expires_at = (?)
+	WHERE expires_at = 0;`
 	INSERT_CRYPTOGRAM = `
-	INSERT INTO secrets (id, data) VALUES (?, ?)`
-	SELECT_CRYPTOGRAM = `
-	SELECT data FROM secrets
+	INSERT INTO secrets (id, data, expires_at, verifier, content_type, key_id) VALUES (?, ?, ?, ?, ?, ?)`
+	TAKE_CRYPTOGRAM = `
+	UPDATE secrets SET attempts = attempts + 1
 	WHERE id = (?)
-	LIMIT 1;`
+	RETURNING data, expires_at, attempts - 1, verifier, content_type, key_id;`
+	REFUND_ATTEMPT = `
+	UPDATE secrets SET attempts = attempts - 1
+	WHERE id = (?) AND attempts > 0`
 	DELETE_CRYPTOGRAM = `
 	DELETE FROM secrets
 	WHERE id = (?)`
+	DELETE_EXPIRED_CRYPTOGRAMS = `
+	DELETE FROM secrets
+	WHERE expires_at <= (?)`
+	SELECT_UNWRAPPED_CRYPTOGRAMS = `
+	SELECT id, data, expires_at, attempts, verifier, content_type, key_id FROM secrets
+	WHERE key_id != (?)`
+	REWRAP_CRYPTOGRAM = `
+	UPDATE secrets SET data = (?), key_id = (?)
+	WHERE id = (?)`
+	LEGACY_EXPIRY    = 24 * time.Hour
 	DEFAULT_DATABASE = "unus.db"
 )
 
@@ -32,19 +68,81 @@ type database struct {
 
 // connects to a database and ensures that the required tables exist
 // if they do not exist, creates them
-func NewDbConnection(filepath string) *database {
+func NewDbConnection(filepath string) (SecretStore, error) {
 	db, err := sql.Open("sqlite3", filepath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	_, err = db.Exec(CREATE_STORAGE)
 	if err != nil {
-		msg := fmt.Sprintf("%q: %s\n", err, CREATE_STORAGE)
-		panic(msg)
+		db.Close()
+		return nil, fmt.Errorf("creating storage: %w", err)
 	}
 
-	return &database{connection: db}
+	err = migrate(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating storage: %w", err)
+	}
+
+	return &database{connection: db}, nil
+}
+
+// brings databases created by earlier versions of unus up to date
+func migrate(db *sql.DB) error {
+	// rows from before secrets could expire are given LEGACY_EXPIRY from now
+	added, err := add_column(db, "expires_at", ADD_EXPIRY_COLUMN)
+	if err != nil {
+		return err
+	}
+	if added {
+		_, err = db.Exec(EXPIRE_LEGACY_CRYPTOGRAMS, time.Now().Add(LEGACY_EXPIRY).Unix())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = add_column(db, "attempts", ADD_ATTEMPTS_COLUMN)
+	if err != nil {
+		return err
+	}
+
+	_, err = add_column(db, "verifier", ADD_VERIFIER_COLUMN)
+	if err != nil {
+		return err
+	}
+
+	_, err = add_column(db, "content_type", ADD_CONTENT_TYPE_COLUMN)
+	if err != nil {
+		return err
+	}
+
+	// rows from before master keys are not wrapped
+	_, err = add_column(db, "key_id", ADD_KEY_ID_COLUMN)
+	return err
+}
+
+// adds the named column to the secrets table if it does not already exist
+// returns true if the column was added
+func add_column(db *sql.DB, name string, statement string) (bool, error) {
+	var count int
+	err := db.QueryRow(SELECT_COLUMN, name).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	// already migrated
+	if count > 0 {
+		return false, nil
+	}
+
+	_, err = db.Exec(statement)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
 }
 
 // closes the database connection and disposes of resources
@@ -52,103 +150,205 @@ func (db *database) Dispose() {
 	db.connection.Close()
 }
 
-// selects a cryptogram by id
-// returns the blob on success, else an error
-func (db *database) SelectCryptogram(id int64) ([]byte, error) {
-	rows, err := db.connection.Query(SELECT_CRYPTOGRAM, id)
+// fetches the cryptogram by id, deleting it only if open succeeds
+// the attempt is counted, and the row read, in one short transaction. open
+// runs outside of any transaction, so a slow open never holds the write lock.
+// whoever deletes the row first wins, so only one caller can ever succeed. if
+// open denies the attempt, the count stands and the cryptogram is deleted once
+// it reaches max_attempts. for any other failure, the attempt is refunded.
+// return nil on success, else an error
+func (db *database) TakeCryptogram(id int64, max_attempts int, open func(cryptogram *Cryptogram) error) error {
+	cryptogram, err := db.count_attempt(id)
 	if err != nil {
-		log.Fatalln(err)
-		return nil, err
+		return err
+	}
+
+	// attempts made by others in the meantime may have used up the limit
+	if cryptogram.Attempts >= max_attempts {
+		if _, err := db.DeleteCryptogram(id); err != nil {
+			return err
+		}
+		return ErrTooManyAttempts
+	}
+
+	err = open(cryptogram)
+	switch {
+	case err == nil:
+		deleted, err := db.DeleteCryptogram(id)
+		if err != nil {
+			return err
+		}
+
+		// another caller took it, or used up its attempts, while it was open
+		if deleted == 0 {
+			return ErrNotFound
+		}
+		return nil
+	case !errors.Is(err, ErrDenied):
+		if _, refund_err := db.connection.Exec(REFUND_ATTEMPT, id); refund_err != nil {
+			return refund_err
+		}
+		return err
+	case cryptogram.Attempts+1 >= max_attempts:
+		if _, err := db.DeleteCryptogram(id); err != nil {
+			return err
+		}
+		return ErrTooManyAttempts
+	default:
+		return err
 	}
-	defer rows.Close()
+}
 
-	// no secret by this id
-	if !rows.Next() {
-		msg := "secret not found"
-		err := errors.New(msg)
+// counts an attempt against the cryptogram by id and reads it, with the
+// number of attempts made before this one. expired cryptograms are burned
+// rather than waiting for the reaper.
+// return the cryptogram on success, else an error
+func (db *database) count_attempt(id int64) (*Cryptogram, error) {
+	transaction, err := db.connection.Begin()
+	if err != nil {
 		return nil, err
 	}
+	// rolling back after a commit is a no-op
+	defer transaction.Rollback()
 
-	var data []byte
-	err = rows.Scan(&data)
+	var expires_at int64
+	cryptogram := &Cryptogram{Id: id}
+	err = transaction.QueryRow(TAKE_CRYPTOGRAM, id).Scan(&cryptogram.Data, &expires_at, &cryptogram.Attempts, &cryptogram.Verifier, &cryptogram.ContentType, &cryptogram.KeyId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
-		log.Fatalln("unable to scan row")
+		return nil, err
+	}
+	cryptogram.ExpiresAt = time.Unix(expires_at, 0)
+
+	if cryptogram.expired(time.Now()) {
+		if _, err := transaction.Exec(DELETE_CRYPTOGRAM, id); err != nil {
+			return nil, err
+		}
+		if err := transaction.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrExpired
+	}
+
+	if err := transaction.Commit(); err != nil {
 		return nil, err
 	}
 
-	return data, nil
+	return cryptogram, nil
 }
 
 // insert the given cryptogram into the database
 // return the index on success, else an error
-func (db *database) InsertCryptogram(goflake int64, cryptogram []byte) (int64, error) {
-	transaction, err := db.connection.Begin()
+func (db *database) InsertCryptogram(cryptogram *Cryptogram) (int64, error) {
+	result, err := db.exec(INSERT_CRYPTOGRAM, cryptogram.Id, cryptogram.Data, cryptogram.ExpiresAt.Unix(), cryptogram.Verifier, cryptogram.ContentType, cryptogram.KeyId)
 	if err != nil {
-		log.Fatalln(err)
 		return -1, err
 	}
 
-	statement, err := transaction.Prepare(INSERT_CRYPTOGRAM)
+	return result.LastInsertId()
+}
+
+// delete the given cryptogram from the database
+// return the number of rows affected on success, else an error
+func (db *database) DeleteCryptogram(goflake int64) (int64, error) {
+	result, err := db.exec(DELETE_CRYPTOGRAM, goflake)
 	if err != nil {
-		log.Fatalln(err)
 		return -1, err
 	}
-	defer statement.Close()
 
-	result, err := statement.Exec(goflake, cryptogram)
+	return result.RowsAffected()
+}
+
+// delete every cryptogram which expired at or before now
+// return the number of rows affected on success, else an error
+func (db *database) DeleteExpiredCryptograms(now time.Time) (int64, error) {
+	result, err := db.exec(DELETE_EXPIRED_CRYPTOGRAMS, now.Unix())
 	if err != nil {
-		log.Fatalln(err)
 		return -1, err
 	}
 
-	err = transaction.Commit()
+	return result.RowsAffected()
+}
+
+// runs the statement with the given arguments in a transaction of its own
+// return the result on success, else an error
+func (db *database) exec(query string, args ...interface{}) (sql.Result, error) {
+	transaction, err := db.connection.Begin()
 	if err != nil {
-		log.Fatalln(err)
-		return -1, err
+		return nil, err
 	}
+	// rolling back after a commit is a no-op
+	defer transaction.Rollback()
 
-	id, err := result.LastInsertId()
+	result, err := transaction.Exec(query, args...)
 	if err != nil {
-		log.Fatalln(err)
-		return -1, err
+		return nil, err
+	}
+
+	err = transaction.Commit()
+	if err != nil {
+		return nil, err
 	}
 
-	return id, nil
+	return result, nil
 }
 
-// delete the given cryptogram from the database
-// return the number of rows affected on success, else an error
-func (db *database) DeleteCryptogram(goflake int64) (int64, error) {
+// pass every cryptogram not wrapped by key_id to rewrap, storing the results
+// in a single transaction, so either every cryptogram is rewrapped or none are
+// return the number of rows rewrapped on success, else an error
+func (db *database) RewrapCryptograms(key_id string, rewrap func(cryptogram *Cryptogram) error) (int64, error) {
 	transaction, err := db.connection.Begin()
 	if err != nil {
-		log.Fatalln(err)
 		return -1, err
 	}
+	// rolling back after a commit is a no-op
+	defer transaction.Rollback()
 
-	statement, err := transaction.Prepare(DELETE_CRYPTOGRAM)
+	rows, err := transaction.Query(SELECT_UNWRAPPED_CRYPTOGRAMS, key_id)
 	if err != nil {
-		log.Fatalln(err)
 		return -1, err
 	}
-	defer statement.Close()
 
-	result, err := statement.Exec(goflake)
-	if err != nil {
-		log.Fatalln(err)
+	// the rows are read in full before any are updated
+	var cryptograms []*Cryptogram
+	for rows.Next() {
+		cryptogram := &Cryptogram{}
+		var expires_at int64
+		err := rows.Scan(&cryptogram.Id, &cryptogram.Data, &expires_at, &cryptogram.Attempts, &cryptogram.Verifier, &cryptogram.ContentType, &cryptogram.KeyId)
+		if err != nil {
+			rows.Close()
+			return -1, err
+		}
+		cryptogram.ExpiresAt = time.Unix(expires_at, 0)
+		cryptograms = append(cryptograms, cryptogram)
+	}
+	if err := rows.Err(); err != nil {
 		return -1, err
 	}
 
-	err = transaction.Commit()
+	statement, err := transaction.Prepare(REWRAP_CRYPTOGRAM)
 	if err != nil {
-		log.Fatalln(err)
 		return -1, err
 	}
+	defer statement.Close()
+
+	for _, cryptogram := range cryptograms {
+		if err := rewrap(cryptogram); err != nil {
+			return -1, fmt.Errorf("secret %d: %w", cryptogram.Id, err)
+		}
 
-	rows_affected, err := result.RowsAffected()
+		_, err := statement.Exec(cryptogram.Data, cryptogram.KeyId, cryptogram.Id)
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	err = transaction.Commit()
 	if err != nil {
-		log.Fatalln(err)
 		return -1, err
 	}
 
-	return rows_affected, nil
+	return int64(len(cryptograms)), nil
 }
@@ -0,0 +1,32 @@
+//go:build cgo
+
+package db
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// new_test_database opens a fresh database in a temporary directory
+func new_test_database(t *testing.T) SecretStore {
+	t.Helper()
+
+	store, err := NewDbConnection(filepath.Join(t.TempDir(), DEFAULT_DATABASE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Dispose)
+	return store
+}
+
+func TestSQLiteTakeCryptogramOnce(t *testing.T) {
+	check_take_cryptogram_once(t, new_test_database(t))
+}
+
+func TestSQLiteSlowOpenDoesNotBlockWrites(t *testing.T) {
+	check_slow_open_does_not_block_writes(t, new_test_database(t))
+}
+
+func TestSQLiteTakeCryptogramAttempts(t *testing.T) {
+	check_take_cryptogram_attempts(t, new_test_database(t))
+}
@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package db
+
+// the sqlite3 driver needs cgo, so without it there is no sqlite3 store
+// always returns ErrSQLiteUnavailable
+func NewDbConnection(filepath string) (SecretStore, error) {
+	return nil, ErrSQLiteUnavailable
+}
@@ -1,18 +1,28 @@
 package unus
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"code.leif.uk/lwg/unus/internal/unus/db"
+	"code.leif.uk/lwg/unus/internal/wire"
 	ecies "code.leif.uk/lwg/unus/pkg/go-ecies"
 )
 
+var (
+	errWrongRetrieval = errors.New("secret requested in the wrong mode")
+	errTooBusy        = errors.New("no key derivation free to open secret")
+)
+
 // gets an existing secret
-func getSecretHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) getSecretHandler(w http.ResponseWriter, r *http.Request) {
 	matches := secret_id_regex.FindStringSubmatch(r.URL.Path)
 	if len(matches) != 2 {
 		msg := "too many ids received"
@@ -53,46 +63,103 @@ func getSecretHandler(w http.ResponseWriter, r *http.Request) {
 	offset := strings.Index(string(passphrase_bytes), ":") + 1
 	passphrase := string(passphrase_bytes[offset:])
 
-	cryptogram, err := database.SelectCryptogram(secret_id)
-	if err != nil {
+	// clients holding the access token for a secret they sealed themselves ask
+	// for the cryptogram, everyone else gets the secret decrypted by us. for a
+	// sealed secret, the "passphrase" we were given is that access token.
+	sealed := r.Header.Get("Accept") == wire.MIME_CRYPTOGRAM
+
+	// the cryptogram is only burned once it has been opened successfully
+	var secret secret
+	msg := "error opening cryptogram"
+	err = s.store.TakeCryptogram(secret_id, s.config.MaxAttempts, func(cryptogram *db.Cryptogram) error {
+		// the master key is ours, so failing to unwrap is never the
+		// passphrase's fault
+		if err := s.master_keys.unwrap(cryptogram); err != nil {
+			msg = "error unwrapping cryptogram"
+			return err
+		}
+
+		// asking in the wrong way isn't a wrong passphrase, so isn't counted
+		if sealed != (cryptogram.Verifier != nil) {
+			return errWrongRetrieval
+		}
+
+		if sealed {
+			if subtle.ConstantTimeCompare(wire.Verifier(passphrase), cryptogram.Verifier) != 1 {
+				return fmt.Errorf("%w: access token does not match", db.ErrDenied)
+			}
+
+			secret.ContentType = wire.MIME_CRYPTOGRAM
+			secret.Secret = cryptogram.Data
+			return nil
+		}
+
+		// cryptograms stored before they were bound have no content type
+		var ad []byte
+		if cryptogram.ContentType != "" {
+			ad = associated_data(cryptogram.Id, cryptogram.ContentType)
+		}
+
+		// being too busy to check the passphrase isn't the passphrase's
+		// fault, so isn't counted
+		if !s.acquire_derivation() {
+			return errTooBusy
+		}
+		payload, err := ecies.DecryptWithPassphraseCompat([]byte(passphrase), cryptogram.Data, ad)
+		s.release_derivation()
+
+		// a damaged cryptogram can't be opened by any passphrase, so isn't
+		// counted. a passphrase which can't make a key is as wrong as any
+		// other.
+		var format_error *ecies.FormatError
+		if errors.As(err, &format_error) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", db.ErrDenied, err)
+		}
+
+		if err := json.Unmarshal(payload, &secret); err != nil {
+			msg = "error decoding payload"
+			return err
+		}
+
+		return nil
+	})
+
+	switch {
+	case err == nil:
+		writeResponseBytes(w, secret.ContentType, secret.Secret)
+	case errors.Is(err, db.ErrNotFound):
 		msg := "error finding cryptogram"
 		http.Error(w, msg, http.StatusNotFound)
 		log.Println(err)
-		return
-	}
-
-	// create the key from the passphrase we were given
-	receiver_key, err := ecies.NewECPrivateKeyFromBytes([]byte(passphrase))
-	if err != nil {
-		msg := "error deciding passphrase"
-		http.Error(w, msg, http.StatusInternalServerError)
+	case errors.Is(err, db.ErrExpired):
+		msg := "secret has expired"
+		http.Error(w, msg, http.StatusGone)
 		log.Println(err)
-		return
-	}
-
-	payload, err := ecies.Decrypt(receiver_key, cryptogram)
-	if err != nil {
-		msg := "error during decryption"
-		http.Error(w, msg, http.StatusInternalServerError)
+	case errors.Is(err, db.ErrDenied):
+		msg := "incorrect passphrase"
+		w.Header().Set("WWW-Authenticate", `Basic realm="unus"`)
+		http.Error(w, msg, http.StatusUnauthorized)
 		log.Println(err)
-		return
-	}
-
-	var secret secret
-	if err := json.Unmarshal(payload, &secret); err != nil {
-		msg := "error decoding payload"
-		http.Error(w, msg, http.StatusInternalServerError)
+	case errors.Is(err, errWrongRetrieval) && sealed:
+		msg := "secret was encrypted by the server, retrieve it with its passphrase"
+		http.Error(w, msg, http.StatusNotAcceptable)
 		log.Println(err)
-		return
-	}
-
-	_, err = database.DeleteCryptogram(secret_id)
-	if err != nil {
-		msg := "error deleting cryptogram"
+	case errors.Is(err, errWrongRetrieval):
+		msg := fmt.Sprintf("secret was sealed by its sender, retrieve it as %s", wire.MIME_CRYPTOGRAM)
+		http.Error(w, msg, http.StatusNotAcceptable)
+		log.Println(err)
+	case errors.Is(err, errTooBusy):
+		tooBusy(w)
+		log.Println(err)
+	case errors.Is(err, db.ErrTooManyAttempts):
+		msg := "too many incorrect passphrases, secret destroyed"
+		http.Error(w, msg, http.StatusForbidden)
+		log.Println(err)
+	default:
 		http.Error(w, msg, http.StatusInternalServerError)
 		log.Println(err)
-		return
 	}
-
-	writeResponseBytes(w, secret.ContentType, secret.Secret)
 }
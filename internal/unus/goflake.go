@@ -1,6 +1,9 @@
 package unus
 
-import "time"
+import (
+	"sync/atomic"
+	"time"
+)
 
 var (
 	goflake *_goflake = newGoflake()
@@ -8,20 +11,19 @@ var (
 
 type _goflake struct {
 	epoch    time.Time
-	sequence int64
+	sequence atomic.Int64
 	ticker   *time.Ticker
 }
 
 func newGoflake() *_goflake {
 	goflake := &_goflake{
-		epoch:    time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
-		sequence: 0,
+		epoch: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
 	}
 
 	ticker := time.NewTicker(time.Second)
 	go func() {
 		for range ticker.C {
-			goflake.sequence = 0
+			goflake.sequence.Store(0)
 		}
 	}()
 
@@ -30,13 +32,15 @@ func newGoflake() *_goflake {
 }
 
 // returns a simple snowflake where the top 44 bits are time and lower 20 are
-// sequence
+// sequence. the sequence counts every id given out, and is reset every second,
+// so ids given out in the same millisecond still differ.
 func (g *_goflake) Next() int64 {
 	current_time := time.Now().UTC()
 	diff := current_time.Sub(g.epoch)
 
 	time_bits := diff.Milliseconds() << 20
-	return time_bits + g.sequence
+	sequence := (g.sequence.Add(1) - 1) & (1<<20 - 1)
+	return time_bits + sequence
 }
 
 // stops the snowflake ticking
@@ -0,0 +1,32 @@
+package unus
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestGoflakeUnique(t *testing.T) {
+	const callers, ids = 8, 1000
+
+	var wait sync.WaitGroup
+	generated := make(chan int64, callers*ids)
+	for i := 0; i < callers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < ids; j++ {
+				generated <- goflake.Next()
+			}
+		}()
+	}
+	wait.Wait()
+	close(generated)
+
+	seen := make(map[int64]bool)
+	for id := range generated {
+		if seen[id] {
+			t.Fatalf("id %d given out twice", id)
+		}
+		seen[id] = true
+	}
+}
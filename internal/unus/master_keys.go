@@ -0,0 +1,206 @@
+package unus
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"code.leif.uk/lwg/unus/internal/unus/config"
+	"code.leif.uk/lwg/unus/internal/unus/db"
+)
+
+// master keys are AES-256 keys
+const MASTER_KEY_SIZE = 32
+
+// master_keys wrap every cryptogram the server stores, so a copy of the
+// database alone can't be attacked offline. the active key wraps new
+// cryptograms, the others only unwrap those stored before it was added.
+type master_keys struct {
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+// loads the master keys given by the configuration, either inline or from a
+// file. returns nil if none are configured.
+func load_master_keys(cfg *config.Config) (*master_keys, error) {
+	if cfg.MasterKeysFile != "" {
+		data, err := os.ReadFile(cfg.MasterKeysFile)
+		if err != nil {
+			return nil, err
+		}
+
+		keys, err := parse_master_keys(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg.MasterKeysFile, err)
+		}
+		return keys, nil
+	}
+
+	if cfg.MasterKeys != "" {
+		return parse_master_keys(cfg.MasterKeys)
+	}
+
+	return nil, nil
+}
+
+// parses master keys given as id:base64 pairs, separated by commas or new
+// lines. blank lines and those starting with # are ignored. the last key
+// given is the active one.
+func parse_master_keys(text string) (*master_keys, error) {
+	keys := &master_keys{keys: make(map[string]cipher.AEAD)}
+
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		for _, entry := range strings.Split(line, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+
+			// the key itself is never included in errors
+			id, encoded, ok := strings.Cut(entry, ":")
+			if !ok || id == "" {
+				return nil, errors.New("master keys must be given as id:base64")
+			}
+
+			if _, ok := keys.keys[id]; ok {
+				return nil, fmt.Errorf("master key %q is given more than once", id)
+			}
+
+			key, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(key) != MASTER_KEY_SIZE {
+				return nil, fmt.Errorf("master key %q must be %d bytes of base64", id, MASTER_KEY_SIZE)
+			}
+
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+
+			aead, err := cipher.NewGCM(block)
+			if err != nil {
+				return nil, err
+			}
+
+			keys.keys[id] = aead
+			keys.active = id
+		}
+	}
+
+	if len(keys.keys) == 0 {
+		return nil, errors.New("no master keys given")
+	}
+
+	return keys, nil
+}
+
+// returns what a wrapped cryptogram is bound to: its id as a big-endian u64,
+// then the id of the master key
+func master_key_ad(id int64, key_id string) []byte {
+	ad := binary.BigEndian.AppendUint64(nil, uint64(id))
+	return append(ad, key_id...)
+}
+
+// wraps the cryptogram's data with the active master key, as the nonce then
+// the AES-256-GCM ciphertext, and records the key used. does nothing if no
+// master keys are configured.
+func (m *master_keys) wrap(cryptogram *db.Cryptogram) error {
+	if m == nil {
+		return nil
+	}
+
+	aead := m.keys[m.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	ad := master_key_ad(cryptogram.Id, m.active)
+	cryptogram.Data = aead.Seal(nonce, nonce, cryptogram.Data, ad)
+	cryptogram.KeyId = m.active
+	return nil
+}
+
+// unwraps the cryptogram's data with the master key it was wrapped by, if any.
+// an error is returned if that key isn't configured, or the data has been
+// tampered with.
+func (m *master_keys) unwrap(cryptogram *db.Cryptogram) error {
+	if cryptogram.KeyId == "" {
+		return nil
+	}
+
+	if m == nil {
+		return fmt.Errorf("secret is wrapped by master key %q, but no master keys are configured", cryptogram.KeyId)
+	}
+
+	aead, ok := m.keys[cryptogram.KeyId]
+	if !ok {
+		return fmt.Errorf("secret is wrapped by master key %q, which is not configured", cryptogram.KeyId)
+	}
+
+	if len(cryptogram.Data) < aead.NonceSize() {
+		return fmt.Errorf("secret wrapped by master key %q is truncated", cryptogram.KeyId)
+	}
+
+	nonce, ciphertext := cryptogram.Data[:aead.NonceSize()], cryptogram.Data[aead.NonceSize():]
+	ad := master_key_ad(cryptogram.Id, cryptogram.KeyId)
+	data, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return fmt.Errorf("unable to unwrap secret with master key %q", cryptogram.KeyId)
+	}
+
+	cryptogram.Data = data
+	cryptogram.KeyId = ""
+	return nil
+}
+
+// rewraps every secret in the configured store with the active master key,
+// purging those which have expired first. secrets wrapped by any other
+// configured key, or not wrapped at all, are rewrapped without their
+// passphrases being needed. returns the number of secrets rewrapped.
+func Rekey(cfg *config.Config) (int64, error) {
+	if cfg.Storage == config.STORAGE_MEMORY {
+		return 0, errors.New("secrets kept in memory can't be rekeyed")
+	}
+
+	keys, err := load_master_keys(cfg)
+	if err != nil {
+		return 0, err
+	}
+	if keys == nil {
+		return 0, errors.New("master keys must be set to rekey")
+	}
+
+	// falling back to memory would leave nothing to rekey
+	store, err := db.NewDbConnection(cfg.DatabasePath)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Dispose()
+
+	return rekey(store, keys)
+}
+
+// rewraps every secret in the store with the active master key, as Rekey does.
+// either every secret is rewrapped or, on error, none are.
+func rekey(store db.SecretStore, keys *master_keys) (int64, error) {
+	if _, err := store.DeleteExpiredCryptograms(time.Now()); err != nil {
+		return 0, err
+	}
+
+	return store.RewrapCryptograms(keys.active, func(cryptogram *db.Cryptogram) error {
+		if err := keys.unwrap(cryptogram); err != nil {
+			return err
+		}
+		return keys.wrap(cryptogram)
+	})
+}
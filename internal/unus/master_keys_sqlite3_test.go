@@ -0,0 +1,29 @@
+//go:build cgo
+
+package unus
+
+import (
+	"path/filepath"
+	"testing"
+
+	"code.leif.uk/lwg/unus/internal/unus/config"
+	"code.leif.uk/lwg/unus/internal/unus/db"
+)
+
+func TestRekeySQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), db.DEFAULT_DATABASE)
+
+	store, err := db.NewDbConnection(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Dispose)
+
+	// through the command's own entry point, on its own connection
+	check_rekey(t, store, func(text string) (int64, error) {
+		cfg := config.Default()
+		cfg.DatabasePath = path
+		cfg.MasterKeys = text
+		return Rekey(cfg)
+	})
+}
@@ -0,0 +1,385 @@
+package unus
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"code.leif.uk/lwg/unus/internal/unus/config"
+	"code.leif.uk/lwg/unus/internal/unus/db"
+)
+
+// test_master_key returns a master key of the given byte, in base64
+func test_master_key(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, MASTER_KEY_SIZE))
+}
+
+var (
+	old_master_keys = "a:" + test_master_key(1)
+	new_master_keys = old_master_keys + ",b:" + test_master_key(2)
+)
+
+func must_parse_master_keys(t *testing.T, text string) *master_keys {
+	t.Helper()
+
+	keys, err := parse_master_keys(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// peek returns a copy of the stored cryptogram without taking it, or counting
+// an attempt against it
+func peek(t *testing.T, store db.SecretStore, id int64) db.Cryptogram {
+	t.Helper()
+
+	only_looking := errors.New("only looking")
+
+	var peeked db.Cryptogram
+	err := store.TakeCryptogram(id, 1000, func(cryptogram *db.Cryptogram) error {
+		peeked = *cryptogram
+		peeked.Data = append([]byte(nil), cryptogram.Data...)
+		return only_looking
+	})
+	if !errors.Is(err, only_looking) {
+		t.Fatalf("peek at %d gave %v", id, err)
+	}
+	return peeked
+}
+
+func TestParseMasterKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		active string
+		ids    int
+	}{
+		{"one key", "a:" + test_master_key(1), "a", 1},
+		{"comma separated", "a:" + test_master_key(1) + ", b:" + test_master_key(2), "b", 2},
+		{"one per line", "# rotated in 2026\n\na:" + test_master_key(1) + "\n  \nb:" + test_master_key(2) + ",c:" + test_master_key(3) + "\n", "c", 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys := must_parse_master_keys(t, test.text)
+			if keys.active != test.active || len(keys.keys) != test.ids {
+				t.Fatalf("parse gave %d keys, %q active, want %d, %q active", len(keys.keys), keys.active, test.ids, test.active)
+			}
+		})
+	}
+}
+
+func TestParseMasterKeysErrors(t *testing.T) {
+	short := base64.StdEncoding.EncodeToString(make([]byte, MASTER_KEY_SIZE-1))
+	long := base64.StdEncoding.EncodeToString(make([]byte, MASTER_KEY_SIZE+1))
+
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"empty", ""},
+		{"only comments", "# no keys here\n\n"},
+		{"no colon", test_master_key(1)},
+		{"no id", ":" + test_master_key(1)},
+		{"not base64", "a:" + strings.Repeat("!", 44)},
+		{"too short", "a:" + short},
+		{"too long", "a:" + long},
+		{"duplicate id", "a:" + test_master_key(1) + ",a:" + test_master_key(2)},
+		{"duplicate id across lines", "a:" + test_master_key(1) + "\nb:" + test_master_key(2) + "\na:" + test_master_key(3)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parse_master_keys(test.text)
+			if err == nil {
+				t.Fatal("parsed invalid master keys")
+			}
+
+			// errors end up in logs, so must never include a key
+			for _, key := range []string{test_master_key(1), test_master_key(2), test_master_key(3), short, long} {
+				if strings.Contains(err.Error(), key) {
+					t.Fatalf("error %q includes a key", err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadMasterKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master_keys")
+	if err := os.WriteFile(path, []byte("# retired\nold:"+test_master_key(1)+"\nnew:"+test_master_key(2)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("none", func(t *testing.T) {
+		keys, err := load_master_keys(config.Default())
+		if keys != nil || err != nil {
+			t.Fatalf("load gave %v, %v, want nil, nil", keys, err)
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		cfg := config.Default()
+		cfg.MasterKeysFile = path
+
+		keys, err := load_master_keys(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys.active != "new" || len(keys.keys) != 2 {
+			t.Fatalf("load gave %d keys, %q active", len(keys.keys), keys.active)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		cfg := config.Default()
+		cfg.MasterKeysFile = filepath.Join(t.TempDir(), "missing")
+
+		if _, err := load_master_keys(cfg); err == nil {
+			t.Fatal("loaded master keys from a missing file")
+		}
+	})
+
+	t.Run("bad file", func(t *testing.T) {
+		bad_path := filepath.Join(t.TempDir(), "master_keys")
+		if err := os.WriteFile(bad_path, []byte("a:"+test_master_key(1)+"\na:"+test_master_key(2)+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := config.Default()
+		cfg.MasterKeysFile = bad_path
+
+		_, err := load_master_keys(cfg)
+		if err == nil || !strings.Contains(err.Error(), bad_path) {
+			t.Fatalf("load gave %v, want an error naming %s", err, bad_path)
+		}
+	})
+
+	t.Run("environment", func(t *testing.T) {
+		t.Setenv("UNUS_MASTER_KEYS", new_master_keys)
+
+		cfg, err := config.Load("unus", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := load_master_keys(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys.active != "b" || len(keys.keys) != 2 {
+			t.Fatalf("load gave %d keys, %q active", len(keys.keys), keys.active)
+		}
+	})
+
+	t.Run("environment file", func(t *testing.T) {
+		t.Setenv("UNUS_MASTER_KEYS_FILE", path)
+
+		cfg, err := config.Load("unus", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := load_master_keys(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys.active != "new" {
+			t.Fatalf("load gave %q active, want %q", keys.active, "new")
+		}
+	})
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	keys := must_parse_master_keys(t, new_master_keys)
+
+	wrapped := db.Cryptogram{Id: 7, Data: []byte("MySuperSecretMessage")}
+	if err := keys.wrap(&wrapped); err != nil {
+		t.Fatal(err)
+	}
+	if wrapped.KeyId != "b" || bytes.Contains(wrapped.Data, []byte("MySuperSecretMessage")) {
+		t.Fatalf("wrap gave %x under %q", wrapped.Data, wrapped.KeyId)
+	}
+
+	// changed returns a copy of the wrapped cryptogram changed by change
+	changed := func(change func(cryptogram *db.Cryptogram)) *db.Cryptogram {
+		cryptogram := wrapped
+		cryptogram.Data = append([]byte(nil), wrapped.Data...)
+		change(&cryptogram)
+		return &cryptogram
+	}
+
+	unwrapped := changed(func(*db.Cryptogram) {})
+	if err := keys.unwrap(unwrapped); err != nil {
+		t.Fatal(err)
+	}
+	if string(unwrapped.Data) != "MySuperSecretMessage" || unwrapped.KeyId != "" {
+		t.Fatalf("unwrap gave %q under %q", unwrapped.Data, unwrapped.KeyId)
+	}
+
+	// the older key still unwraps what it wrapped
+	older := db.Cryptogram{Id: 7, Data: []byte("MySuperSecretMessage")}
+	if err := must_parse_master_keys(t, old_master_keys).wrap(&older); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.unwrap(&older); err != nil || string(older.Data) != "MySuperSecretMessage" {
+		t.Fatalf("unwrap with an older key gave %q, %v", older.Data, err)
+	}
+
+	failures := map[string]*db.Cryptogram{
+		"moved to another id":      changed(func(c *db.Cryptogram) { c.Id = 8 }),
+		"relabelled":               changed(func(c *db.Cryptogram) { c.KeyId = "a" }),
+		"tampered with":            changed(func(c *db.Cryptogram) { c.Data[len(c.Data)-1] ^= 1 }),
+		"truncated":                changed(func(c *db.Cryptogram) { c.Data = c.Data[:4] }),
+		"wrapped by a retired key": changed(func(c *db.Cryptogram) { c.KeyId = "c" }),
+	}
+	for name, cryptogram := range failures {
+		if err := keys.unwrap(cryptogram); err == nil {
+			t.Errorf("unwrapped a cryptogram %s", name)
+		}
+	}
+
+	var no_keys *master_keys
+	if err := no_keys.unwrap(changed(func(*db.Cryptogram) {})); err == nil {
+		t.Error("unwrapped a cryptogram without any master keys")
+	}
+}
+
+func TestUnwrapLegacy(t *testing.T) {
+	// stored before master keys were configured
+	for _, keys := range []*master_keys{nil, must_parse_master_keys(t, new_master_keys)} {
+		legacy := db.Cryptogram{Id: 7, Data: []byte("cryptogram")}
+		if err := keys.unwrap(&legacy); err != nil {
+			t.Fatal(err)
+		}
+		if string(legacy.Data) != "cryptogram" || legacy.KeyId != "" {
+			t.Fatalf("unwrap changed a legacy cryptogram to %q under %q", legacy.Data, legacy.KeyId)
+		}
+	}
+
+	// and without master keys, nothing is wrapped
+	var no_keys *master_keys
+	cryptogram := db.Cryptogram{Id: 7, Data: []byte("cryptogram")}
+	if err := no_keys.wrap(&cryptogram); err != nil || string(cryptogram.Data) != "cryptogram" || cryptogram.KeyId != "" {
+		t.Fatalf("wrap without master keys gave %q under %q, %v", cryptogram.Data, cryptogram.KeyId, err)
+	}
+}
+
+// check_rekey checks that rekeying, with the master keys given as text,
+// rewraps every secret in the store under the active key, and that a secret
+// which can't be unwrapped leaves every secret as it was
+func check_rekey(t *testing.T, store db.SecretStore, rekey func(text string) (int64, error)) {
+	old_keys := must_parse_master_keys(t, old_master_keys)
+	new_keys := must_parse_master_keys(t, new_master_keys)
+
+	store_secret := func(id int64, keys *master_keys, expires_at time.Time) {
+		t.Helper()
+
+		cryptogram := &db.Cryptogram{Id: id, Data: []byte(fmt.Sprintf("secret %d", id)), ExpiresAt: expires_at}
+		if err := keys.wrap(cryptogram); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.InsertCryptogram(cryptogram); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// three wrapped by the old key, one stored before there were any, and
+	// one which has expired
+	for id := int64(1); id <= 3; id++ {
+		store_secret(id, old_keys, time.Now().Add(time.Hour))
+	}
+	store_secret(4, nil, time.Now().Add(time.Hour))
+	store_secret(5, old_keys, time.Now().Add(-time.Second))
+
+	var before []db.Cryptogram
+	for id := int64(1); id <= 4; id++ {
+		before = append(before, peek(t, store, id))
+	}
+
+	// one secret that can't be unwrapped spoils the lot
+	broken := map[string]func(cryptogram *db.Cryptogram){
+		"unknown key": func(cryptogram *db.Cryptogram) { cryptogram.KeyId = "c" },
+		"tampered":    func(cryptogram *db.Cryptogram) { cryptogram.Data[len(cryptogram.Data)-1] ^= 1 },
+	}
+	for name, breaks := range broken {
+		cryptogram := &db.Cryptogram{Id: 6, Data: []byte("secret 6"), ExpiresAt: time.Now().Add(time.Hour)}
+		if err := old_keys.wrap(cryptogram); err != nil {
+			t.Fatal(err)
+		}
+		breaks(cryptogram)
+		if _, err := store.InsertCryptogram(cryptogram); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := rekey(new_master_keys); err == nil {
+			t.Fatalf("rekeyed with a secret wrapped by %s", name)
+		}
+
+		for i, want := range before {
+			if got := peek(t, store, want.Id); got.KeyId != want.KeyId || !bytes.Equal(got.Data, want.Data) {
+				t.Fatalf("%s: secret %d was changed by a failed rekey", name, i+1)
+			}
+		}
+
+		if _, err := store.DeleteCryptogram(6); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rewrapped, err := rekey(new_master_keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped != 4 {
+		t.Fatalf("rekey rewrapped %d secrets, want 4", rewrapped)
+	}
+
+	for id := int64(1); id <= 4; id++ {
+		cryptogram := peek(t, store, id)
+		if cryptogram.KeyId != "b" {
+			t.Fatalf("secret %d is wrapped by %q, want %q", id, cryptogram.KeyId, "b")
+		}
+		if err := new_keys.unwrap(&cryptogram); err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("secret %d", id); string(cryptogram.Data) != want {
+			t.Fatalf("secret %d unwrapped to %q, want %q", id, cryptogram.Data, want)
+		}
+	}
+
+	if err := store.TakeCryptogram(5, 1, func(*db.Cryptogram) error { return nil }); !errors.Is(err, db.ErrNotFound) {
+		t.Fatalf("take of the expired secret gave %v, want %v", err, db.ErrNotFound)
+	}
+
+	// there's nothing left to do
+	if rewrapped, err := rekey(new_master_keys); err != nil || rewrapped != 0 {
+		t.Fatalf("second rekey gave %d, %v, want 0, nil", rewrapped, err)
+	}
+}
+
+func TestRekeyMemory(t *testing.T) {
+	store := db.NewMemoryStore()
+	t.Cleanup(store.Dispose)
+
+	check_rekey(t, store, func(text string) (int64, error) {
+		return rekey(store, must_parse_master_keys(t, text))
+	})
+}
+
+func TestRekeyRefusesMemory(t *testing.T) {
+	cfg := config.Default()
+	cfg.Storage = config.STORAGE_MEMORY
+	cfg.MasterKeys = new_master_keys
+
+	if _, err := Rekey(cfg); err == nil {
+		t.Fatal("rekeyed secrets kept in memory")
+	}
+}
@@ -1,12 +1,19 @@
 package unus
 
 import (
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
+	"code.leif.uk/lwg/unus/internal/unus/db"
+	"code.leif.uk/lwg/unus/internal/wire"
 	ecies "code.leif.uk/lwg/unus/pkg/go-ecies"
 	"github.com/tjarratt/babble"
 )
@@ -17,27 +24,28 @@ type secret struct {
 }
 
 // decodes a secret push request
-func decode_secret_request(w http.ResponseWriter, r *http.Request) (*secret, error) {
+func (s *server) decode_secret_request(w http.ResponseWriter, r *http.Request) (*secret, error) {
 	// enforce content-type header
 	content_type := r.Header.Get("Content-Type")
-	switch content_type {
-	case MIME_STRING:
-	case MIME_PNG:
-	case MIME_JPEG:
-	case MIME_JSON:
-		break
-	default:
+	if !s.config.AllowsContentType(content_type) {
 		msg := "content-type header is not supported type"
 		err := errors.New(msg)
 		http.Error(w, msg, http.StatusUnsupportedMediaType)
 		return nil, err
 	}
 
-	// enforce 1 MiB max.
-	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+	// enforce the configured max. size
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxSecretSize)
 
 	// enforce no unknown fields
 	content, err := ioutil.ReadAll(r.Body)
+	var max_bytes_error *http.MaxBytesError
+	if errors.As(err, &max_bytes_error) {
+		msg := fmt.Sprintf("secret is larger than %d bytes", max_bytes_error.Limit)
+		err := errors.New(msg)
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return nil, err
+	}
 	if err != nil {
 		// may need to do some additional validation on the content
 		// for now, don't bother
@@ -47,24 +55,77 @@ func decode_secret_request(w http.ResponseWriter, r *http.Request) (*secret, err
 		return nil, err
 	}
 
+	if err := s.verify_sender(w, r, content); err != nil {
+		return nil, err
+	}
+
 	return &secret{ContentType: content_type, Secret: content}, nil
 }
 
-func generate_passphrase() string {
+// decodes the requested time-to-live from the ttl query parameter, e.g. ?ttl=1h
+// falls back to the default ttl if none is given, and refuses anything over the
+// max. ttl
+func (s *server) decode_ttl(r *http.Request) (time.Duration, error) {
+	raw_ttl := r.URL.Query().Get(wire.TTL_PARAM)
+	if raw_ttl == "" {
+		return s.config.DefaultTTL, nil
+	}
+
+	ttl, err := time.ParseDuration(raw_ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	if ttl <= 0 || ttl > s.config.MaxTTL {
+		msg := fmt.Sprintf("ttl must be greater than 0s and at most %s", s.config.MaxTTL)
+		return 0, errors.New(msg)
+	}
+
+	return ttl, nil
+}
+
+// decodes the number of passphrases requested from the recipients query
+// parameter, e.g. ?recipients=3, any one of which retrieves the secret. falls
+// back to one if none is given, and refuses anything over the max. recipients
+func (s *server) decode_recipients(r *http.Request) (int, error) {
+	raw_recipients := r.URL.Query().Get(wire.RECIPIENTS_PARAM)
+	if raw_recipients == "" {
+		return 1, nil
+	}
+
+	recipients, err := strconv.Atoi(raw_recipients)
+	if err != nil || recipients <= 0 || recipients > s.config.MaxRecipients {
+		msg := fmt.Sprintf("recipients must be between 1 and %d", s.config.MaxRecipients)
+		return 0, errors.New(msg)
+	}
+
+	return recipients, nil
+}
+
+// makes a passphrase of the given number of words from the system dictionary.
+// tests replace it, so that they don't need one.
+var generate_passphrase = func(words int) string {
 	babbler := babble.NewBabbler()
-	babbler.Count = 4
+	babbler.Count = words
 	babbler.Separator = "-"
 	return babbler.Babble()
 }
 
-// creates a new secret and returns the id + key
-func newSecretHandler(w http.ResponseWriter, r *http.Request) {
-	secret, err := decode_secret_request(w, r)
+// binds a cryptogram encrypted by us to the id and content type it is stored
+// under, so that it fails to decrypt if either is changed
+func associated_data(id int64, content_type string) []byte {
+	ad := binary.BigEndian.AppendUint64(nil, uint64(id))
+	return append(ad, content_type...)
+}
+
+// decodes, then encrypts, a plaintext secret push request under a new
+// passphrase for each recipient, bound to the id it will be stored under. any
+// one of the passphrases decrypts it. returns the cryptogram, passphrases and
+// content type, else replies with the reason and returns an error.
+func (s *server) encrypt_secret_request(w http.ResponseWriter, r *http.Request, id int64, recipients int) ([]byte, []string, string, error) {
+	secret, err := s.decode_secret_request(w, r)
 	if err != nil {
-		msg := "nothing received"
-		http.Error(w, msg, http.StatusBadRequest)
-		log.Println(err)
-		return
+		return nil, nil, "", err
 	}
 
 	// marshal the secret as json bytes
@@ -72,31 +133,142 @@ func newSecretHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		msg := "error encoding payload"
 		http.Error(w, msg, http.StatusInternalServerError)
+		return nil, nil, "", err
+	}
+
+	// create the passphrases, then encrypt to the keys stretched from them
+	passphrases := make([]string, recipients)
+	passphrase_bytes := make([][]byte, recipients)
+	for i := range passphrases {
+		passphrases[i] = generate_passphrase(s.config.PassphraseWords)
+		passphrase_bytes[i] = []byte(passphrases[i])
+	}
+
+	// every passphrase is stretched in turn under the one derivation
+	if !s.acquire_derivation() {
+		tooBusy(w)
+		return nil, nil, "", errors.New("no key derivation free to encrypt secret")
+	}
+	defer s.release_derivation()
+
+	ad := associated_data(id, secret.ContentType)
+	var cryptogram []byte
+	if recipients == 1 {
+		cryptogram, err = ecies.EncryptWithPassphraseAD(passphrase_bytes[0], json_bytes, ad, &ecies.DefaultPassphraseParams)
+	} else {
+		cryptogram, err = ecies.EncryptWithPassphrasesAD(passphrase_bytes, json_bytes, ad, &ecies.DefaultPassphraseParams)
+	}
+	if err != nil {
+		msg := "error encoding cryptogram"
+		http.Error(w, msg, http.StatusInternalServerError)
+		return nil, nil, "", err
+	}
+
+	return cryptogram, passphrases, secret.ContentType, nil
+}
+
+// decodes a secret push request which the client has already encrypted. the
+// cryptogram is opaque to us, so all that can be checked is its size, the
+// verifier for the access token needed to retrieve it and who signed it.
+// returns the cryptogram and verifier, else replies with the reason and
+// returns an error.
+func (s *server) decode_sealed_request(w http.ResponseWriter, r *http.Request, recipients int) ([]byte, []byte, error) {
+	// there is only one access token, so only one passphrase
+	if recipients != 1 {
+		msg := "sealed secrets can only have one recipient"
+		http.Error(w, msg, http.StatusBadRequest)
+		return nil, nil, errors.New(msg)
+	}
+
+	verifier, err := base64.StdEncoding.DecodeString(r.Header.Get(wire.VERIFIER_HEADER))
+	if err != nil || len(verifier) != wire.VERIFIER_LEN {
+		msg := fmt.Sprintf("%s header must be the base64 sha-256 of the access token", wire.VERIFIER_HEADER)
+		http.Error(w, msg, http.StatusBadRequest)
+		return nil, nil, errors.New(msg)
+	}
+
+	// leave room for the json and encryption overhead of a secret at the max.
+	// size
+	r.Body = http.MaxBytesReader(w, r.Body, 2*s.config.MaxSecretSize)
+
+	cryptogram, err := ioutil.ReadAll(r.Body)
+	var max_bytes_error *http.MaxBytesError
+	if errors.As(err, &max_bytes_error) {
+		msg := fmt.Sprintf("cryptogram is larger than %d bytes", max_bytes_error.Limit)
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return nil, nil, errors.New(msg)
+	}
+	if err != nil {
+		msg := "an unknown error occurred during read"
+		http.Error(w, msg, http.StatusInternalServerError)
+		return nil, nil, err
+	}
+
+	if len(cryptogram) == 0 {
+		msg := "nothing received"
+		http.Error(w, msg, http.StatusBadRequest)
+		return nil, nil, errors.New(msg)
+	}
+
+	if err := s.verify_sender(w, r, cryptogram); err != nil {
+		return nil, nil, err
+	}
+
+	return cryptogram, verifier, nil
+}
+
+// creates a new secret and returns the id + key
+func (s *server) newSecretHandler(w http.ResponseWriter, r *http.Request) {
+	ttl, err := s.decode_ttl(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		log.Println(err)
 		return
 	}
 
-	// create the passphrase and key
-	passphrase := generate_passphrase()
-	receiver_key, err := ecies.NewECPrivateKeyFromBytes([]byte(passphrase))
+	recipients, err := s.decode_recipients(r)
 	if err != nil {
-		msg := "error deciding passphrase"
-		http.Error(w, msg, http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		log.Println(err)
 		return
 	}
 
-	// then encrypt it
-	cryptogram, err := ecies.EncryptEphemeral(receiver_key.PublicKey(), json_bytes)
+	// the id is needed up front, to bind the cryptogram to it
+	id := goflake.Next()
+
+	// either way, the reason for any failure has already been given. sealed
+	// cryptograms are opaque to us, so can't be bound to anything.
+	var cryptogram, verifier []byte
+	var passphrases []string
+	var content_type string
+	if r.Header.Get("Content-Type") == wire.MIME_CRYPTOGRAM {
+		cryptogram, verifier, err = s.decode_sealed_request(w, r, recipients)
+	} else {
+		cryptogram, passphrases, content_type, err = s.encrypt_secret_request(w, r, id, recipients)
+	}
 	if err != nil {
-		msg := "error encoding cryptogram"
+		log.Println(err)
+		return
+	}
+
+	// wrap the cryptogram with the master key, if any, before it is stored
+	expires_at := time.Now().Add(ttl).UTC()
+	stored := &db.Cryptogram{
+		Id:          id,
+		Data:        cryptogram,
+		ExpiresAt:   expires_at,
+		Verifier:    verifier,
+		ContentType: content_type,
+	}
+	if err := s.master_keys.wrap(stored); err != nil {
+		msg := "error wrapping cryptogram"
 		http.Error(w, msg, http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
 
 	// store the cryptogram and get the id number back
-	id, err := database.InsertCryptogram(goflake.Next(), cryptogram)
+	id, err = s.store.InsertCryptogram(stored)
 	if err != nil {
 		msg := "error storing cryptogram"
 		http.Error(w, msg, http.StatusInternalServerError)
@@ -104,8 +276,17 @@ func newSecretHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// crete and marshal the response
-	response_bytes, err := json.Marshal(responseBody{Id: id, Passphrase: passphrase})
+	// crete and marshal the response. the first passphrase is also given alone,
+	// for those who only asked for one.
+	response := responseBody{Id: id, ExpiresAt: expires_at.Truncate(time.Second)}
+	if len(passphrases) > 0 {
+		response.Passphrase = passphrases[0]
+	}
+	if len(passphrases) > 1 {
+		response.Passphrases = passphrases
+	}
+
+	response_bytes, err := json.Marshal(response)
 	if err != nil {
 		msg := "error encoding response"
 		http.Error(w, msg, http.StatusInternalServerError)
@@ -113,6 +294,6 @@ func newSecretHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// then return the id and password to the user
+	// then return the id and passwords, if we made any, to the user
 	writeResponseBytes(w, MIME_JSON, response_bytes)
 }
@@ -0,0 +1,74 @@
+package unus
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"code.leif.uk/lwg/unus/internal/unus/db"
+)
+
+type _reaper struct {
+	store   db.SecretStore
+	ticker  *time.Ticker
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// starts a reaper which purges expired cryptograms from the store every
+// interval, until ctx is cancelled or it is disposed of
+func newReaper(ctx context.Context, store db.SecretStore, interval time.Duration) *_reaper {
+	ticker := time.NewTicker(interval)
+	reaper := start_reaper(ctx, store, ticker.C)
+	reaper.ticker = ticker
+	return reaper
+}
+
+// starts a reaper which purges the cryptograms expired as of each time
+// received from ticks, until ctx is cancelled or it is disposed of
+func start_reaper(ctx context.Context, store db.SecretStore, ticks <-chan time.Time) *_reaper {
+	ctx, cancel := context.WithCancel(ctx)
+	reaper := &_reaper{
+		store:   store,
+		cancel:  cancel,
+		stopped: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(reaper.stopped)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticks:
+				reaper.reap(now)
+			}
+		}
+	}()
+
+	return reaper
+}
+
+// deletes every cryptogram that has expired as of now
+func (r *_reaper) reap(now time.Time) {
+	rows_affected, err := r.store.DeleteExpiredCryptograms(now)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if rows_affected > 0 {
+		log.Printf("reaped %d expired secret(s)\n", rows_affected)
+	}
+}
+
+// stops the reaper, waiting for any purge in progress to finish, so that the
+// store can then be closed
+func (r *_reaper) Dispose() {
+	if r.ticker != nil {
+		r.ticker.Stop()
+	}
+	r.cancel()
+	<-r.stopped
+}
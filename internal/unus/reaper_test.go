@@ -0,0 +1,135 @@
+package unus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"code.leif.uk/lwg/unus/internal/unus/db"
+)
+
+// reaped_store passes on each purge to the store it wraps, then sends the
+// time it was asked to purge as of
+type reaped_store struct {
+	db.SecretStore
+	reaped chan time.Time
+}
+
+func (s *reaped_store) DeleteExpiredCryptograms(now time.Time) (int64, error) {
+	defer func() { s.reaped <- now }()
+	return s.SecretStore.DeleteExpiredCryptograms(now)
+}
+
+// wait_for_reap waits for the store to be purged as of now
+func wait_for_reap(t *testing.T, store *reaped_store, now time.Time) {
+	t.Helper()
+
+	select {
+	case reaped := <-store.reaped:
+		if !reaped.Equal(now) {
+			t.Fatalf("reaped as of %s, want %s", reaped, now)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the reaper")
+	}
+}
+
+func TestReaperDeletesExpired(t *testing.T) {
+	store := &reaped_store{SecretStore: db.NewMemoryStore(), reaped: make(chan time.Time)}
+	t.Cleanup(store.Dispose)
+
+	// far from the real time, so only the reaper's clock can expire them
+	now := time.Date(2040, time.January, 1, 0, 0, 0, 0, time.UTC)
+	expiries := map[int64]time.Time{
+		1: now.Add(-time.Hour),
+		2: now,
+		3: now.Add(time.Second),
+		4: now.Add(2 * time.Hour),
+	}
+	for id, expires_at := range expiries {
+		if _, err := store.InsertCryptogram(&db.Cryptogram{Id: id, Data: []byte("cryptogram"), ExpiresAt: expires_at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ticks := make(chan time.Time)
+	reaper := start_reaper(context.Background(), store, ticks)
+	defer reaper.Dispose()
+
+	ticks <- now
+	wait_for_reap(t, store, now)
+
+	ticks <- now.Add(time.Hour)
+	wait_for_reap(t, store, now.Add(time.Hour))
+
+	// whatever is left can still be deleted
+	for id, want := range map[int64]int64{1: 0, 2: 0, 3: 0, 4: 1} {
+		deleted, err := store.DeleteCryptogram(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != want {
+			t.Errorf("secret %d expiring at %s: %d left, want %d", id, expiries[id], deleted, want)
+		}
+	}
+}
+
+func TestReaperStopsOnCancel(t *testing.T) {
+	store := &reaped_store{SecretStore: db.NewMemoryStore(), reaped: make(chan time.Time, 1)}
+	t.Cleanup(store.Dispose)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ticks := make(chan time.Time)
+	reaper := start_reaper(ctx, store, ticks)
+	defer reaper.Dispose()
+
+	now := time.Now()
+	ticks <- now
+	wait_for_reap(t, store, now)
+
+	cancel()
+	select {
+	case <-reaper.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reaper still running after its context was cancelled")
+	}
+
+	// nothing is left to receive another tick
+	select {
+	case ticks <- now:
+		t.Fatal("reaper reaped after its context was cancelled")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReaperDispose(t *testing.T) {
+	store := &reaped_store{SecretStore: db.NewMemoryStore(), reaped: make(chan time.Time)}
+	t.Cleanup(store.Dispose)
+
+	reaper := newReaper(context.Background(), store, time.Millisecond)
+
+	// the real clock drives it, so wait for a purge as of any time
+	select {
+	case <-store.reaped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the reaper")
+	}
+
+	purging := make(chan struct{})
+	go func() {
+		defer close(purging)
+		for range store.reaped {
+		}
+	}()
+
+	// returns only once the reaper has stopped, so the store can be closed
+	reaper.Dispose()
+	select {
+	case <-reaper.stopped:
+	default:
+		t.Fatal("reaper still running after being disposed of")
+	}
+
+	close(store.reaped)
+	<-purging
+}
@@ -0,0 +1,80 @@
+package unus
+
+import (
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"code.leif.uk/lwg/unus/internal/wire"
+	ecies "code.leif.uk/lwg/unus/pkg/go-ecies"
+)
+
+// loads the public keys of the senders whose secrets are accepted from a PEM
+// file
+func load_trusted_senders(path string) ([]crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	trusted_senders, err := ecies.ParseVerifyingKeysPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return trusted_senders, nil
+}
+
+// checks the request was signed by one of the trusted senders, if any are
+// configured, and recently enough that it isn't being replayed. else replies
+// with the reason and returns an error.
+func (s *server) verify_sender(w http.ResponseWriter, r *http.Request, body []byte) error {
+	if len(s.trusted_senders) == 0 {
+		return nil
+	}
+
+	raw_signature := r.Header.Get(wire.SIGNATURE_HEADER)
+	if raw_signature == "" {
+		msg := fmt.Sprintf("secrets must be signed by a trusted sender in the %s header", wire.SIGNATURE_HEADER)
+		http.Error(w, msg, http.StatusUnauthorized)
+		return errors.New(msg)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(raw_signature)
+	if err != nil {
+		msg := fmt.Sprintf("%s header must be base64", wire.SIGNATURE_HEADER)
+		http.Error(w, msg, http.StatusBadRequest)
+		return errors.New(msg)
+	}
+
+	timestamp, err := strconv.ParseInt(r.Header.Get(wire.TIMESTAMP_HEADER), 10, 64)
+	if err != nil {
+		msg := fmt.Sprintf("%s header must be the time of signing in seconds since the unix epoch", wire.TIMESTAMP_HEADER)
+		http.Error(w, msg, http.StatusBadRequest)
+		return errors.New(msg)
+	}
+
+	// either clock may be a little out, so allow for it both ways
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > wire.MAX_SIGNATURE_AGE || age < -wire.MAX_SIGNATURE_AGE {
+		msg := fmt.Sprintf("signature must be made within %s of the server's time", wire.MAX_SIGNATURE_AGE)
+		http.Error(w, msg, http.StatusUnauthorized)
+		return errors.New(msg)
+	}
+
+	signed := wire.SignedRequest(r.Header, r.URL.Query(), body)
+	for _, trusted_sender := range s.trusted_senders {
+		if ecies.Verify(trusted_sender, signed, signature) == nil {
+			return nil
+		}
+	}
+
+	msg := "secret is not signed by a trusted sender"
+	http.Error(w, msg, http.StatusForbidden)
+	return errors.New(msg)
+}
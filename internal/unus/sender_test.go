@@ -0,0 +1,181 @@
+package unus
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"code.leif.uk/lwg/unus/internal/unus/config"
+	"code.leif.uk/lwg/unus/internal/wire"
+	ecies "code.leif.uk/lwg/unus/pkg/go-ecies"
+)
+
+// new_test_sender makes a signing key, and writes its public key to a PEM
+// file of trusted senders, returning both
+func new_test_sender(t *testing.T) (crypto.Signer, string) {
+	t.Helper()
+
+	_, signing_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(signing_key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "trusted.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return signing_key, path
+}
+
+// new_signed_request makes a request to create a secret, signed by the key at
+// the given time. the request may be changed afterwards, to break the
+// signature.
+func new_signed_request(t *testing.T, signing_key crypto.Signer, signed_at time.Time, target string, content_type string, body string) *http.Request {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	request.Header.Set("Content-Type", content_type)
+	if content_type == wire.MIME_CRYPTOGRAM {
+		token_hash := sha256.Sum256([]byte("access-token"))
+		request.Header.Set(wire.VERIFIER_HEADER, base64.StdEncoding.EncodeToString(token_hash[:]))
+	}
+	request.Header.Set(wire.TIMESTAMP_HEADER, strconv.FormatInt(signed_at.Unix(), 10))
+
+	signature, err := ecies.Sign(signing_key, wire.SignedRequest(request.Header, request.URL.Query(), []byte(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set(wire.SIGNATURE_HEADER, base64.StdEncoding.EncodeToString(signature))
+
+	return request
+}
+
+func TestTrustedSenders(t *testing.T) {
+	signing_key, trusted_senders := new_test_sender(t)
+	untrusted_key, _ := new_test_sender(t)
+
+	handler, _ := new_test_handler(t, func(cfg *config.Config) {
+		cfg.TrustedSenders = trusted_senders
+	})
+
+	now := time.Now()
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		want    int
+	}{
+		{"signed", func() *http.Request {
+			return new_signed_request(t, signing_key, now, "/api/v1/secrets?ttl=1h", MIME_STRING, "secret")
+		}, http.StatusOK},
+		{"signed and sealed", func() *http.Request {
+			return new_signed_request(t, signing_key, now, "/api/v1/secrets", wire.MIME_CRYPTOGRAM, "cryptogram")
+		}, http.StatusOK},
+		{"signed a little ahead", func() *http.Request {
+			return new_signed_request(t, signing_key, now.Add(time.Minute), "/api/v1/secrets", MIME_STRING, "secret")
+		}, http.StatusOK},
+		{"unsigned", func() *http.Request {
+			request := new_signed_request(t, signing_key, now, "/api/v1/secrets", MIME_STRING, "secret")
+			request.Header.Del(wire.SIGNATURE_HEADER)
+			return request
+		}, http.StatusUnauthorized},
+		{"signature not base64", func() *http.Request {
+			request := new_signed_request(t, signing_key, now, "/api/v1/secrets", MIME_STRING, "secret")
+			request.Header.Set(wire.SIGNATURE_HEADER, "not base64!")
+			return request
+		}, http.StatusBadRequest},
+		{"no timestamp", func() *http.Request {
+			request := new_signed_request(t, signing_key, now, "/api/v1/secrets", MIME_STRING, "secret")
+			request.Header.Del(wire.TIMESTAMP_HEADER)
+			return request
+		}, http.StatusBadRequest},
+		{"timestamp not a number", func() *http.Request {
+			request := new_signed_request(t, signing_key, now, "/api/v1/secrets", MIME_STRING, "secret")
+			request.Header.Set(wire.TIMESTAMP_HEADER, now.Format(time.RFC3339))
+			return request
+		}, http.StatusBadRequest},
+		{"stale", func() *http.Request {
+			return new_signed_request(t, signing_key, now.Add(-wire.MAX_SIGNATURE_AGE-time.Minute), "/api/v1/secrets", MIME_STRING, "secret")
+		}, http.StatusUnauthorized},
+		{"from the future", func() *http.Request {
+			return new_signed_request(t, signing_key, now.Add(wire.MAX_SIGNATURE_AGE+time.Minute), "/api/v1/secrets", MIME_STRING, "secret")
+		}, http.StatusUnauthorized},
+		{"timestamp changed", func() *http.Request {
+			request := new_signed_request(t, signing_key, now, "/api/v1/secrets", MIME_STRING, "secret")
+			request.Header.Set(wire.TIMESTAMP_HEADER, strconv.FormatInt(now.Unix()+1, 10))
+			return request
+		}, http.StatusForbidden},
+		{"untrusted", func() *http.Request {
+			return new_signed_request(t, untrusted_key, now, "/api/v1/secrets", MIME_STRING, "secret")
+		}, http.StatusForbidden},
+		{"ttl added", func() *http.Request {
+			request := new_signed_request(t, signing_key, now, "/api/v1/secrets", MIME_STRING, "secret")
+			request.URL.RawQuery = "ttl=1m"
+			return request
+		}, http.StatusForbidden},
+		{"ttl changed", func() *http.Request {
+			request := new_signed_request(t, signing_key, now, "/api/v1/secrets?ttl=1h", MIME_STRING, "secret")
+			request.URL.RawQuery = "ttl=2h"
+			return request
+		}, http.StatusForbidden},
+		{"recipients changed", func() *http.Request {
+			request := new_signed_request(t, signing_key, now, "/api/v1/secrets?recipients=2", MIME_STRING, "secret")
+			request.URL.RawQuery = "recipients=3"
+			return request
+		}, http.StatusForbidden},
+		{"content type changed", func() *http.Request {
+			request := new_signed_request(t, signing_key, now, "/api/v1/secrets", MIME_STRING, "secret")
+			request.Header.Set("Content-Type", MIME_JSON)
+			return request
+		}, http.StatusForbidden},
+		{"verifier changed", func() *http.Request {
+			request := new_signed_request(t, signing_key, now, "/api/v1/secrets", wire.MIME_CRYPTOGRAM, "cryptogram")
+			token_hash := sha256.Sum256([]byte("another-access-token"))
+			request.Header.Set(wire.VERIFIER_HEADER, base64.StdEncoding.EncodeToString(token_hash[:]))
+			return request
+		}, http.StatusForbidden},
+		{"body changed", func() *http.Request {
+			request := new_signed_request(t, signing_key, now, "/api/v1/secrets", MIME_STRING, "secret")
+			request.Body = io.NopCloser(strings.NewReader("secreT"))
+			return request
+		}, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if response := serve(handler, test.request()); response.Code != test.want {
+				t.Fatalf("gave %d, want %d: %s", response.Code, test.want, response.Body)
+			}
+		})
+	}
+}
+
+func TestTrustedSendersNotConfigured(t *testing.T) {
+	handler, _ := new_test_handler(t, nil)
+
+	// without trusted senders, signatures are neither needed nor checked
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/secrets", strings.NewReader("secret"))
+	request.Header.Set("Content-Type", MIME_STRING)
+	request.Header.Set(wire.SIGNATURE_HEADER, "not base64!")
+	if response := serve(handler, request); response.Code != http.StatusOK {
+		t.Fatalf("gave %d: %s", response.Code, response.Body)
+	}
+}
@@ -2,12 +2,23 @@ package unus
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
+	"time"
 
+	"code.leif.uk/lwg/unus/internal/unus/config"
 	"code.leif.uk/lwg/unus/internal/unus/db"
+	"code.leif.uk/lwg/unus/internal/wire"
 )
 
 const (
@@ -20,12 +31,25 @@ const (
 var (
 	secret_id_regex  = regexp.MustCompile(`^/api/v1/secrets/(?P<id>\d{1,19})$`)
 	basic_auth_regex = regexp.MustCompile(`^Basic (?P<passphrase>[\w+\/=]+)$`)
-	database         = db.NewDbConnection(db.DEFAULT_DATABASE)
 )
 
+// server holds everything the request handlers depend upon
+type server struct {
+	config          *config.Config
+	store           db.SecretStore
+	trusted_senders []crypto.PublicKey
+	master_keys     *master_keys
+
+	// holds a token for each passphrase key derivation under way, so that no
+	// more than the configured number run at once
+	derivations chan struct{}
+}
+
 type responseBody struct {
-	Id         int64
-	Passphrase string
+	Id          int64
+	Passphrase  string   `json:",omitempty"`
+	Passphrases []string `json:",omitempty"`
+	ExpiresAt   time.Time
 }
 
 // writes a response to the given writer
@@ -68,14 +92,212 @@ func createHandler(fn func(http.ResponseWriter, *http.Request), allowedMethods [
 	}
 }
 
-// serves unus
-func Serve(listenAddress string) error {
+// reserves one of the passphrase key derivations which may run at once,
+// returning false if none are free. each needs 64 MiB, so callers refuse the
+// request rather than wait for one.
+func (s *server) acquire_derivation() bool {
+	select {
+	case s.derivations <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// frees a key derivation reserved by acquire_derivation
+func (s *server) release_derivation() {
+	<-s.derivations
+}
+
+// writes a service unavailable message to the response stream, for when no key
+// derivation is free
+func tooBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "too many passphrases being checked, try again later", http.StatusServiceUnavailable)
+}
+
+// creates the server, keeping secrets in the given store. an error is returned
+// if the trusted senders or master keys are configured but can't be loaded.
+func new_server(cfg *config.Config, store db.SecretStore) (*server, error) {
+	s := &server{
+		config:      cfg,
+		store:       store,
+		derivations: make(chan struct{}, cfg.MaxDerivations),
+	}
+
+	master_keys, err := load_master_keys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.master_keys = master_keys
+
+	if cfg.TrustedSenders != "" {
+		trusted_senders, err := load_trusted_senders(cfg.TrustedSenders)
+		if err != nil {
+			return nil, err
+		}
+		s.trusted_senders = trusted_senders
+	}
+
+	return s, nil
+}
+
+// creates the unus request handler, keeping secrets in the given store. an
+// error is returned if the trusted senders or master keys are configured but
+// can't be loaded.
+func NewHandler(cfg *config.Config, store db.SecretStore) (http.Handler, error) {
+	s, err := new_server(cfg, store)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.handler(), nil
+}
+
+// routes each request to its handler
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", createHandler(frontPageHandler, []string{"GET"}))
+	mux.HandleFunc(wire.SECRETS_PATH, createHandler(s.newSecretHandler, []string{"POST"}))
+	mux.HandleFunc(wire.SECRETS_PATH+"/", createHandler(s.getSecretHandler, []string{"DELETE"}))
+
+	return mux
+}
+
+// opens the secret store named by the configuration. unus built without cgo
+// has no sqlite3 store, so falls back to the in-memory store, saying why.
+// returns an error if the store can't be opened.
+func NewStore(cfg *config.Config) (db.SecretStore, error) {
+	if cfg.Storage == config.STORAGE_MEMORY {
+		return db.NewMemoryStore(), nil
+	}
+
+	store, err := db.NewDbConnection(cfg.DatabasePath)
+	if errors.Is(err, db.ErrSQLiteUnavailable) {
+		log.Printf("%s, falling back to %s storage. secrets will be lost on restart.\n", err, config.STORAGE_MEMORY)
+		return db.NewMemoryStore(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.DatabasePath, err)
+	}
+
+	return store, nil
+}
+
+// creates a handler which redirects every request to the same path over https
+// on the given https listen address
+func newRedirectHandler(https_address string) http.Handler {
+	_, https_port, _ := net.SplitHostPort(https_address)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// no port was given
+			host = r.Host
+		}
+
+		if https_port != "" && https_port != "443" {
+			host = net.JoinHostPort(host, https_port)
+		}
+
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// serves unus according to the given configuration until ctx is cancelled,
+// at which point in-flight requests are given the configured shutdown timeout
+// to finish before the store is closed. if a tls certificate is configured,
+// serves https and optionally redirects http to it, otherwise serves plain
+// http. returns nil after a clean shutdown, else an error.
+func Serve(ctx context.Context, cfg *config.Config) error {
 	defer goflake.Dispose()
-	defer database.Dispose()
 
-	http.HandleFunc("/", createHandler(frontPageHandler, []string{"GET"}))
-	http.HandleFunc("/api/v1/secrets", createHandler(newSecretHandler, []string{"POST"}))
-	http.HandleFunc("/api/v1/secrets/", createHandler(getSecretHandler, []string{"DELETE"}))
+	store, err := NewStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Dispose()
+
+	handler, err := NewHandler(cfg, store)
+	if err != nil {
+		return err
+	}
+
+	reaper := newReaper(ctx, store, cfg.ReapInterval)
+	defer reaper.Dispose()
+
+	server := &http.Server{
+		Addr:    cfg.ListenAddress,
+		Handler: handler,
+	}
+	servers := []*http.Server{server}
+	errs := make(chan error, 2)
+
+	if cfg.TLSCertificate == "" {
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	} else {
+		certificate, err := newCertificate(cfg.TLSCertificate, cfg.TLSKey, cfg.TLSReloadInterval)
+		if err != nil {
+			return err
+		}
+		defer certificate.Dispose()
 
-	return http.ListenAndServe(listenAddress, nil)
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certificate.GetCertificate,
+		}
+
+		go func() {
+			// the certificate comes from the tls config
+			errs <- server.ListenAndServeTLS("", "")
+		}()
+
+		if cfg.RedirectAddress != "" {
+			redirect := &http.Server{
+				Addr:    cfg.RedirectAddress,
+				Handler: newRedirectHandler(cfg.ListenAddress),
+			}
+			servers = append(servers, redirect)
+
+			go func() {
+				errs <- redirect.ListenAndServe()
+			}()
+		}
+	}
+
+	select {
+	case err := <-errs:
+		// one listener failing takes the others down with it
+		shutdown(servers, cfg.ShutdownTimeout)
+		return err
+	case <-ctx.Done():
+		log.Println("shutting down")
+		return shutdown(servers, cfg.ShutdownTimeout)
+	}
+}
+
+// stops the servers accepting connections and waits up to timeout for
+// in-flight requests to finish. any still running after that are cut off.
+// returns the first error encountered, if any.
+func shutdown(servers []*http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var first error
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err == nil {
+			continue
+		}
+
+		// ran out of time, so drop whatever is left
+		server.Close()
+		if first == nil {
+			first = err
+		}
+	}
+	return first
 }
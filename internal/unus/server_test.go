@@ -0,0 +1,499 @@
+package unus
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"code.leif.uk/lwg/unus/internal/unus/config"
+	"code.leif.uk/lwg/unus/internal/unus/db"
+	"code.leif.uk/lwg/unus/internal/wire"
+)
+
+func TestMain(m *testing.M) {
+	// there may be no system dictionary to babble from
+	generate_passphrase = func(words int) string {
+		parts := make([]string, words)
+		for i := range parts {
+			word := make([]byte, 4)
+			rand.Read(word)
+			parts[i] = hex.EncodeToString(word)
+		}
+		return strings.Join(parts, "-")
+	}
+
+	os.Exit(m.Run())
+}
+
+// new_test_handler returns the unus handler over an in-memory store, with the
+// default configuration changed by configure, if not nil
+func new_test_handler(t *testing.T, configure func(cfg *config.Config)) (http.Handler, db.SecretStore) {
+	t.Helper()
+
+	s := new_test_server(t, configure)
+	return s.handler(), s.store
+}
+
+// new_test_server returns the unus server over an in-memory store, with the
+// default configuration changed by configure, if not nil
+func new_test_server(t *testing.T, configure func(cfg *config.Config)) *server {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.Storage = config.STORAGE_MEMORY
+	if configure != nil {
+		configure(cfg)
+	}
+
+	store := db.NewMemoryStore()
+	t.Cleanup(store.Dispose)
+
+	s, err := new_server(cfg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// serve sends the request to the handler, returning the recorded response
+func serve(handler http.Handler, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// create_secret posts the secret to the handler, failing the test unless it
+// is stored
+func create_secret(t *testing.T, handler http.Handler, content_type string, secret string) responseBody {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/secrets", strings.NewReader(secret))
+	request.Header.Set("Content-Type", content_type)
+
+	response := serve(handler, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("create gave %d: %s", response.Code, response.Body)
+	}
+
+	var body responseBody
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// retrieve asks the handler for the secret by id with the given passphrase
+// and accept header, which may be empty
+func retrieve(handler http.Handler, id int64, passphrase string, accept string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodDelete, "/api/v1/secrets/"+strconv.FormatInt(id, 10), nil)
+	request.SetBasicAuth("", passphrase)
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	return serve(handler, request)
+}
+
+func TestCreateAndRetrieve(t *testing.T) {
+	handler, _ := new_test_handler(t, nil)
+
+	created := create_secret(t, handler, MIME_STRING, "MySuperSecretMessage")
+	if created.Passphrase == "" {
+		t.Fatal("no passphrase given")
+	}
+
+	response := retrieve(handler, created.Id, created.Passphrase, "")
+	if response.Code != http.StatusOK {
+		t.Fatalf("retrieve gave %d: %s", response.Code, response.Body)
+	}
+	if got := response.Body.String(); got != "MySuperSecretMessage" {
+		t.Fatalf("retrieve gave %q", got)
+	}
+	if got := response.Header().Get("Content-Type"); got != MIME_STRING {
+		t.Fatalf("retrieve gave content type %q", got)
+	}
+
+	// secrets are burned once read
+	if response := retrieve(handler, created.Id, created.Passphrase, ""); response.Code != http.StatusNotFound {
+		t.Fatalf("second retrieve gave %d, want %d", response.Code, http.StatusNotFound)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	handler, _ := new_test_handler(t, nil)
+
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/secrets?recipients=3", strings.NewReader("MySuperSecretMessage"))
+	request.Header.Set("Content-Type", MIME_STRING)
+	response := serve(handler, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("create gave %d: %s", response.Code, response.Body)
+	}
+
+	var created responseBody
+	if err := json.Unmarshal(response.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if len(created.Passphrases) != 3 || created.Passphrase != created.Passphrases[0] {
+		t.Fatalf("create gave passphrases %q and %q", created.Passphrase, created.Passphrases)
+	}
+
+	// any of them will do
+	if response := retrieve(handler, created.Id, created.Passphrases[2], ""); response.Code != http.StatusOK {
+		t.Fatalf("retrieve gave %d: %s", response.Code, response.Body)
+	}
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	handler, _ := new_test_handler(t, func(cfg *config.Config) {
+		cfg.MaxAttempts = 2
+	})
+
+	created := create_secret(t, handler, MIME_STRING, "MySuperSecretMessage")
+
+	response := retrieve(handler, created.Id, "wrong-passphrase", "")
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("first wrong passphrase gave %d, want %d", response.Code, http.StatusUnauthorized)
+	}
+
+	response = retrieve(handler, created.Id, "wrong-passphrase", "")
+	if response.Code != http.StatusForbidden {
+		t.Fatalf("last wrong passphrase gave %d, want %d", response.Code, http.StatusForbidden)
+	}
+
+	// the secret was destroyed, so even the right passphrase is too late
+	response = retrieve(handler, created.Id, created.Passphrase, "")
+	if response.Code != http.StatusNotFound {
+		t.Fatalf("retrieve gave %d, want %d", response.Code, http.StatusNotFound)
+	}
+}
+
+func TestExpiredSecret(t *testing.T) {
+	handler, store := new_test_handler(t, nil)
+
+	_, err := store.InsertCryptogram(&db.Cryptogram{Id: 1, Data: []byte("cryptogram"), ExpiresAt: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response := retrieve(handler, 1, "passphrase", ""); response.Code != http.StatusGone {
+		t.Fatalf("retrieve gave %d, want %d", response.Code, http.StatusGone)
+	}
+
+	// expired secrets are burned as they are found
+	if response := retrieve(handler, 1, "passphrase", ""); response.Code != http.StatusNotFound {
+		t.Fatalf("retrieve gave %d, want %d", response.Code, http.StatusNotFound)
+	}
+}
+
+func TestSealedSecret(t *testing.T) {
+	handler, _ := new_test_handler(t, nil)
+
+	token := "access-token"
+	token_hash := sha256.Sum256([]byte(token))
+
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/secrets", strings.NewReader("opaque cryptogram"))
+	request.Header.Set("Content-Type", wire.MIME_CRYPTOGRAM)
+	request.Header.Set(wire.VERIFIER_HEADER, base64.StdEncoding.EncodeToString(token_hash[:]))
+	response := serve(handler, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("create gave %d: %s", response.Code, response.Body)
+	}
+
+	var created responseBody
+	if err := json.Unmarshal(response.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Passphrase != "" {
+		t.Fatal("the server chose a passphrase for a sealed secret")
+	}
+
+	// asking for the plaintext isn't counted as a wrong passphrase
+	for i := 0; i < 10; i++ {
+		if response := retrieve(handler, created.Id, token, ""); response.Code != http.StatusNotAcceptable {
+			t.Fatalf("retrieve in the wrong mode gave %d, want %d", response.Code, http.StatusNotAcceptable)
+		}
+	}
+
+	if response := retrieve(handler, created.Id, "wrong-token", wire.MIME_CRYPTOGRAM); response.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong access token gave %d, want %d", response.Code, http.StatusUnauthorized)
+	}
+
+	response = retrieve(handler, created.Id, token, wire.MIME_CRYPTOGRAM)
+	if response.Code != http.StatusOK {
+		t.Fatalf("retrieve gave %d: %s", response.Code, response.Body)
+	}
+	if got := response.Body.String(); got != "opaque cryptogram" {
+		t.Fatalf("retrieve gave %q", got)
+	}
+}
+
+func TestServerSecretRetrievedAsSealed(t *testing.T) {
+	handler, _ := new_test_handler(t, nil)
+
+	created := create_secret(t, handler, MIME_STRING, "MySuperSecretMessage")
+	if response := retrieve(handler, created.Id, created.Passphrase, wire.MIME_CRYPTOGRAM); response.Code != http.StatusNotAcceptable {
+		t.Fatalf("retrieve in the wrong mode gave %d, want %d", response.Code, http.StatusNotAcceptable)
+	}
+
+	// and it's still there
+	if response := retrieve(handler, created.Id, created.Passphrase, ""); response.Code != http.StatusOK {
+		t.Fatalf("retrieve gave %d: %s", response.Code, response.Body)
+	}
+}
+
+func TestTooManyDerivations(t *testing.T) {
+	s := new_test_server(t, func(cfg *config.Config) {
+		cfg.MaxDerivations = 2
+		cfg.MaxAttempts = 1
+	})
+	handler := s.handler()
+
+	created := create_secret(t, handler, MIME_STRING, "MySuperSecretMessage")
+
+	// hold every derivation, as if that many passphrases were being checked.
+	// requests past the limit must be refused at once, not left waiting.
+	for i := 0; i < 2; i++ {
+		if !s.acquire_derivation() {
+			t.Fatalf("derivation %d refused", i)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/secrets", strings.NewReader("MySuperSecretMessage"))
+	request.Header.Set("Content-Type", MIME_STRING)
+	response := serve(handler, request)
+	if response.Code != http.StatusServiceUnavailable {
+		t.Fatalf("create gave %d, want %d", response.Code, http.StatusServiceUnavailable)
+	}
+	if response.Header().Get("Retry-After") == "" {
+		t.Fatal("create gave no Retry-After")
+	}
+
+	// nor is being refused counted as a wrong passphrase, though one attempt
+	// is all it has
+	for i := 0; i < 3; i++ {
+		if response := retrieve(handler, created.Id, "wrong-passphrase", ""); response.Code != http.StatusServiceUnavailable {
+			t.Fatalf("retrieve gave %d, want %d", response.Code, http.StatusServiceUnavailable)
+		}
+	}
+
+	// sealed secrets need no derivation, so are unaffected
+	token := "access-token"
+	token_hash := sha256.Sum256([]byte(token))
+	request = httptest.NewRequest(http.MethodPost, "/api/v1/secrets", strings.NewReader("opaque cryptogram"))
+	request.Header.Set("Content-Type", wire.MIME_CRYPTOGRAM)
+	request.Header.Set(wire.VERIFIER_HEADER, base64.StdEncoding.EncodeToString(token_hash[:]))
+	if response := serve(handler, request); response.Code != http.StatusOK {
+		t.Fatalf("sealed create gave %d: %s", response.Code, response.Body)
+	}
+
+	s.release_derivation()
+
+	if response := retrieve(handler, created.Id, created.Passphrase, ""); response.Code != http.StatusOK {
+		t.Fatalf("retrieve gave %d: %s", response.Code, response.Body)
+	}
+}
+
+func TestRejectedRequests(t *testing.T) {
+	handler, _ := new_test_handler(t, func(cfg *config.Config) {
+		cfg.MaxSecretSize = 16
+	})
+
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		content_type string
+		body         string
+		want         int
+	}{
+		{"unsupported content type", http.MethodPost, "/api/v1/secrets", "application/octet-stream", "secret", http.StatusUnsupportedMediaType},
+		{"too large", http.MethodPost, "/api/v1/secrets", MIME_STRING, strings.Repeat("a", 17), http.StatusRequestEntityTooLarge},
+		{"bad ttl", http.MethodPost, "/api/v1/secrets?ttl=forever", MIME_STRING, "secret", http.StatusBadRequest},
+		{"ttl too long", http.MethodPost, "/api/v1/secrets?ttl=10000h", MIME_STRING, "secret", http.StatusBadRequest},
+		{"too many recipients", http.MethodPost, "/api/v1/secrets?recipients=100", MIME_STRING, "secret", http.StatusBadRequest},
+		{"sealed without verifier", http.MethodPost, "/api/v1/secrets", wire.MIME_CRYPTOGRAM, "cryptogram", http.StatusBadRequest},
+		{"wrong method", http.MethodGet, "/api/v1/secrets/1", "", "", http.StatusMethodNotAllowed},
+		{"bad id", http.MethodDelete, "/api/v1/secrets/abc", "", "", http.StatusBadRequest},
+		{"no passphrase", http.MethodDelete, "/api/v1/secrets/1", "", "", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, test.target, bytes.NewReader([]byte(test.body)))
+			if test.content_type != "" {
+				request.Header.Set("Content-Type", test.content_type)
+			}
+
+			if response := serve(handler, request); response.Code != test.want {
+				t.Fatalf("gave %d, want %d: %s", response.Code, test.want, response.Body)
+			}
+		})
+	}
+}
+
+// goroutines counts the goroutines running any of the named functions
+func goroutines(functions ...string) int {
+	stacks := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(stacks, true)
+		if n < len(stacks) {
+			stacks = stacks[:n]
+			break
+		}
+		stacks = make([]byte, 2*len(stacks))
+	}
+
+	count := 0
+	for _, stack := range strings.Split(string(stacks), "\n\n") {
+		for _, function := range functions {
+			if strings.Contains(stack, function) {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+// watchers counts the goroutines of reapers and certificate watchers running
+func watchers() int {
+	return goroutines("unus.start_reaper.func", "unus.newCertificate.func")
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	pki := new_test_pki(t)
+	pki.issue(t, 2)
+
+	cfg := config.Default()
+	cfg.Storage = config.STORAGE_MEMORY
+	cfg.ListenAddress = free_address(t)
+	cfg.TLSCertificate = pki.certificate_path
+	cfg.TLSKey = pki.key_path
+	cfg.TLSReloadInterval = 10 * time.Millisecond
+	cfg.ReapInterval = 10 * time.Millisecond
+
+	before := watchers()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, cfg)
+	}()
+
+	eventually(t, "unus to listen", func() bool {
+		connection, err := net.Dial("tcp", cfg.ListenAddress)
+		if err == nil {
+			connection.Close()
+		}
+		return err == nil
+	})
+
+	if running := watchers() - before; running != 2 {
+		t.Fatalf("%d reapers and certificate watchers running, want 2", running)
+	}
+
+	// start a request, but hold back the end of its body so that it is still
+	// in flight when shutdown begins. with its length given, the headers are
+	// sent without waiting for the body.
+	body, body_writer := io.Pipe()
+	request, err := http.NewRequest(http.MethodPost, "https://"+cfg.ListenAddress+"/api/v1/secrets", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", MIME_STRING)
+	request.ContentLength = int64(len("half a secret"))
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pki.pool, ServerName: "localhost"},
+	}}
+	defer client.CloseIdleConnections()
+
+	responses := make(chan *http.Response, 1)
+	errs := make(chan error, 1)
+	go func() {
+		response, err := client.Do(request)
+		if err != nil {
+			errs <- err
+			return
+		}
+		responses <- response
+	}()
+
+	if _, err := body_writer.Write([]byte("half a ")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a request whose headers haven't been read when shutdown begins is
+	// dropped, so wait for it to reach its handler
+	eventually(t, "the request to be handled", func() bool {
+		return goroutines("unus.(*server).newSecretHandler") > 0
+	})
+
+	cancel()
+
+	// no new connections are accepted
+	eventually(t, "the listener to close", func() bool {
+		connection, err := net.Dial("tcp", cfg.ListenAddress)
+		if err == nil {
+			connection.Close()
+		}
+		return err != nil
+	})
+
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned %v with a request in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the request in flight is still answered
+	if _, err := body_writer.Write([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	body_writer.Close()
+
+	select {
+	case response := <-responses:
+		defer response.Body.Close()
+		var created responseBody
+		if err := json.NewDecoder(response.Body).Decode(&created); err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusOK || created.Passphrase == "" {
+			t.Fatalf("request in flight gave %d: %+v", response.StatusCode, created)
+		}
+	case err := <-errs:
+		t.Fatalf("request in flight failed: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the request in flight")
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for serve to return")
+	}
+
+	// the reaper and certificate watcher are stopped before serve returns
+	if running := watchers() - before; running != 0 {
+		t.Fatalf("%d reapers and certificate watchers still running", running)
+	}
+}
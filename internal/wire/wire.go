@@ -0,0 +1,83 @@
+package wire
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// what the unus server and its clients put on the wire, kept in one place so
+// that neither can drift from the other
+const (
+	// secrets are created by posting to this path, and retrieved by deleting
+	// the id beneath it
+	SECRETS_PATH = "/api/v1/secrets"
+
+	// secrets sealed by the client are uploaded and returned as this
+	MIME_CRYPTOGRAM = "application/vnd.unus.cryptogram"
+
+	// carries the base64 sha-256 of the access token for a sealed secret
+	VERIFIER_HEADER = "Unus-Verifier"
+
+	// carries the base64 signature of a secret from a trusted sender
+	SIGNATURE_HEADER = "Unus-Signature"
+
+	// carries the time a secret was signed, in seconds since the unix epoch
+	TIMESTAMP_HEADER = "Unus-Timestamp"
+
+	// query parameters giving the time-to-live of a new secret, e.g. ?ttl=1h,
+	// and how many passphrases it is given, e.g. ?recipients=3
+	TTL_PARAM        = "ttl"
+	RECIPIENTS_PARAM = "recipients"
+
+	// domain separates the access token from the key made from a passphrase
+	ACCESS_TOKEN_INFO = "unus access token v1"
+
+	// the length of a verifier, before it is base64 encoded
+	VERIFIER_LEN = sha256.Size
+
+	// how far a signature's timestamp may be from the server's clock before
+	// the secret is refused, so that a signed request can't be replayed later
+	MAX_SIGNATURE_AGE = 5 * time.Minute
+)
+
+// AccessToken derives the access token that proves knowledge of the passphrase
+// of a sealed secret to the server without revealing it. It is an
+// HMAC-SHA-256 of ACCESS_TOKEN_INFO keyed by the passphrase, base64url
+// encoded, so neither the passphrase nor the key made from it can be
+// recovered from the token.
+func AccessToken(passphrase string) string {
+	mac := hmac.New(sha256.New, []byte(passphrase))
+	mac.Write([]byte(ACCESS_TOKEN_INFO))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verifier derives the verifier the server keeps in place of the access token
+func Verifier(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// SignedRequest returns what a sender signs to create a secret: the timestamp,
+// ttl, recipients, content type and verifier, each prefixed by its length as a
+// big-endian u32, then the body exactly as it is uploaded. Each field is taken
+// as it appears in the header or query, and is empty if absent, so that
+// everything the server acts upon is covered by the signature.
+func SignedRequest(header http.Header, query url.Values, body []byte) []byte {
+	var signed []byte
+	for _, field := range []string{
+		header.Get(TIMESTAMP_HEADER),
+		query.Get(TTL_PARAM),
+		query.Get(RECIPIENTS_PARAM),
+		header.Get("Content-Type"),
+		header.Get(VERIFIER_HEADER),
+	} {
+		signed = binary.BigEndian.AppendUint32(signed, uint32(len(field)))
+		signed = append(signed, field...)
+	}
+	return append(signed, body...)
+}
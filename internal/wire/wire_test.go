@@ -0,0 +1,56 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestAccessToken(t *testing.T) {
+	// clients already out there derive the same token, so it must never change
+	token := AccessToken("correct-horse-battery-staple")
+	if token != "3xQ2JF137ot4wAjhGnsn3lBsaLWNpO6XPsuuwOZigV8" {
+		t.Fatalf("access token is %q", token)
+	}
+
+	verifier := Verifier(token)
+	if len(verifier) != VERIFIER_LEN {
+		t.Fatalf("verifier is %d bytes, want %d", len(verifier), VERIFIER_LEN)
+	}
+	if got := base64.StdEncoding.EncodeToString(verifier); got != "0Nyox8JRvYhCgXS5SOIJ8s2wss2yoFZY+9ZupJ7vjGM=" {
+		t.Fatalf("verifier is %q", got)
+	}
+}
+
+func TestSignedRequest(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	header.Set(TIMESTAMP_HEADER, "1700000000")
+	query := url.Values{TTL_PARAM: {"1h"}}
+
+	signed := SignedRequest(header, query, []byte("secret"))
+	want := []byte("\x00\x00\x00\x0a1700000000" +
+		"\x00\x00\x00\x021h" +
+		"\x00\x00\x00\x00" +
+		"\x00\x00\x00\x0atext/plain" +
+		"\x00\x00\x00\x00" +
+		"secret")
+	if !bytes.Equal(signed, want) {
+		t.Fatalf("signed %q, want %q", signed, want)
+	}
+
+	// the length prefixes keep each field from running into the next
+	header.Set("Content-Type", "text/plainsecret")
+	if bytes.Equal(SignedRequest(header, query, nil), want) {
+		t.Fatal("content type and body aren't separated")
+	}
+
+	// and anything else in the request is left out
+	header.Set("User-Agent", "unus")
+	query.Set("other", "value")
+	if !bytes.Equal(SignedRequest(header, query, nil), SignedRequest(header, url.Values{TTL_PARAM: {"1h"}}, nil)) {
+		t.Fatal("unknown query parameters are signed")
+	}
+}
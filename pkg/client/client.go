@@ -0,0 +1,277 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.leif.uk/lwg/unus/internal/wire"
+	ecies "code.leif.uk/lwg/unus/pkg/go-ecies"
+)
+
+const (
+	SECRETS_PATH = wire.SECRETS_PATH
+)
+
+// Client talks to an unus server over its HTTP API
+type Client struct {
+	base_url    *url.URL
+	http_client *http.Client
+}
+
+// CreateOptions holds the optional settings for a new secret
+type CreateOptions struct {
+	// TTL is how long the secret lives for. If zero, the server's default is
+	// used.
+	TTL time.Duration
+
+	// ServerEncrypted sends the plaintext for the server to encrypt under a
+	// passphrase of its choosing, rather than sealing it locally.
+	ServerEncrypted bool
+
+	// Recipients is how many passphrases the server gives the secret, any one
+	// of which retrieves it. Only server-encrypted secrets can have more than
+	// one. If zero, there is one.
+	Recipients int
+
+	// SigningKey signs the secret as it is uploaded, for servers which only
+	// accept secrets from trusted senders. It may be any key accepted by
+	// ecies.Sign. The signature is timestamped, so is refused if the clocks
+	// of the client and server differ by more than five minutes. If nil, the
+	// secret is not signed.
+	SigningKey crypto.Signer
+}
+
+// Receipt describes a newly created secret, holding everything the recipient
+// needs to retrieve it. Secrets with more than one recipient list every
+// passphrase in Passphrases, the first of which is also in Passphrase.
+type Receipt struct {
+	Id          int64
+	Passphrase  string
+	Passphrases []string `json:",omitempty"`
+	ExpiresAt   time.Time
+}
+
+// NewClient creates a client for the unus server at base_url, e.g.
+// https://unus.example.com. Requests are made with http_client, or with
+// http.DefaultClient if it is nil. An error is returned if base_url is not an
+// absolute http or https url.
+func NewClient(base_url string, http_client *http.Client) (*Client, error) {
+	parsed, err := url.Parse(base_url)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return nil, fmt.Errorf("base url %q must be an absolute http or https url", base_url)
+	}
+
+	if http_client == nil {
+		http_client = http.DefaultClient
+	}
+
+	return &Client{base_url: parsed, http_client: http_client}, nil
+}
+
+// Create stores body as a new secret of the given content type, returning the
+// receipt needed to retrieve it. opts may be nil. Unless opts.ServerEncrypted
+// is set, the secret is sealed locally under a passphrase the server never
+// sees. If the server refuses the secret, the error is a *StatusError.
+func (c *Client) Create(ctx context.Context, content_type string, body io.Reader, opts *CreateOptions) (*Receipt, error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+
+	if opts.Recipients > 1 && !opts.ServerEncrypted {
+		return nil, errors.New("only server-encrypted secrets can have more than one recipient")
+	}
+
+	endpoint := c.endpoint(SECRETS_PATH)
+	query := url.Values{}
+	if opts.TTL != 0 {
+		query.Set(wire.TTL_PARAM, opts.TTL.String())
+	}
+	if opts.Recipients > 1 {
+		query.Set(wire.RECIPIENTS_PARAM, strconv.Itoa(opts.Recipients))
+	}
+	endpoint.RawQuery = query.Encode()
+
+	var passphrase string
+	headers := http.Header{"Content-Type": {content_type}}
+	if !opts.ServerEncrypted {
+		secret, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+
+		var cryptogram []byte
+		cryptogram, passphrase, err = seal(content_type, secret)
+		if err != nil {
+			return nil, err
+		}
+
+		body = bytes.NewReader(cryptogram)
+		headers.Set("Content-Type", MIME_CRYPTOGRAM)
+		headers.Set(VERIFIER_HEADER, base64.StdEncoding.EncodeToString(wire.Verifier(wire.AccessToken(passphrase))))
+	}
+
+	// the signature covers the query, the headers and the body exactly as
+	// they are sent
+	if opts.SigningKey != nil {
+		uploaded, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+
+		headers.Set(TIMESTAMP_HEADER, strconv.FormatInt(time.Now().Unix(), 10))
+		signature, err := ecies.Sign(opts.SigningKey, wire.SignedRequest(headers, query, uploaded))
+		if err != nil {
+			return nil, err
+		}
+
+		body = bytes.NewReader(uploaded)
+		headers.Set(SIGNATURE_HEADER, base64.StdEncoding.EncodeToString(signature))
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header = headers
+
+	response, err := c.do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var receipt Receipt
+	if err := json.NewDecoder(response.Body).Decode(&receipt); err != nil {
+		return nil, fmt.Errorf("decoding receipt: %w", err)
+	}
+
+	// the server only knows the passphrase if it chose it
+	if !opts.ServerEncrypted {
+		receipt.Passphrase = passphrase
+	}
+
+	return &receipt, nil
+}
+
+// Retrieve fetches and burns the secret by id, returning its content type and
+// content. Secrets sealed by their sender are fetched as a cryptogram with an
+// access token derived from the passphrase, then opened locally. Failing that,
+// the passphrase is sent for the server to decrypt the secret itself. If the
+// server refuses, the error is a *StatusError and can be compared against
+// ErrIncorrectPassphrase, ErrNotFound and so on with errors.Is.
+func (c *Client) Retrieve(ctx context.Context, id int64, passphrase string) (string, []byte, error) {
+	_, cryptogram, err := c.retrieve(ctx, id, wire.AccessToken(passphrase), MIME_CRYPTOGRAM)
+	if err == nil {
+		return open(cryptogram, passphrase)
+	}
+
+	// the server tells us if the secret wasn't sealed, without counting it as
+	// a failed attempt
+	if !errors.Is(err, ErrNotAcceptable) {
+		return "", nil, err
+	}
+
+	return c.retrieve(ctx, id, passphrase, "")
+}
+
+// fetches and burns the secret by id, authenticated by credential, returning
+// the content type and body of the response
+func (c *Client) retrieve(ctx context.Context, id int64, credential string, accept string) (string, []byte, error) {
+	endpoint := c.endpoint(SECRETS_PATH + "/" + strconv.FormatInt(id, 10))
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodDelete, endpoint.String(), nil)
+	if err != nil {
+		return "", nil, err
+	}
+
+	request.SetBasicAuth("", credential)
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+
+	response, err := c.do(request)
+	if err != nil {
+		return "", nil, err
+	}
+	defer response.Body.Close()
+
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return response.Header.Get("Content-Type"), content, nil
+}
+
+// returns the absolute url for path on the server
+func (c *Client) endpoint(path string) *url.URL {
+	endpoint := *c.base_url
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + path
+	return &endpoint
+}
+
+// sends the request, turning any status other than 200 into a *StatusError
+func (c *Client) do(request *http.Request) (*http.Response, error) {
+	response, err := c.http_client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusOK {
+		return response, nil
+	}
+	defer response.Body.Close()
+
+	// the handlers reply with a short plain text message
+	message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	return nil, &StatusError{
+		StatusCode: response.StatusCode,
+		Message:    strings.TrimSpace(string(message)),
+	}
+}
+
+// StatusError is returned when the server replies with anything other than
+// 200 OK. It matches the Err* values of the same status code under errors.Is.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+var (
+	ErrBadRequest             = &StatusError{StatusCode: http.StatusBadRequest, Message: "bad request"}
+	ErrIncorrectPassphrase    = &StatusError{StatusCode: http.StatusUnauthorized, Message: "incorrect passphrase"}
+	ErrTooManyAttempts        = &StatusError{StatusCode: http.StatusForbidden, Message: "too many incorrect passphrases"}
+	ErrNotFound               = &StatusError{StatusCode: http.StatusNotFound, Message: "secret not found"}
+	ErrMethodNotAllowed       = &StatusError{StatusCode: http.StatusMethodNotAllowed, Message: "method not allowed"}
+	ErrNotAcceptable          = &StatusError{StatusCode: http.StatusNotAcceptable, Message: "secret requested in the wrong mode"}
+	ErrExpired                = &StatusError{StatusCode: http.StatusGone, Message: "secret has expired"}
+	ErrTooLarge               = &StatusError{StatusCode: http.StatusRequestEntityTooLarge, Message: "secret is too large"}
+	ErrUnsupportedContentType = &StatusError{StatusCode: http.StatusUnsupportedMediaType, Message: "unsupported content type"}
+	ErrServer                 = &StatusError{StatusCode: http.StatusInternalServerError, Message: "server error"}
+)
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unus: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is reports whether target is a *StatusError with the same status code
+func (e *StatusError) Is(target error) bool {
+	status_error, ok := target.(*StatusError)
+	return ok && status_error.StatusCode == e.StatusCode
+}
@@ -0,0 +1,292 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"code.leif.uk/lwg/unus/internal/unus"
+	"code.leif.uk/lwg/unus/internal/unus/config"
+	"code.leif.uk/lwg/unus/internal/unus/db"
+	ecies "code.leif.uk/lwg/unus/pkg/go-ecies"
+)
+
+// new_test_client starts the real unus handlers over an in-memory store,
+// allowing two attempts per secret, and returns a client for them along with
+// the store
+func new_test_client(t *testing.T, configure func(cfg *config.Config)) (*Client, db.SecretStore) {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.Storage = config.STORAGE_MEMORY
+	cfg.MaxAttempts = 2
+	if configure != nil {
+		configure(cfg)
+	}
+
+	store := db.NewMemoryStore()
+	t.Cleanup(store.Dispose)
+
+	handler, err := unus.NewHandler(cfg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := NewClient(server.URL, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, store
+}
+
+// check_secret fails the test unless the secret retrieved is as wanted
+func check_secret(t *testing.T, content_type string, secret []byte, want_content_type string, want_secret string) {
+	t.Helper()
+
+	if content_type != want_content_type || string(secret) != want_secret {
+		t.Fatalf("retrieve gave %q of type %q, want %q of type %q", secret, content_type, want_secret, want_content_type)
+	}
+}
+
+// check_status fails the test unless err is a *StatusError matching want
+func check_status(t *testing.T, err error, want *StatusError) {
+	t.Helper()
+
+	var status_error *StatusError
+	if !errors.As(err, &status_error) || !errors.Is(err, want) {
+		t.Fatalf("gave %v, want %v", err, want)
+	}
+}
+
+func TestCreateAndRetrieveSealed(t *testing.T) {
+	client, store := new_test_client(t, nil)
+	ctx := context.Background()
+
+	receipt, err := client.Create(ctx, "text/plain", strings.NewReader("MySuperSecretMessage"), &CreateOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Passphrase == "" {
+		t.Fatal("no passphrase given")
+	}
+	if until := time.Until(receipt.ExpiresAt); until <= 59*time.Minute || until > time.Hour {
+		t.Fatalf("secret expires in %s, want an hour", until)
+	}
+
+	// the server only ever holds the cryptogram
+	taken := false
+	store.TakeCryptogram(receipt.Id, 1, func(cryptogram *db.Cryptogram) error {
+		taken = true
+		if strings.Contains(string(cryptogram.Data), "MySuperSecretMessage") || strings.Contains(string(cryptogram.Data), receipt.Passphrase) {
+			t.Error("server holds the plaintext or passphrase")
+		}
+		return errors.New("only looking")
+	})
+	if !taken {
+		t.Fatal("secret was not stored")
+	}
+
+	content_type, secret, err := client.Retrieve(ctx, receipt.Id, receipt.Passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_secret(t, content_type, secret, "text/plain", "MySuperSecretMessage")
+
+	_, _, err = client.Retrieve(ctx, receipt.Id, receipt.Passphrase)
+	check_status(t, err, ErrNotFound)
+}
+
+func TestCreateAndRetrieveServerEncrypted(t *testing.T) {
+	// the server makes passphrases from the system dictionary
+	if _, err := os.Stat("/usr/share/dict/words"); err != nil {
+		t.Skip("no system dictionary for the server to make passphrases from")
+	}
+
+	client, _ := new_test_client(t, nil)
+	ctx := context.Background()
+
+	receipt, err := client.Create(ctx, "text/plain", strings.NewReader("MySuperSecretMessage"), &CreateOptions{ServerEncrypted: true, Recipients: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipt.Passphrases) != 2 {
+		t.Fatalf("create gave %d passphrases, want 2", len(receipt.Passphrases))
+	}
+
+	content_type, secret, err := client.Retrieve(ctx, receipt.Id, receipt.Passphrases[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_secret(t, content_type, secret, "text/plain", "MySuperSecretMessage")
+}
+
+func TestRetrieveFallsBackToServerEncrypted(t *testing.T) {
+	client, store := new_test_client(t, nil)
+
+	// as the server stored them before cryptograms were bound to their id
+	passphrase := "correct-horse-battery-staple"
+	plaintext, err := json.Marshal(payload{ContentType: "text/plain", Secret: []byte("MySuperSecretMessage")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := ecies.PassphraseParams{Time: 1, Memory: 1024, Threads: 1}
+	cryptogram, err := ecies.EncryptWithPassphrase([]byte(passphrase), plaintext, &params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.InsertCryptogram(&db.Cryptogram{Id: 1, Data: cryptogram, ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first, sealed, request is refused without being counted against
+	// the two attempts allowed
+	content_type, secret, err := client.Retrieve(context.Background(), 1, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_secret(t, content_type, secret, "text/plain", "MySuperSecretMessage")
+}
+
+func TestCreateSigned(t *testing.T) {
+	_, signing_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, untrusted_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(signing_key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted_senders := filepath.Join(t.TempDir(), "trusted.pem")
+	if err := os.WriteFile(trusted_senders, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := new_test_client(t, func(cfg *config.Config) {
+		cfg.TrustedSenders = trusted_senders
+	})
+	ctx := context.Background()
+
+	// the ttl and verifier are signed along with the body
+	receipt, err := client.Create(ctx, "text/plain", strings.NewReader("MySuperSecretMessage"), &CreateOptions{TTL: time.Hour, SigningKey: signing_key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content_type, secret, err := client.Retrieve(ctx, receipt.Id, receipt.Passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_secret(t, content_type, secret, "text/plain", "MySuperSecretMessage")
+
+	_, err = client.Create(ctx, "text/plain", strings.NewReader("MySuperSecretMessage"), nil)
+	check_status(t, err, &StatusError{StatusCode: http.StatusUnauthorized})
+
+	_, err = client.Create(ctx, "text/plain", strings.NewReader("MySuperSecretMessage"), &CreateOptions{SigningKey: untrusted_key})
+	check_status(t, err, &StatusError{StatusCode: http.StatusForbidden})
+}
+
+func TestStatusErrors(t *testing.T) {
+	client, store := new_test_client(t, nil)
+	ctx := context.Background()
+
+	t.Run("not found", func(t *testing.T) {
+		_, _, err := client.Retrieve(ctx, 1, "passphrase")
+		check_status(t, err, ErrNotFound)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		_, err := store.InsertCryptogram(&db.Cryptogram{Id: 2, Data: []byte("cryptogram"), ExpiresAt: time.Now().Add(-time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = client.Retrieve(ctx, 2, "passphrase")
+		check_status(t, err, ErrExpired)
+	})
+
+	t.Run("incorrect passphrase, then too many attempts", func(t *testing.T) {
+		receipt, err := client.Create(ctx, "text/plain", strings.NewReader("secret"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = client.Retrieve(ctx, receipt.Id, "wrong-passphrase")
+		check_status(t, err, ErrIncorrectPassphrase)
+
+		_, _, err = client.Retrieve(ctx, receipt.Id, "wrong-passphrase")
+		check_status(t, err, ErrTooManyAttempts)
+
+		_, _, err = client.Retrieve(ctx, receipt.Id, receipt.Passphrase)
+		check_status(t, err, ErrNotFound)
+	})
+
+	t.Run("not acceptable", func(t *testing.T) {
+		receipt, err := client.Create(ctx, "text/plain", strings.NewReader("secret"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// asking the server to decrypt a secret it can't
+		_, _, err = client.retrieve(ctx, receipt.Id, receipt.Passphrase, "")
+		check_status(t, err, ErrNotAcceptable)
+
+		// which isn't counted against it
+		content_type, secret, err := client.Retrieve(ctx, receipt.Id, receipt.Passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check_secret(t, content_type, secret, "text/plain", "secret")
+	})
+
+	t.Run("unsupported content type", func(t *testing.T) {
+		_, err := client.Create(ctx, "application/octet-stream", strings.NewReader("secret"), &CreateOptions{ServerEncrypted: true})
+		check_status(t, err, ErrUnsupportedContentType)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		_, err := client.Create(ctx, "text/plain", strings.NewReader(strings.Repeat("a", int(config.Default().MaxSecretSize)+1)), &CreateOptions{ServerEncrypted: true})
+		check_status(t, err, ErrTooLarge)
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		_, err := client.Create(ctx, "text/plain", strings.NewReader("secret"), &CreateOptions{TTL: 10000 * time.Hour})
+		check_status(t, err, ErrBadRequest)
+	})
+}
+
+func TestNewClient(t *testing.T) {
+	for _, base_url := range []string{"", "unus.example.com", "ftp://unus.example.com", "https://"} {
+		if _, err := NewClient(base_url, nil); err == nil {
+			t.Errorf("NewClient accepted %q", base_url)
+		}
+	}
+
+	client, err := NewClient("https://unus.example.com/prefix/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := client.endpoint(SECRETS_PATH).String(); got != "https://unus.example.com/prefix/api/v1/secrets" {
+		t.Fatalf("endpoint gave %q", got)
+	}
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"code.leif.uk/lwg/unus/internal/wire"
+	ecies "code.leif.uk/lwg/unus/pkg/go-ecies"
+)
+
+const (
+	// secrets sealed by the client are uploaded and returned as this
+	MIME_CRYPTOGRAM = wire.MIME_CRYPTOGRAM
+
+	// carries the base64 sha-256 of the access token for a sealed secret
+	VERIFIER_HEADER = wire.VERIFIER_HEADER
+
+	// carries the base64 signature of a secret from a trusted sender
+	SIGNATURE_HEADER = wire.SIGNATURE_HEADER
+
+	// carries the time a secret was signed, in seconds since the unix epoch
+	TIMESTAMP_HEADER = wire.TIMESTAMP_HEADER
+
+	// domain separates the access token from the key made from a passphrase
+	ACCESS_TOKEN_INFO = wire.ACCESS_TOKEN_INFO
+
+	passphrase_entropy_len = 32
+)
+
+// payload is the plaintext of a sealed secret, matching the shape the server
+// uses for the secrets it encrypts itself
+type payload struct {
+	ContentType string
+	Secret      []byte
+}
+
+// generates a passphrase with 256 bits of entropy
+func generate_passphrase() (string, error) {
+	entropy := make([]byte, passphrase_entropy_len)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(entropy), nil
+}
+
+// seals the secret under a new passphrase, returning the cryptogram and the
+// passphrase
+func seal(content_type string, secret []byte) ([]byte, string, error) {
+	plaintext, err := json.Marshal(payload{ContentType: content_type, Secret: secret})
+	if err != nil {
+		return nil, "", err
+	}
+
+	passphrase, err := generate_passphrase()
+	if err != nil {
+		return nil, "", err
+	}
+
+	cryptogram, err := ecies.EncryptWithPassphrase([]byte(passphrase), plaintext, &ecies.DefaultPassphraseParams)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return cryptogram, passphrase, nil
+}
+
+// opens a sealed secret with its passphrase, returning its content type and
+// content
+func open(cryptogram []byte, passphrase string) (string, []byte, error) {
+	plaintext, err := ecies.DecryptWithPassphraseCompat([]byte(passphrase), cryptogram, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("opening sealed secret: %w", err)
+	}
+
+	var opened payload
+	if err := json.Unmarshal(plaintext, &opened); err != nil {
+		return "", nil, fmt.Errorf("decoding sealed secret: %w", err)
+	}
+
+	return opened.ContentType, opened.Secret, nil
+}
@@ -3,10 +3,10 @@ package goecies
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/hmac"
-	"crypto/rand"
-	"crypto/sha256"
+	"crypto/subtle"
 	"errors"
+	"fmt"
+	"io"
 )
 
 const (
@@ -15,11 +15,15 @@ const (
 	salt_len             = 16
 )
 
-// readEntropy generates n bytes of entropy
-func read_entropy(n int) []byte {
+// read_entropy reads n bytes of entropy from source. An error is returned if
+// the source fails.
+func read_entropy(source io.Reader, n int) ([]byte, error) {
 	entropy := make([]byte, n)
-	rand.Read(entropy)
-	return entropy
+	if _, err := io.ReadFull(source, entropy); err != nil {
+		err := fmt.Errorf("entropy source failed: %w", err)
+		return nil, err
+	}
+	return entropy, nil
 }
 
 // padding_pkcs7_add appends up-to a 16-byte block of padding to a message,
@@ -38,20 +42,39 @@ func padding_pkcs7_add(message []byte) []byte {
 }
 
 // padding_pkcs7_rem removes n bytes of padding from message, determined by the
-// final byte of message. Returns the original message without padding.
-func padding_pkcs7_rem(message []byte) []byte {
+// final byte of message. Returns the original message without padding. Every
+// byte of the final block is checked in constant time, so that how much of
+// the padding is wrong can't be learned from timing. A *FormatError is
+// returned if the message isn't a whole number of blocks, or if the padding
+// is invalid.
+func padding_pkcs7_rem(message []byte) ([]byte, error) {
 	message_length := len(message)
-	pad_byte := message[message_length-1]
+	if message_length == 0 || message_length%aes.BlockSize != 0 {
+		return nil, &FormatError{Field: "body", Err: ErrInvalidLength}
+	}
+
+	block := message[message_length-aes.BlockSize:]
+	pad_byte := int(block[aes.BlockSize-1])
+
+	valid := subtle.ConstantTimeLessOrEq(1, pad_byte) & subtle.ConstantTimeLessOrEq(pad_byte, aes.BlockSize)
+	for i, b := range block {
+		in_padding := subtle.ConstantTimeLessOrEq(aes.BlockSize-i, pad_byte)
+		valid &= (1 ^ in_padding) | subtle.ConstantTimeByteEq(b, byte(pad_byte))
+	}
+
+	if valid != 1 {
+		return nil, &FormatError{Field: "padding", Err: ErrMalformed}
+	}
 
-	original_length := message_length - int(pad_byte)
-	return message[:original_length]
+	original_length := message_length - pad_byte
+	return message[:original_length], nil
 }
 
-// aes_encrypt performs aes encryption of message using key
-func aes_encrypt(key []byte, message []byte) ([]byte, []byte, error) {
+// aes_encrypt performs aes encryption of message using key and iv
+func aes_encrypt(key, iv, message []byte) ([]byte, error) {
 	cipher_block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	padded_message := padding_pkcs7_add(message)
@@ -59,19 +82,24 @@ func aes_encrypt(key []byte, message []byte) ([]byte, []byte, error) {
 	encrypted_length := len(padded_message)
 	encrypted_message := make([]byte, encrypted_length)
 
-	iv := make([]byte, aes.BlockSize)
-	if copy(iv, read_entropy(aes.BlockSize)) != aes.BlockSize {
-		return nil, nil, errors.New("not enough entropy")
-	}
-
 	cbc := cipher.NewCBCEncrypter(cipher_block, iv)
 	cbc.CryptBlocks(encrypted_message, padded_message)
 
-	return encrypted_message, iv, nil
+	return encrypted_message, nil
 }
 
-// aes_decrypt performs aes decryption of message using key
+// aes_decrypt performs aes decryption of message using key. A *FormatError is
+// returned if the iv isn't one block, if the message isn't a whole number of
+// blocks, or if its padding is invalid.
 func aes_decrypt(key, iv, message []byte) ([]byte, error) {
+	if len(iv) != aes.BlockSize {
+		return nil, &FormatError{Field: "nonce", Err: ErrInvalidLength}
+	}
+
+	if len(message) == 0 || len(message)%aes.BlockSize != 0 {
+		return nil, &FormatError{Field: "body", Err: ErrInvalidLength}
+	}
+
 	cipher_block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -81,162 +109,210 @@ func aes_decrypt(key, iv, message []byte) ([]byte, error) {
 	cbc := cipher.NewCBCDecrypter(cipher_block, iv)
 	cbc.CryptBlocks(padded_message, message)
 
-	original_message := padding_pkcs7_rem(padded_message)
-
-	return original_message, nil
-}
-
-// read_out_components splits an ECIES-derived message into its constituent
-// parts
-func read_out_components(message []byte) ([]byte, []byte, []byte, []byte, []byte, []byte) {
-	offset := 0
-	length := compressed_ecpub_len
-	compressed_public_key := message[offset:length]
-
-	offset = length
-	length += hmac_sha256_len
-	tag := message[offset:length]
-
-	offset = length
-	length += salt_len
-	aes_salt := message[offset:length]
-
-	offset = length
-	length += salt_len
-	hmac_salt := message[offset:length]
-
-	offset = length
-	length += aes.BlockSize
-	iv := message[offset:length]
-
-	offset = length
-	encrypted_message := message[offset:]
-
-	return compressed_public_key, tag, aes_salt, hmac_salt, iv, encrypted_message
+	return padding_pkcs7_rem(padded_message)
 }
 
 // EncryptEphemeral performs ECIES encryption of the message using an ephemeral
-// key pair for the sender
-func EncryptEphemeral(receiver_key *_ECPublicKey, message []byte) ([]byte, error) {
-	ephemeral_sender_key, err := NewECPrivateKey()
+// key pair for the sender, on the curve of the receivers key. opts may be nil.
+func EncryptEphemeral(receiver_key *PublicKey, message []byte, opts *Options) ([]byte, error) {
+	ephemeral_sender_key, err := NewECPrivateKey(&Options{Curve: receiver_key.Curve(), Rand: opts.rand()})
 	if err != nil {
 		return nil, err
 	}
 
-	return Encrypt(ephemeral_sender_key, receiver_key, message)
+	return Encrypt(ephemeral_sender_key, receiver_key, message, opts)
 }
 
 // Encrypt performs ECIES encryption of the message using the senders EC
-// private key and the receivers EC public key. If the message length is not a
-// multiple of 16, it will be padded with bytes according to PKCS#7. If either
-// of the keys given are invalid, an error is returned. If EC public key
+// private key and the receivers EC public key, with the algorithms of
+// DefaultSuite unless opts, which may be nil, say otherwise. The cryptogram is
+// wrapped in a versioned envelope recording the suite, so that Decrypt can
+// open it without being told how it was made. If the options name an unknown
+// algorithm, a *FormatError is returned. AES-256-CBC with HMAC-SHA-256 is only
+// kept to decrypt existing cryptograms, so choosing it returns an error. If
+// either of the keys given are invalid, an error is returned. If EC public key
 // compression fails, an error is returned. If the encryption fails, an error
 // is returned.
-func Encrypt(sender_key *_ECPrivateKey, receiver_key *_ECPublicKey, message []byte) ([]byte, error) {
-	// perform ECDHKA
-	shared_secret, err := sender_key.Agree(receiver_key)
+func Encrypt(sender_key *PrivateKey, receiver_key *PublicKey, message []byte, opts *Options) ([]byte, error) {
+	return EncryptWithAD(sender_key, receiver_key, message, nil, opts)
+}
+
+// EncryptWithAD performs ECIES encryption of the message as Encrypt does,
+// additionally authenticating the associated data, ad, which is not included
+// in the cryptogram. The same associated data must be given to DecryptWithAD
+// to decrypt it, binding the cryptogram to the context it was made for.
+func EncryptWithAD(sender_key *PrivateKey, receiver_key *PublicKey, message []byte, ad []byte, opts *Options) ([]byte, error) {
+	e, key, err := new_envelope(sender_key, receiver_key, opts, envelope_magic)
+	if err != nil {
+		return nil, err
+	}
+
+	// encrypt, authenticating the header and associated data along with the
+	// message
+	header := e.marshal_header()
+	body, err := e.suite.Cipher.seal(key, e.nonce, authenticated_data(header, ad), message)
 	if err != nil {
 		return nil, err
 	}
 
-	// initialise KDF
-	kdf := NewKDF(KDFParams{
-		key:        shared_secret,
-		hash:       sha256.New,
-		iterations: 310000,
-		length:     32,
-	})
+	return append(header, body...), nil
+}
+
+// new_envelope makes the envelope for a cryptogram, or a stream, starting with
+// the given magic, from the sender to the receiver with the suite chosen by
+// opts, which may be nil. returns the envelope and the symmetric key agreed
+// for it.
+func new_envelope(sender_key *PrivateKey, receiver_key *PublicKey, opts *Options, magic []byte) (*envelope, []byte, error) {
+	suite := opts.suite()
+	suite.Curve = receiver_key.Curve()
+	if err := suite.validate_encrypt(opts); err != nil {
+		return nil, nil, err
+	}
+
+	if opts != nil && opts.Curve != 0 && opts.Curve != suite.Curve {
+		err := errors.New("keys are not on the curve chosen")
+		return nil, nil, err
+	}
+
+	shared_secret, encapsulation, err := sender_key.encapsulate(receiver_key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	e := &envelope{
+		version:    envelope_version,
+		suite:      suite,
+		public_key: encapsulation,
+		magic:      magic,
+	}
+
+	// the salt is read before the nonce
+	if e.salt, err = read_entropy(opts.rand(), suite.salt_len()); err != nil {
+		return nil, nil, err
+	}
+	if e.nonce, err = read_entropy(opts.rand(), e.nonce_len()); err != nil {
+		return nil, nil, err
+	}
 
 	// derive symmetric key
-	aes_salt := read_entropy(16)
-	aes_key := kdf.DeriveKey(aes_salt)
+	return e, suite.derive_key(shared_secret, e.salt), nil
+}
+
+// key agrees the symmetric key for the envelope using the receivers key and
+// the senders public key, as recorded in the envelope. a receivers key on
+// another curve is as wrong as any other, so ErrAuthFailed is returned.
+func (e *envelope) key(receiver_key *PrivateKey) ([]byte, error) {
+	if receiver_key.Curve() != e.suite.Curve {
+		return nil, ErrAuthFailed
+	}
 
-	// encrypt
-	encrypted_message, iv, err := aes_encrypt(aes_key, message)
+	shared_secret, err := receiver_key.decapsulate(e.public_key, e.version)
 	if err != nil {
 		return nil, err
 	}
 
-	// derive hmac key
-	hmac_salt := read_entropy(16)
-	hmac_key := kdf.DeriveKey(hmac_salt)
+	// derive symmetric key
+	return e.suite.derive_key(shared_secret, e.salt), nil
+}
 
-	// calculate tag
-	hmac_alg := hmac.New(sha256.New, hmac_key)
-	hmac_alg.Write(encrypted_message)
-	tag := hmac_alg.Sum(nil)
+// encapsulate returns the secret shared by ecpriv, the sender, with the
+// receiver, and what is recorded in the senders public key field of the
+// envelope for the receiver to recover it with. That is the senders
+// compressed public key, except on the hybrid.
+func (ecpriv *PrivateKey) encapsulate(receiver_key *PublicKey) ([]byte, []byte, error) {
+	if receiver_key.Curve() == CURVE_X25519_MLKEM768 {
+		if ecpriv.Curve() != CURVE_X25519_MLKEM768 {
+			err := errors.New("unable to validate keys")
+			return nil, nil, err
+		}
+		return hybrid_encapsulate(ecpriv, receiver_key)
+	}
 
-	// compress the key used to send this message
-	compressed_public_key, err := sender_key.Compress()
+	// perform ECDHKA
+	shared_secret, err := ecpriv.agree_envelope(receiver_key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// encode as kP | tag | aes_salt | hmac_salt | message
-	cryptogram := make([]byte, 0)
-	cryptogram = append(cryptogram, compressed_public_key...)
-	cryptogram = append(cryptogram, tag...)
-	cryptogram = append(cryptogram, aes_salt...)
-	cryptogram = append(cryptogram, hmac_salt...)
-	cryptogram = append(cryptogram, iv...)
-	cryptogram = append(cryptogram, encrypted_message...)
+	// compress the key used to send this message
+	compressed_public_key, err := ecpriv.PublicKey().Compress()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return cryptogram, nil
+	return shared_secret, compressed_public_key, nil
 }
 
-// Decrypt decrypts the ECIES-derived message, using the receive_key in the
-// ECDH key agreement step. The ECIES-derived message contains the senders EC
-// public key, the HMAC tag, a salt each for deriving the AES and HMAC keys and
-// the IV used in the AES encryption step. If the message is not at least long
-// enough to contain these data, an error is returned. Additionally, if either
-// of the keys given are invalid, an error is returned. Lastly, if the message
-// has been tampered with, an error is returned.
-func Decrypt(receiver_key *_ECPrivateKey, message []byte) ([]byte, error) {
-	// slice up the cryptogram into the necessary chunks
-	compressed_public_key, tag, aes_salt, hmac_salt, iv, encrypted_message := read_out_components(message)
+// decapsulate recovers the secret shared with ecpriv, the receiver, from the
+// senders public key field of an envelope of the given version. ecpriv is on
+// the right curve, so only the field can be at fault, and a *FormatError is
+// returned.
+func (ecpriv *PrivateKey) decapsulate(encapsulation []byte, version uint8) ([]byte, error) {
+	if ecpriv.Curve() == CURVE_X25519_MLKEM768 {
+		return hybrid_decapsulate(ecpriv, encapsulation)
+	}
 
 	// recreate the sender ephemeral public key
-	sender_public_key, err := NewECPublicKeyFromCompressed(receiver_key.Curve, compressed_public_key)
+	sender_public_key, err := unmarshal_public_key(ecpriv.Curve(), encapsulation)
 	if err != nil {
-		return nil, err
+		return nil, &FormatError{Field: "public key", Err: ErrMalformed}
 	}
 
-	// perform ECDHKA
-	shared_secret, err := receiver_key.Agree(sender_public_key)
+	// perform ECDHKA. e.g. a low order X25519 point fails.
+	agree := ecpriv.agree_envelope
+	if version == envelope_version_1 {
+		agree = ecpriv.Agree
+	}
+	shared_secret, err := agree(sender_public_key)
 	if err != nil {
-		return nil, err
+		return nil, &FormatError{Field: "public key", Err: ErrMalformed}
 	}
+	return shared_secret, nil
+}
 
-	// initialise KDF
-	kdf := NewKDF(KDFParams{
-		key:        shared_secret,
-		hash:       sha256.New,
-		iterations: 310000,
-		length:     32,
-	})
+// Decrypt decrypts the ECIES-derived message, using the receive_key in the
+// ECDH key agreement step. Messages in a versioned envelope are opened with
+// the suite it records, and bare version 0 messages from before the envelope
+// existed are still accepted. Messages made by EncryptMulti are opened if the
+// receive_key is one of their receivers. If the message can't be parsed, a
+// *FormatError is returned. Additionally, if either of the keys given are
+// invalid, an error is returned. Lastly, if the message has been tampered
+// with, an error is returned.
+func Decrypt(receiver_key *PrivateKey, message []byte) ([]byte, error) {
+	return DecryptWithAD(receiver_key, message, nil)
+}
+
+// DecryptWithAD decrypts a message made by EncryptWithAD, as Decrypt does.
+// The associated data, ad, must be the same as was given to EncryptWithAD,
+// else authentication fails and an error is returned. Version 0 messages
+// can't carry associated data, so are only accepted if ad is empty.
+func DecryptWithAD(receiver_key *PrivateKey, message []byte, ad []byte) ([]byte, error) {
+	// otherwise they would be mistaken for version 0
+	if is_signed(message) || is_stream(message) {
+		return nil, &FormatError{Field: "magic", Err: ErrUnsupportedVersion}
+	}
 
-	// derive hmac key
-	hmac_key := kdf.DeriveKey(hmac_salt)
+	if is_multi(message) {
+		return decrypt_multi(receiver_key, message, ad)
+	}
 
-	// calculate tag
-	hmac_alg := hmac.New(sha256.New, hmac_key)
-	hmac_alg.Write(encrypted_message)
-	expected_tag := hmac_alg.Sum(nil)
+	if !is_envelope(message) {
+		if len(ad) > 0 {
+			return nil, &FormatError{Field: "version", Err: ErrUnsupportedVersion}
+		}
+		return decrypt_v0(receiver_key, message)
+	}
 
-	// verify the tags match
-	if !hmac.Equal(expected_tag, tag) {
-		err := errors.New("invalid key or cryptogram")
+	e, err := parse_envelope(message, envelope_magic)
+	if err != nil {
 		return nil, err
 	}
 
-	// derive symmetric key
-	aes_key := kdf.DeriveKey(aes_salt)
-
-	// decrypt
-	original_message, err := aes_decrypt(aes_key, iv, encrypted_message)
+	key, err := e.key(receiver_key)
 	if err != nil {
 		return nil, err
 	}
 
-	return original_message, nil
+	// verify and decrypt
+	return e.suite.Cipher.open(key, e.nonce, authenticated_data(e.header, ad), e.body)
 }
@@ -1,101 +1,183 @@
 package goecies
 
 import (
-	"crypto/elliptic"
-	"crypto/rand"
+	"crypto/ecdh"
+	"crypto/mlkem"
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 )
 
-// ECPrivateKey encapsulates an elliptic curve private key. It is made up of
-// its private bytes d and the nested ECPublicKey. The nested public key
-// maintains a record of the curve, as well as the x and y coordinates derived
-// from it.
-type _ECPrivateKey struct {
-	*_ECPublicKey
-	d *big.Int
+// PrivateKey encapsulates an elliptic curve private key. It is made up of the
+// private scalar, held by crypto/ecdh, and the associated PublicKey. Keys on
+// the X25519MLKEM768 hybrid hold an X25519 scalar and an ML-KEM-768
+// decapsulation key.
+type PrivateKey struct {
+	public *PublicKey
+	key    *ecdh.PrivateKey
+	mlkem  *mlkem.DecapsulationKey768
 }
 
-// NewECPrivateKey generates an EC private key on the NIST P-256 curve using
-// an appropriate source of entropy. An error is returned if a failure of the
-// entropy source occurs.
-func NewECPrivateKey() (*_ECPrivateKey, error) {
-	curve := elliptic.P256()
+// NewECPrivateKey generates an EC private key on the curve chosen by opts, or
+// the NIST P-256 curve if opts is nil, reading the private bytes from the
+// source of randomness chosen by opts. An error is returned if the curve is
+// unknown, or if a failure of the entropy source occurs.
+func NewECPrivateKey(opts *Options) (*PrivateKey, error) {
+	curve_id := opts.curve()
+	if err := curve_id.validate(); err != nil {
+		return nil, err
+	}
 
-	priv, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	k, err := random_scalar(opts.rand(), curve_id)
 	if err != nil {
-		err := fmt.Errorf("key generation failed: %s", err.Error())
+		err := fmt.Errorf("key generation failed: %w", err)
 		return nil, err
 	}
 
-	return &_ECPrivateKey{
-		_ECPublicKey: &_ECPublicKey{
-			Curve: curve,
-			x:     x,
-			y:     y,
-		},
-		d: big.NewInt(0).SetBytes(priv),
-	}, nil
+	return NewECPrivateKeyFromBytes(k, &Options{Curve: curve_id})
+}
+
+// random_scalar reads the private bytes of a key on the curve from source.
+// X25519 takes any 32 bytes, and the hybrid any 96. Otherwise, any bits above
+// the order of the curve are masked off and the bytes are read again until
+// they fall in [1, n-1], which takes two attempts at worst on average.
+func random_scalar(source io.Reader, curve_id CurveID) ([]byte, error) {
+	if curve_id == CURVE_X25519 || curve_id == CURVE_X25519_MLKEM768 {
+		return read_entropy(source, curve_id.scalar_len())
+	}
+
+	excess_bits := 8*curve_id.scalar_len() - curve_id.curve().Params().N.BitLen()
+
+	for {
+		k, err := read_entropy(source, curve_id.scalar_len())
+		if err != nil {
+			return nil, err
+		}
+
+		// crypto/ecdh rejects scalars outside [1, n-1] in constant time
+		k[0] &= 0xff >> excess_bits
+		if _, err := curve_id.ecdh().NewPrivateKey(k); err == nil {
+			return k, nil
+		}
+	}
 }
 
-// NewECPrivateKeyFromBytes generates an EC private key on the NIST P-256 curve
-// using the given bytes k as the private component. An error is returned if
-// the private bytes k are not at least 256-bits in length. The EC public key
-// coordinates arising from this operation is guaranteed to be on the
-// associated curve.
-func NewECPrivateKeyFromBytes(k []byte) (*_ECPrivateKey, error) {
-	if len(k) < 32 {
-		err := errors.New("bytes d must be at least 256-bits")
+// NewECPrivateKeyFromBytes generates an EC private key on the curve chosen by
+// opts, or the NIST P-256 curve if opts is nil, using the given bytes k as the
+// private component. Bytes longer than the order of the curve are reduced
+// modulo it, as earlier versions did, so that passphrases used directly as
+// keys still open their secrets. An error is returned if the curve is
+// unknown, if the private bytes k are shorter than the order of the curve or
+// if they are zero once reduced. X25519 keys must be exactly 256-bits, and
+// X25519MLKEM768 keys exactly 768-bits: the X25519 scalar, then the ML-KEM-768
+// seed. The EC public key arising from this operation is guaranteed to be on
+// the associated curve.
+func NewECPrivateKeyFromBytes(k []byte, opts *Options) (*PrivateKey, error) {
+	curve_id := opts.curve()
+	if err := curve_id.validate(); err != nil {
 		return nil, err
 	}
 
-	curve := elliptic.P256()
-	x, y := curve.ScalarBaseMult(k)
+	if curve_id == CURVE_X25519_MLKEM768 {
+		return new_hybrid_private_key(k)
+	}
+
+	if curve_id != CURVE_X25519 {
+		size := curve_id.scalar_len()
+		if len(k) < size {
+			err := fmt.Errorf("bytes d must be at least %d-bits", 8*size)
+			return nil, err
+		}
+
+		if len(k) > size {
+			d := new(big.Int).SetBytes(k)
+			k = d.Mod(d, curve_id.curve().Params().N).FillBytes(make([]byte, size))
+		}
+	}
+
+	key, err := curve_id.ecdh().NewPrivateKey(k)
+	if err != nil {
+		return nil, err
+	}
 
-	return &_ECPrivateKey{
-		_ECPublicKey: &_ECPublicKey{
-			Curve: curve,
-			x:     x,
-			y:     y,
-		},
-		d: big.NewInt(0).SetBytes(k),
+	return &PrivateKey{
+		public: &PublicKey{curve: curve_id, key: key.PublicKey()},
+		key:    key,
 	}, nil
 }
 
 // Agree performs a Diffie-Hellman key agreement using the given EC private and
 // public keys. The agreed key is established as the scalar multiple of the
 // private key bytes by the public key coordinates on the associated curve. The
-// resulting bytes are appended y to x and subject to one round of SHA-256
-// before they are returned. The returned bytes are unsuitable for use as a
-// symmetric encryption key as-is, and should instead be used as the input to a
-// more robust key derivation function. An error is returned if the curves do
-// not match, or if either key does not sit on the curve. The specific nature
-// of the error is not exposed in order to protect from privileged information
-// leakage.
-func (ecpriv *_ECPrivateKey) Agree(ecpub *_ECPublicKey) ([]byte, error) {
-	if ecpriv.Curve != ecpub.Curve ||
-		!ecpub.Curve.IsOnCurve(ecpub.x, ecpub.y) ||
-		!ecpriv.Curve.IsOnCurve(ecpriv.x, ecpriv.y) {
+// resulting bytes are appended y to x, each without leading zeroes as earlier
+// versions made them, or for X25519 are the u-coordinate alone, and subject to
+// one round of SHA-256 before they are returned. The returned bytes are
+// unsuitable for use as a symmetric encryption key as-is, and should instead
+// be used as the input to a more robust key derivation function. An error is
+// returned if the curves do not match, or if either key does not sit on the
+// curve. The specific nature of the error is not exposed in order to protect
+// from privileged information leakage. X25519MLKEM768 keys can't agree a
+// secret, as ML-KEM only encapsulates one, so an error is returned for them.
+// Recovering y on the NIST curves is not constant time, so cryptograms no
+// longer use Agree.
+func (ecpriv *PrivateKey) Agree(ecpub *PublicKey) ([]byte, error) {
+	if ecpriv.Curve() == CURVE_X25519 {
+		return ecpriv.agree_envelope(ecpub)
+	}
+	return ecpriv.agree_v0(ecpub)
+}
+
+// agree_envelope performs the key agreement of envelope cryptograms since
+// version 2, returning SHA-256 of the x coordinate of the agreed point,
+// fixed-width as crypto/ecdh gives it, or for X25519 the u-coordinate
+func (ecpriv *PrivateKey) agree_envelope(ecpub *PublicKey) ([]byte, error) {
+	x, err := ecpriv.agree(ecpub)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(x)
+	return hash[:], nil
+}
+
+// agree returns the x coordinate of the point agreed with ecpub, as
+// agree_envelope does, before it is hashed
+func (ecpriv *PrivateKey) agree(ecpub *PublicKey) ([]byte, error) {
+	if curve := ecpriv.Curve(); curve == 0 || curve != ecpub.Curve() {
 		err := errors.New("unable to validate keys")
 		return nil, err
 	}
 
-	x, y := ecpriv.Curve.ScalarMult(ecpub.x, ecpub.y, ecpriv.d.Bytes())
+	if ecpriv.Curve() == CURVE_X25519_MLKEM768 {
+		return nil, errHybridAgree
+	}
 
-	raw := append(x.Bytes(), y.Bytes()...)
-	hash := sha256.Sum256(raw)
+	x, err := ecpriv.key.ECDH(ecpub.key)
+	if err != nil {
+		err := errors.New("unable to validate keys")
+		return nil, err
+	}
+	return x, nil
+}
 
-	return hash[:], nil
+// Bytes returns the raw private key bytes from ecpriv, padded with leading
+// zeroes to the length of the order of the curve. X25519MLKEM768 keys are the
+// X25519 scalar followed by the ML-KEM-768 seed.
+func (ecpriv *PrivateKey) Bytes() []byte {
+	if ecpriv.mlkem != nil {
+		return append(ecpriv.key.Bytes(), ecpriv.mlkem.Bytes()...)
+	}
+	return ecpriv.key.Bytes()
 }
 
-// Bytes returns the raw private key bytes from ecpriv
-func (ecpriv *_ECPrivateKey) Bytes() []byte {
-	return ecpriv.d.Bytes()
+// Curve returns the id of the curve the key sits on
+func (ecpriv *PrivateKey) Curve() CurveID {
+	return ecpriv.public.Curve()
 }
 
 // PublicKey returns the EC public key associated with this private key
-func (ecpriv *_ECPrivateKey) PublicKey() *_ECPublicKey {
-	return ecpriv._ECPublicKey
+func (ecpriv *PrivateKey) PublicKey() *PublicKey {
+	return ecpriv.public
 }
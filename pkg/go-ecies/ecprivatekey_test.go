@@ -0,0 +1,213 @@
+package goecies
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+)
+
+// reference_agree is agree_envelope made with crypto/elliptic, hashing the x
+// coordinate of the shared point padded to the width of the field
+func reference_agree(ecpriv *PrivateKey, ecpub *PublicKey) []byte {
+	curve := ecpriv.Curve().curve()
+	x, y := ecpub.coordinates()
+	x, _ = curve.ScalarMult(x, y, ecpriv.Bytes())
+
+	hash := sha256.Sum256(x.FillBytes(make([]byte, (curve.Params().BitSize+7)/8)))
+	return hash[:]
+}
+
+// leading_zero_key returns a key on the curve whose scalar starts with a zero
+// byte, which math/big would have dropped
+func leading_zero_key(t *testing.T, curve_id CurveID, source *drbg) *PrivateKey {
+	for {
+		k, err := random_scalar(source, curve_id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		k[0] = 0
+		if curve_id == CURVE_P521 {
+			k[1] = 0
+		}
+
+		key, err := NewECPrivateKeyFromBytes(k, &Options{Curve: curve_id})
+		if err != nil {
+			continue
+		}
+
+		if !bytes.Equal(key.Bytes(), k) {
+			t.Fatalf("Bytes gave %x, want %x", key.Bytes(), k)
+		}
+		return key
+	}
+}
+
+func TestLeadingZeroKeys(t *testing.T) {
+	source := &drbg{seed: []byte("leading zero keys")}
+
+	for _, curve_id := range []CurveID{CURVE_P256, CURVE_P384, CURVE_P521} {
+		t.Run(curve_id.String(), func(t *testing.T) {
+			key := leading_zero_key(t, curve_id, source)
+			if len(key.Bytes()) != curve_id.scalar_len() {
+				t.Fatalf("scalar is %d bytes, want %d", len(key.Bytes()), curve_id.scalar_len())
+			}
+
+			der, err := key.MarshalPKCS8()
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := ParsePKCS8PrivateKey(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(parsed.Bytes(), key.Bytes()) {
+				t.Fatalf("PKCS #8 gave %x, want %x", parsed.Bytes(), key.Bytes())
+			}
+
+			jwk, err := key.MarshalJWK()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ParsePrivateKeyJWK(jwk); err != nil {
+				t.Fatal(err)
+			}
+
+			other_key, err := NewECPrivateKey(&Options{Curve: curve_id, Rand: source})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, pair := range [][2]*PrivateKey{{key, other_key}, {other_key, key}} {
+				cryptogram, err := Encrypt(pair[0], pair[1].PublicKey(), []byte("MySuperSecretMessage"), &Options{Curve: curve_id})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				message, err := Decrypt(pair[1], cryptogram)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(message) != "MySuperSecretMessage" {
+					t.Fatalf("decrypt gave %q", message)
+				}
+			}
+		})
+	}
+}
+
+func TestAgreeMatchesReference(t *testing.T) {
+	source := &drbg{seed: []byte("agree matches reference")}
+
+	for _, curve_id := range []CurveID{CURVE_P256, CURVE_P384, CURVE_P521} {
+		t.Run(curve_id.String(), func(t *testing.T) {
+			n := curve_id.curve().Params().N
+			one := make([]byte, curve_id.scalar_len())
+			one[len(one)-1] = 1
+
+			// the generator and its negation are special cases of agree_v0
+			var public_keys []*PublicKey
+			for _, k := range [][]byte{one, new(big.Int).Sub(n, big.NewInt(1)).FillBytes(make([]byte, len(one)))} {
+				key, err := NewECPrivateKeyFromBytes(k, &Options{Curve: curve_id})
+				if err != nil {
+					t.Fatal(err)
+				}
+				public_keys = append(public_keys, key.PublicKey())
+			}
+
+			private_keys := []*PrivateKey{leading_zero_key(t, curve_id, source)}
+			for i := 0; i < 16; i++ {
+				key, err := NewECPrivateKey(&Options{Curve: curve_id, Rand: source})
+				if err != nil {
+					t.Fatal(err)
+				}
+				private_keys = append(private_keys, key)
+				public_keys = append(public_keys, key.PublicKey())
+			}
+
+			for _, private_key := range private_keys {
+				for _, public_key := range public_keys[:4] {
+					check_agree(t, private_key, public_key)
+				}
+			}
+		})
+	}
+}
+
+func TestAgreeLeadingZeroCoordinates(t *testing.T) {
+	source := &drbg{seed: []byte("agree leading zero coordinates")}
+	curve := CURVE_P256.curve()
+
+	// look for shared points whose x, then y, coordinate starts with a zero
+	// byte, which agree_envelope keeps and Agree drops
+	found_x, found_y := false, false
+	for i := 0; i < 1<<14 && !(found_x && found_y); i++ {
+		private_key, err := NewECPrivateKey(&Options{Rand: source})
+		if err != nil {
+			t.Fatal(err)
+		}
+		public_key, err := NewECPrivateKey(&Options{Rand: source})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x, y := public_key.PublicKey().coordinates()
+		x, y = curve.ScalarMult(x, y, private_key.Bytes())
+
+		if short_x, short_y := x.BitLen() <= 248, y.BitLen() <= 248; (short_x && !found_x) || (short_y && !found_y) {
+			found_x, found_y = found_x || short_x, found_y || short_y
+			check_agree(t, private_key, public_key.PublicKey())
+		}
+	}
+
+	if !found_x || !found_y {
+		t.Fatal("no shared points with short coordinates found")
+	}
+}
+
+// check_agree checks that agree_envelope hashes the fixed-width x coordinate,
+// and that Agree and agree_v0 give the same secret as they always have
+func check_agree(t *testing.T, private_key *PrivateKey, public_key *PublicKey) {
+	t.Helper()
+
+	shared_secret, err := private_key.agree_envelope(public_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := reference_agree(private_key, public_key); !bytes.Equal(shared_secret, want) {
+		t.Fatalf("agree_envelope gave %x, want %x", shared_secret, want)
+	}
+
+	want := reference_agree_v0(private_key, public_key)
+	for name, agree := range map[string]func(*PublicKey) ([]byte, error){
+		"Agree":    private_key.Agree,
+		"agree_v0": private_key.agree_v0,
+	} {
+		shared_secret, err := agree(public_key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(shared_secret, want) {
+			t.Fatalf("%s gave %x, want %x", name, shared_secret, want)
+		}
+	}
+}
+
+func TestLegacyPassphraseKey(t *testing.T) {
+	// earlier versions of unus used the passphrase itself as the scalar,
+	// reduced modulo the order of P-256
+	passphrase := []byte("correct-horse-battery-staple-and-then-some")
+	key, err := NewECPrivateKeyFromBytes(passphrase, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := new(big.Int).SetBytes(passphrase)
+	d.Mod(d, CURVE_P256.curve().Params().N)
+	if want := d.FillBytes(make([]byte, 32)); !bytes.Equal(key.Bytes(), want) {
+		t.Fatalf("Bytes gave %x, want %x", key.Bytes(), want)
+	}
+}
@@ -1,37 +1,111 @@
 package goecies
 
 import (
+	"crypto/ecdh"
 	"crypto/elliptic"
+	"crypto/mlkem"
 	"errors"
 	"math/big"
 )
 
-// ECPublicKey encapsulates an elliptice curve public key. It is made up of its
-// x and y coordinates, and the curve from which they were derived.
-type _ECPublicKey struct {
-	elliptic.Curve
-	x *big.Int
-	y *big.Int
+// PublicKey encapsulates an elliptic curve public key. It is made up of the
+// point, held by crypto/ecdh, and the id of the curve it sits on. Keys on the
+// X25519MLKEM768 hybrid hold an X25519 point and an ML-KEM-768 encapsulation
+// key.
+type PublicKey struct {
+	curve CurveID
+	key   *ecdh.PublicKey
+	mlkem *mlkem.EncapsulationKey768
 }
 
 // NewECPublicKeyFromCompressed attempts to unmarshal the compressed EC public
 // key bytes onto the given curve. If the key and/or curve are invalid, an
 // error is returned.
-func NewECPublicKeyFromCompressed(curve elliptic.Curve, compressed []byte) (*_ECPublicKey, error) {
+func NewECPublicKeyFromCompressed(curve elliptic.Curve, compressed []byte) (*PublicKey, error) {
+	curve_id := curve_id_of(curve)
+	if curve_id == 0 {
+		err := errors.New("invalid key")
+		return nil, err
+	}
+
 	x, y := elliptic.UnmarshalCompressed(curve, compressed)
-	if !curve.IsOnCurve(x, y) {
+	if x == nil {
+		err := errors.New("invalid key")
+		return nil, err
+	}
+
+	return new_public_key(curve_id, marshal_uncompressed(curve_id, x, y))
+}
+
+// NewX25519PublicKey attempts to unmarshal the 32-byte u-coordinate of an
+// X25519 public key. If the key is invalid, an error is returned.
+func NewX25519PublicKey(u []byte) (*PublicKey, error) {
+	return new_public_key(CURVE_X25519, u)
+}
+
+// new_public_key unmarshals the public key bytes onto the curve, as
+// crypto/ecdh encodes them, checking that the point is on the curve
+func new_public_key(curve_id CurveID, data []byte) (*PublicKey, error) {
+	key, err := curve_id.ecdh().NewPublicKey(data)
+	if err != nil {
 		err := errors.New("invalid key")
 		return nil, err
 	}
 
-	return &_ECPublicKey{
-		Curve: curve,
-		x:     x,
-		y:     y,
-	}, nil
+	return &PublicKey{curve: curve_id, key: key}, nil
+}
+
+// unmarshal_public_key unmarshals a public key on the identified curve, as
+// encoded by Compress
+func unmarshal_public_key(curve CurveID, data []byte) (*PublicKey, error) {
+	switch curve {
+	case CURVE_X25519:
+		return NewX25519PublicKey(data)
+	case CURVE_X25519_MLKEM768:
+		return new_hybrid_public_key(data)
+	}
+	return NewECPublicKeyFromCompressed(curve.curve(), data)
+}
+
+// Compress compresses the EC public key into its x coordinate and the sign of
+// y, e.g. 257 bits (33 bytes) on P-256. X25519 keys are already 32 bytes, so
+// are returned as-is, as are X25519MLKEM768 keys, which can't be compressed.
+func (ecpub *PublicKey) Compress() ([]byte, error) {
+	uncompressed := ecpub.Bytes()
+	if ecpub.curve == CURVE_X25519 || ecpub.curve == CURVE_X25519_MLKEM768 {
+		return uncompressed, nil
+	}
+
+	// 0x04 | x | y becomes 0x02 or 0x03, by the parity of y, | x
+	size := ecpub.curve.scalar_len()
+	compressed := make([]byte, 1+size)
+	compressed[0] = 2 | uncompressed[2*size]&1
+	copy(compressed[1:], uncompressed[1:1+size])
+	return compressed, nil
+}
+
+// Curve returns the id of the curve the key sits on, or zero if unknown
+func (ecpub *PublicKey) Curve() CurveID {
+	return ecpub.curve
+}
+
+// coordinates returns the x and y coordinates of a key on one of the NIST
+// curves
+func (ecpub *PublicKey) coordinates() (*big.Int, *big.Int) {
+	uncompressed := ecpub.key.Bytes()
+	size := ecpub.curve.scalar_len()
+	x := new(big.Int).SetBytes(uncompressed[1 : 1+size])
+	y := new(big.Int).SetBytes(uncompressed[1+size:])
+	return x, y
 }
 
-// Compress compresses the EC public key into 257 bits (32 bytes)
-func (ecpub *_ECPublicKey) Compress() ([]byte, error) {
-	return elliptic.MarshalCompressed(ecpub.Curve, ecpub.x, ecpub.y), nil
+// marshal_uncompressed encodes the point as in SEC 1, so 0x04 | x | y, with
+// each coordinate padded to the width of the curve
+func marshal_uncompressed(curve_id CurveID, x *big.Int, y *big.Int) []byte {
+	size := curve_id.scalar_len()
+	uncompressed := make([]byte, 1+2*size)
+	uncompressed[0] = 4
+	x.FillBytes(uncompressed[1 : 1+size])
+	y.FillBytes(uncompressed[1+size:])
+	return uncompressed
 }
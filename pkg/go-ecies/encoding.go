@@ -0,0 +1,479 @@
+package goecies
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	PEM_PRIVATE_KEY = "PRIVATE KEY"
+	PEM_PUBLIC_KEY  = "PUBLIC KEY"
+
+	JWK_KTY_EC  = "EC"
+	JWK_KTY_OKP = "OKP"
+)
+
+var (
+	errUnsupportedKey = errors.New("unsupported key type or curve")
+	errKeyMismatch    = errors.New("private and public key do not match")
+)
+
+// jwk is a JSON Web Key, as in RFC 7517. EC keys are as in RFC 7518, X25519
+// keys as in RFC 8037. Coordinates and scalars are unpadded base64url.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	D   string `json:"d,omitempty"`
+}
+
+// Bytes returns the public key uncompressed, as in SEC 1, so 0x04 | x | y.
+// X25519 keys are returned as their 32-byte u-coordinate, and X25519MLKEM768
+// keys as that followed by the ML-KEM-768 encapsulation key.
+func (ecpub *PublicKey) Bytes() []byte {
+	if ecpub.mlkem != nil {
+		return append(ecpub.key.Bytes(), ecpub.mlkem.Bytes()...)
+	}
+	return ecpub.key.Bytes()
+}
+
+// NewECPublicKeyFromBytes attempts to unmarshal the public key bytes onto the
+// curve chosen by opts, or the NIST P-256 curve if opts is nil. Keys on the
+// NIST curves may be compressed or uncompressed, as in SEC 1. X25519 keys
+// must be their 32-byte u-coordinate, and X25519MLKEM768 keys as returned by
+// Bytes. If the key and/or curve are invalid, an error is returned.
+func NewECPublicKeyFromBytes(data []byte, opts *Options) (*PublicKey, error) {
+	curve_id := opts.curve()
+	if err := curve_id.validate(); err != nil {
+		return nil, err
+	}
+
+	switch curve_id {
+	case CURVE_X25519:
+		return NewX25519PublicKey(data)
+	case CURVE_X25519_MLKEM768:
+		return new_hybrid_public_key(data)
+	}
+
+	if len(data) == curve_id.public_key_len() {
+		return NewECPublicKeyFromCompressed(curve_id.curve(), data)
+	}
+
+	// checks the point is on the curve
+	return new_public_key(curve_id, data)
+}
+
+// ECDSA returns the private key as an *ecdsa.PrivateKey, for use with
+// crypto/x509 and the like. An error is returned for X25519 keys, which
+// can't be used with ECDSA.
+func (ecpriv *PrivateKey) ECDSA() (*ecdsa.PrivateKey, error) {
+	public, err := ecpriv.public.ECDSA()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecdsa.PrivateKey{
+		PublicKey: *public,
+		D:         new(big.Int).SetBytes(ecpriv.key.Bytes()),
+	}, nil
+}
+
+// ECDSA returns the public key as an *ecdsa.PublicKey. An error is returned
+// for X25519 and X25519MLKEM768 keys, which can't be used with ECDSA.
+func (ecpub *PublicKey) ECDSA() (*ecdsa.PublicKey, error) {
+	if ecpub.curve.curve() == nil {
+		return nil, errUnsupportedKey
+	}
+
+	x, y := ecpub.coordinates()
+	return &ecdsa.PublicKey{
+		Curve: ecpub.curve.curve(),
+		X:     x,
+		Y:     y,
+	}, nil
+}
+
+// ECDH returns the private key as an *ecdh.PrivateKey. An error is returned
+// for X25519MLKEM768 keys, which crypto/ecdh can't hold.
+func (ecpriv *PrivateKey) ECDH() (*ecdh.PrivateKey, error) {
+	if ecpriv.mlkem != nil {
+		return nil, errUnsupportedKey
+	}
+	return ecpriv.key, nil
+}
+
+// ECDH returns the public key as an *ecdh.PublicKey. An error is returned
+// for X25519MLKEM768 keys, which crypto/ecdh can't hold.
+func (ecpub *PublicKey) ECDH() (*ecdh.PublicKey, error) {
+	if ecpub.mlkem != nil {
+		return nil, errUnsupportedKey
+	}
+	return ecpub.key, nil
+}
+
+// NewECPrivateKeyFromECDSA converts an *ecdsa.PrivateKey on one of the
+// supported NIST curves. An error is returned if the curve is unsupported.
+func NewECPrivateKeyFromECDSA(key *ecdsa.PrivateKey) (*PrivateKey, error) {
+	curve_id := curve_id_of(key.Curve)
+	if curve_id == 0 {
+		return nil, errUnsupportedKey
+	}
+
+	private_key, err := key.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	return NewECPrivateKeyFromECDH(private_key)
+}
+
+// NewECPublicKeyFromECDSA converts an *ecdsa.PublicKey on one of the
+// supported NIST curves. An error is returned if the curve is unsupported or
+// the point is not on it.
+func NewECPublicKeyFromECDSA(key *ecdsa.PublicKey) (*PublicKey, error) {
+	curve_id := curve_id_of(key.Curve)
+	if curve_id == 0 {
+		return nil, errUnsupportedKey
+	}
+
+	public_key, err := key.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	return NewECPublicKeyFromECDH(public_key)
+}
+
+// NewECPrivateKeyFromECDH converts an *ecdh.PrivateKey on one of the
+// supported curves. An error is returned if the curve is unsupported.
+func NewECPrivateKeyFromECDH(key *ecdh.PrivateKey) (*PrivateKey, error) {
+	curve_id := ecdh_curve_id_of(key.Curve())
+	if curve_id == 0 {
+		return nil, errUnsupportedKey
+	}
+
+	return NewECPrivateKeyFromBytes(key.Bytes(), &Options{Curve: curve_id})
+}
+
+// NewECPublicKeyFromECDH converts an *ecdh.PublicKey on one of the supported
+// curves. An error is returned if the curve is unsupported.
+func NewECPublicKeyFromECDH(key *ecdh.PublicKey) (*PublicKey, error) {
+	curve_id := ecdh_curve_id_of(key.Curve())
+	if curve_id == 0 {
+		return nil, errUnsupportedKey
+	}
+
+	return NewECPublicKeyFromBytes(key.Bytes(), &Options{Curve: curve_id})
+}
+
+// MarshalPKCS8 encodes the private key as PKCS #8 DER
+func (ecpriv *PrivateKey) MarshalPKCS8() ([]byte, error) {
+	if ecpriv.Curve() == CURVE_X25519 {
+		return x509.MarshalPKCS8PrivateKey(ecpriv.key)
+	}
+
+	key, err := ecpriv.ECDSA()
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKCS8PrivateKey(key)
+}
+
+// MarshalPKCS8PEM encodes the private key as a PKCS #8 "PRIVATE KEY" PEM
+// block
+func (ecpriv *PrivateKey) MarshalPKCS8PEM() ([]byte, error) {
+	der, err := ecpriv.MarshalPKCS8()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEM_PRIVATE_KEY, Bytes: der}), nil
+}
+
+// ParsePKCS8PrivateKey decodes a PKCS #8 DER private key. An error is
+// returned if it can't be parsed, or isn't on one of the supported curves.
+func ParsePKCS8PrivateKey(der []byte) (*PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return NewECPrivateKeyFromECDSA(key)
+	case *ecdh.PrivateKey:
+		return NewECPrivateKeyFromECDH(key)
+	}
+	return nil, errUnsupportedKey
+}
+
+// ParsePrivateKeyPEM decodes the first PKCS #8 "PRIVATE KEY" PEM block in
+// data. An error is returned if there is none, or if it can't be parsed.
+func ParsePrivateKeyPEM(data []byte) (*PrivateKey, error) {
+	der, err := decode_pem(data, PEM_PRIVATE_KEY)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePKCS8PrivateKey(der)
+}
+
+// MarshalSPKI encodes the public key as SubjectPublicKeyInfo DER, as in
+// RFC 5280
+func (ecpub *PublicKey) MarshalSPKI() ([]byte, error) {
+	if ecpub.curve == CURVE_X25519 {
+		return x509.MarshalPKIXPublicKey(ecpub.key)
+	}
+
+	key, err := ecpub.ECDSA()
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKIXPublicKey(key)
+}
+
+// MarshalSPKIPEM encodes the public key as a SubjectPublicKeyInfo
+// "PUBLIC KEY" PEM block
+func (ecpub *PublicKey) MarshalSPKIPEM() ([]byte, error) {
+	der, err := ecpub.MarshalSPKI()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEM_PUBLIC_KEY, Bytes: der}), nil
+}
+
+// ParseSPKIPublicKey decodes a SubjectPublicKeyInfo DER public key. An error
+// is returned if it can't be parsed, or isn't on one of the supported curves.
+func ParseSPKIPublicKey(der []byte) (*PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return NewECPublicKeyFromECDSA(key)
+	case *ecdh.PublicKey:
+		return NewECPublicKeyFromECDH(key)
+	}
+	return nil, errUnsupportedKey
+}
+
+// ParsePublicKeyPEM decodes the first SubjectPublicKeyInfo "PUBLIC KEY" PEM
+// block in data. An error is returned if there is none, or if it can't be
+// parsed.
+func ParsePublicKeyPEM(data []byte) (*PublicKey, error) {
+	der, err := decode_pem(data, PEM_PUBLIC_KEY)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSPKIPublicKey(der)
+}
+
+// decode_pem returns the contents of the first PEM block of the given type
+func decode_pem(data []byte, block_type string) ([]byte, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no %q PEM block found", block_type)
+		}
+
+		if block.Type == block_type {
+			return block.Bytes, nil
+		}
+	}
+}
+
+// MarshalJWK encodes the private key as a JSON Web Key, including the public
+// coordinates. An error is returned for X25519MLKEM768 keys, which have no
+// JSON Web Key encoding.
+func (ecpriv *PrivateKey) MarshalJWK() ([]byte, error) {
+	key, err := ecpriv.public.jwk()
+	if err != nil {
+		return nil, err
+	}
+
+	key.D = base64.RawURLEncoding.EncodeToString(ecpriv.Bytes())
+	return json.Marshal(key)
+}
+
+// MarshalJWK encodes the public key as a JSON Web Key. An error is returned
+// for X25519MLKEM768 keys, which have no JSON Web Key encoding.
+func (ecpub *PublicKey) MarshalJWK() ([]byte, error) {
+	key, err := ecpub.jwk()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(key)
+}
+
+// jwk returns the public key as a JSON Web Key
+func (ecpub *PublicKey) jwk() (*jwk, error) {
+	curve_id := ecpub.Curve()
+	switch curve_id {
+	case CURVE_X25519:
+		return &jwk{
+			Kty: JWK_KTY_OKP,
+			Crv: curve_id.String(),
+			X:   base64.RawURLEncoding.EncodeToString(ecpub.key.Bytes()),
+		}, nil
+	case CURVE_X25519_MLKEM768:
+		return nil, errUnsupportedKey
+	}
+
+	// 0x04 | x | y, with each coordinate already padded to size
+	uncompressed := ecpub.key.Bytes()
+	size := curve_id.scalar_len()
+	return &jwk{
+		Kty: JWK_KTY_EC,
+		Crv: curve_id.String(),
+		X:   base64.RawURLEncoding.EncodeToString(uncompressed[1 : 1+size]),
+		Y:   base64.RawURLEncoding.EncodeToString(uncompressed[1+size:]),
+	}, nil
+}
+
+// ParsePrivateKeyJWK decodes a private key from a JSON Web Key. An error is
+// returned if it can't be parsed, isn't on one of the supported curves, or
+// if its public coordinates don't match the private key.
+func ParsePrivateKeyJWK(data []byte) (*PrivateKey, error) {
+	var key jwk
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+
+	curve_id, err := key.curve_id()
+	if err != nil {
+		return nil, err
+	}
+
+	if key.D == "" {
+		err := errors.New("jwk has no private key")
+		return nil, err
+	}
+
+	d, err := base64.RawURLEncoding.DecodeString(key.D)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(d) != curve_id.scalar_len() {
+		err := errors.New("jwk private key is the wrong length")
+		return nil, err
+	}
+
+	private_key, err := NewECPrivateKeyFromBytes(d, &Options{Curve: curve_id})
+	if err != nil {
+		return nil, err
+	}
+
+	public_key, err := key.public_key(curve_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(private_key.public.Bytes(), public_key.Bytes()) {
+		return nil, errKeyMismatch
+	}
+
+	return private_key, nil
+}
+
+// ParsePublicKeyJWK decodes a public key from a JSON Web Key. Any private key
+// it holds is ignored. An error is returned if it can't be parsed, or isn't
+// on one of the supported curves.
+func ParsePublicKeyJWK(data []byte) (*PublicKey, error) {
+	var key jwk
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, err
+	}
+
+	curve_id, err := key.curve_id()
+	if err != nil {
+		return nil, err
+	}
+
+	return key.public_key(curve_id)
+}
+
+// curve_id returns the curve named by the key, checking it has the right
+// key type
+func (key *jwk) curve_id() (CurveID, error) {
+	for _, curve_id := range []CurveID{CURVE_P256, CURVE_P384, CURVE_P521, CURVE_X25519} {
+		if key.Crv != curve_id.String() {
+			continue
+		}
+
+		kty := JWK_KTY_EC
+		if curve_id == CURVE_X25519 {
+			kty = JWK_KTY_OKP
+		}
+
+		if key.Kty != kty {
+			return 0, fmt.Errorf("jwk with crv %q must have kty %q", key.Crv, kty)
+		}
+		return curve_id, nil
+	}
+	return 0, errUnsupportedKey
+}
+
+// public_key decodes the public coordinates of the key onto the curve
+func (key *jwk) public_key(curve_id CurveID) (*PublicKey, error) {
+	x, err := base64.RawURLEncoding.DecodeString(key.X)
+	if err != nil {
+		return nil, err
+	}
+
+	if curve_id == CURVE_X25519 {
+		return NewX25519PublicKey(x)
+	}
+
+	y, err := base64.RawURLEncoding.DecodeString(key.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	size := curve_id.scalar_len()
+	if len(x) != size || len(y) != size {
+		err := errors.New("jwk coordinates are the wrong length")
+		return nil, err
+	}
+
+	uncompressed := append([]byte{4}, x...)
+	uncompressed = append(uncompressed, y...)
+	return NewECPublicKeyFromBytes(uncompressed, &Options{Curve: curve_id})
+}
+
+// curve_id_of returns the id of the elliptic curve, or zero if unsupported
+func curve_id_of(curve elliptic.Curve) CurveID {
+	switch curve {
+	case elliptic.P256():
+		return CURVE_P256
+	case elliptic.P384():
+		return CURVE_P384
+	case elliptic.P521():
+		return CURVE_P521
+	}
+	return 0
+}
+
+// ecdh_curve_id_of returns the id of the ecdh curve, or zero if unsupported
+func ecdh_curve_id_of(curve ecdh.Curve) CurveID {
+	switch curve {
+	case ecdh.P256():
+		return CURVE_P256
+	case ecdh.P384():
+		return CURVE_P384
+	case ecdh.P521():
+		return CURVE_P521
+	case ecdh.X25519():
+		return CURVE_X25519
+	}
+	return 0
+}
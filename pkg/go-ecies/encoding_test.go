@@ -0,0 +1,371 @@
+package goecies
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"testing"
+)
+
+// check_same_key checks that the private key, and its public key, are the
+// same as want
+func check_same_key(t *testing.T, got *PrivateKey, want *PrivateKey) {
+	t.Helper()
+
+	if got.Curve() != want.Curve() || !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Fatalf("private key %s %x, want %s %x", got.Curve(), got.Bytes(), want.Curve(), want.Bytes())
+	}
+	check_same_public_key(t, got.PublicKey(), want.PublicKey())
+}
+
+// check_same_public_key checks that the public key is the same as want
+func check_same_public_key(t *testing.T, got *PublicKey, want *PublicKey) {
+	t.Helper()
+
+	if got.Curve() != want.Curve() || !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Fatalf("public key %s %x, want %s %x", got.Curve(), got.Bytes(), want.Curve(), want.Bytes())
+	}
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	for _, curve_id := range []CurveID{CURVE_P256, CURVE_P384, CURVE_P521, CURVE_X25519} {
+		t.Run(curve_id.String(), func(t *testing.T) {
+			key, err := NewECPrivateKey(&Options{Curve: curve_id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			public_key := key.PublicKey()
+
+			private_encodings := map[string]func() (*PrivateKey, error){
+				"PKCS #8 DER": func() (*PrivateKey, error) {
+					der, err := key.MarshalPKCS8()
+					if err != nil {
+						return nil, err
+					}
+					return ParsePKCS8PrivateKey(der)
+				},
+				"PKCS #8 PEM": func() (*PrivateKey, error) {
+					data, err := key.MarshalPKCS8PEM()
+					if err != nil {
+						return nil, err
+					}
+					return ParsePrivateKeyPEM(data)
+				},
+				"JWK": func() (*PrivateKey, error) {
+					data, err := key.MarshalJWK()
+					if err != nil {
+						return nil, err
+					}
+					return ParsePrivateKeyJWK(data)
+				},
+				"raw": func() (*PrivateKey, error) {
+					return NewECPrivateKeyFromBytes(key.Bytes(), &Options{Curve: curve_id})
+				},
+				"crypto/ecdh": func() (*PrivateKey, error) {
+					converted, err := key.ECDH()
+					if err != nil {
+						return nil, err
+					}
+					return NewECPrivateKeyFromECDH(converted)
+				},
+			}
+
+			public_encodings := map[string]func() (*PublicKey, error){
+				"SPKI DER": func() (*PublicKey, error) {
+					der, err := public_key.MarshalSPKI()
+					if err != nil {
+						return nil, err
+					}
+					return ParseSPKIPublicKey(der)
+				},
+				"SPKI PEM": func() (*PublicKey, error) {
+					data, err := public_key.MarshalSPKIPEM()
+					if err != nil {
+						return nil, err
+					}
+					return ParsePublicKeyPEM(data)
+				},
+				"JWK": func() (*PublicKey, error) {
+					data, err := public_key.MarshalJWK()
+					if err != nil {
+						return nil, err
+					}
+					return ParsePublicKeyJWK(data)
+				},
+				"private JWK": func() (*PublicKey, error) {
+					data, err := key.MarshalJWK()
+					if err != nil {
+						return nil, err
+					}
+					return ParsePublicKeyJWK(data)
+				},
+				"uncompressed": func() (*PublicKey, error) {
+					return NewECPublicKeyFromBytes(public_key.Bytes(), &Options{Curve: curve_id})
+				},
+				"compressed": func() (*PublicKey, error) {
+					compressed, err := public_key.Compress()
+					if err != nil {
+						return nil, err
+					}
+					return NewECPublicKeyFromBytes(compressed, &Options{Curve: curve_id})
+				},
+				"crypto/ecdh": func() (*PublicKey, error) {
+					converted, err := public_key.ECDH()
+					if err != nil {
+						return nil, err
+					}
+					return NewECPublicKeyFromECDH(converted)
+				},
+			}
+
+			// crypto/ecdsa only has the NIST curves
+			if curve_id != CURVE_X25519 {
+				private_encodings["crypto/ecdsa"] = func() (*PrivateKey, error) {
+					converted, err := key.ECDSA()
+					if err != nil {
+						return nil, err
+					}
+					return NewECPrivateKeyFromECDSA(converted)
+				}
+				public_encodings["crypto/ecdsa"] = func() (*PublicKey, error) {
+					converted, err := public_key.ECDSA()
+					if err != nil {
+						return nil, err
+					}
+					return NewECPublicKeyFromECDSA(converted)
+				}
+			}
+
+			for name, round_trip := range private_encodings {
+				t.Run("private "+name, func(t *testing.T) {
+					decoded, err := round_trip()
+					if err != nil {
+						t.Fatal(err)
+					}
+					check_same_key(t, decoded, key)
+				})
+			}
+
+			for name, round_trip := range public_encodings {
+				t.Run("public "+name, func(t *testing.T) {
+					decoded, err := round_trip()
+					if err != nil {
+						t.Fatal(err)
+					}
+					check_same_public_key(t, decoded, public_key)
+				})
+			}
+		})
+	}
+}
+
+func TestEncodingCompressedLength(t *testing.T) {
+	for _, curve_id := range []CurveID{CURVE_P256, CURVE_P384, CURVE_P521, CURVE_X25519} {
+		key, err := NewECPrivateKey(&Options{Curve: curve_id})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compressed, err := key.PublicKey().Compress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(compressed) != curve_id.public_key_len() {
+			t.Fatalf("%s: compressed key is %d bytes, want %d", curve_id, len(compressed), curve_id.public_key_len())
+		}
+	}
+}
+
+func TestEncodingWrongPEMBlock(t *testing.T) {
+	key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private_pem, err := key.MarshalPKCS8PEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public_pem, err := key.PublicKey().MarshalSPKIPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParsePrivateKeyPEM(public_pem); err == nil {
+		t.Fatal("parsed a private key from a PUBLIC KEY block")
+	}
+	if _, err := ParsePublicKeyPEM(private_pem); err == nil {
+		t.Fatal("parsed a public key from a PRIVATE KEY block")
+	}
+	if _, err := ParsePrivateKeyPEM([]byte("not PEM")); err == nil {
+		t.Fatal("parsed a private key from no PEM at all")
+	}
+
+	// an EC PRIVATE KEY block is SEC 1, not PKCS #8
+	sec1 := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key.Bytes()})
+	if _, err := ParsePrivateKeyPEM(sec1); err == nil {
+		t.Fatal("parsed a private key from an EC PRIVATE KEY block")
+	}
+
+	// blocks of other types are skipped over
+	decoded, err := ParsePublicKeyPEM(append(bytes.Clone(private_pem), public_pem...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check_same_public_key(t, decoded, key.PublicKey())
+}
+
+func TestEncodingCurveMismatch(t *testing.T) {
+	p256_key, err := NewECPrivateKey(&Options{Curve: CURVE_P256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384_key, err := NewECPrivateKey(&Options{Curve: CURVE_P384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x25519_key, err := NewECPrivateKey(&Options{Curve: CURVE_X25519})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a point on one curve isn't one on another
+	for _, encode := range []func(*PublicKey) ([]byte, error){
+		func(public_key *PublicKey) ([]byte, error) { return public_key.Bytes(), nil },
+		(*PublicKey).Compress,
+	} {
+		encoded, err := encode(p384_key.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewECPublicKeyFromBytes(encoded, &Options{Curve: CURVE_P256}); err == nil {
+			t.Fatal("parsed a P-384 key as P-256")
+		}
+	}
+	if _, err := NewECPublicKeyFromBytes(x25519_key.PublicKey().Bytes(), &Options{Curve: CURVE_P256}); err == nil {
+		t.Fatal("parsed an X25519 key as P-256")
+	}
+	if _, err := NewECPrivateKeyFromBytes(p384_key.Bytes(), &Options{Curve: CURVE_X25519}); err == nil {
+		t.Fatal("parsed a P-384 scalar as X25519")
+	}
+
+	jwk_of := func(key *PrivateKey) map[string]string {
+		data, err := key.MarshalJWK()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := map[string]string{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatal(err)
+		}
+		return fields
+	}
+
+	tests := map[string]func(fields map[string]string){
+		"crv of another curve":  func(fields map[string]string) { fields["crv"] = CURVE_P384.String() },
+		"unknown crv":           func(fields map[string]string) { fields["crv"] = "P-224" },
+		"X25519 with kty EC":    func(fields map[string]string) { fields["crv"], fields["kty"] = CURVE_X25519.String(), JWK_KTY_EC },
+		"P-256 with kty OKP":    func(fields map[string]string) { fields["kty"] = JWK_KTY_OKP },
+		"x of the wrong length": func(fields map[string]string) { fields["x"] = fields["x"][:len(fields["x"])-2] },
+		"coordinates of another key": func(fields map[string]string) {
+			other_key, err := NewECPrivateKey(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other := jwk_of(other_key)
+			fields["x"], fields["y"] = other["x"], other["y"]
+		},
+	}
+
+	for name, tamper := range tests {
+		t.Run(name, func(t *testing.T) {
+			fields := jwk_of(p256_key)
+			tamper(fields)
+			data, err := json.Marshal(fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ParsePrivateKeyJWK(data); err == nil {
+				t.Fatalf("parsed %s", data)
+			}
+		})
+	}
+
+	// a private key that doesn't match its own public coordinates is
+	// caught, and reported as such
+	other_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := jwk_of(p256_key)
+	fields["d"] = base64.RawURLEncoding.EncodeToString(other_key.Bytes())
+	data, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePrivateKeyJWK(data); !errors.Is(err, errKeyMismatch) {
+		t.Fatalf("parse gave %v, want %v", err, errKeyMismatch)
+	}
+
+	// crypto/ecdsa keys on other curves aren't supported
+	p224_key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewECPrivateKeyFromECDSA(p224_key); !errors.Is(err, errUnsupportedKey) {
+		t.Fatalf("private P-224 key gave %v", err)
+	}
+	if _, err := NewECPublicKeyFromECDSA(&p224_key.PublicKey); !errors.Is(err, errUnsupportedKey) {
+		t.Fatalf("public P-224 key gave %v", err)
+	}
+}
+
+func TestEncodingX25519NotECDSA(t *testing.T) {
+	key, err := NewECPrivateKey(&Options{Curve: CURVE_X25519})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := key.ECDSA(); !errors.Is(err, errUnsupportedKey) {
+		t.Fatalf("private key conversion gave %v", err)
+	}
+	if _, err := key.PublicKey().ECDSA(); !errors.Is(err, errUnsupportedKey) {
+		t.Fatalf("public key conversion gave %v", err)
+	}
+}
+
+func TestEncodingTruncatedDER(t *testing.T) {
+	for _, curve_id := range []CurveID{CURVE_P256, CURVE_P384, CURVE_P521, CURVE_X25519} {
+		t.Run(curve_id.String(), func(t *testing.T) {
+			key, err := NewECPrivateKey(&Options{Curve: curve_id})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			private_der, err := key.MarshalPKCS8()
+			if err != nil {
+				t.Fatal(err)
+			}
+			public_der, err := key.PublicKey().MarshalSPKI()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, length := range []int{0, 1, len(private_der) / 2, len(private_der) - 1} {
+				if _, err := ParsePKCS8PrivateKey(private_der[:length]); err == nil {
+					t.Fatalf("parsed PKCS #8 truncated to %d bytes", length)
+				}
+			}
+			for _, length := range []int{0, 1, len(public_der) / 2, len(public_der) - 1} {
+				if _, err := ParseSPKIPublicKey(public_der[:length]); err == nil {
+					t.Fatalf("parsed SPKI truncated to %d bytes", length)
+				}
+			}
+		})
+	}
+}
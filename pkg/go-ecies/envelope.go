@@ -0,0 +1,206 @@
+package goecies
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// the current version of the envelope, whose key agreement hashes the
+	// fixed-width x coordinate of the shared point. version 1 envelopes agreed
+	// keys as Agree does, and are still opened. cryptograms from before the
+	// envelope existed are treated as version 0.
+	envelope_version   = 2
+	envelope_version_1 = 1
+
+	// magic, version, curve, kdf and cipher
+	envelope_prefix_len = 8
+	envelope_length_len = 2
+)
+
+var (
+	// marks a cryptogram wrapped in an envelope. a version 0 cryptogram starts
+	// with a compressed public key, so 0x02 or 0x03, and can't be mistaken for
+	// one.
+	envelope_magic = []byte("ECIE")
+)
+
+var (
+	ErrTruncated          = errors.New("truncated")
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	ErrUnsupportedSuite   = errors.New("unsupported suite")
+	ErrInvalidLength      = errors.New("invalid length")
+	ErrMalformed          = errors.New("malformed")
+
+	// ErrAuthFailed is returned when a cryptogram fails to authenticate,
+	// whether it was tampered with or the wrong key was given. The two can't
+	// be told apart.
+	ErrAuthFailed = errors.New("invalid key or cryptogram")
+)
+
+// FormatError describes which field of a cryptogram could not be parsed, and
+// why. The reason is one of ErrTruncated, ErrUnsupportedVersion,
+// ErrUnsupportedSuite, ErrInvalidLength or ErrMalformed, and can be tested for
+// with errors.Is.
+type FormatError struct {
+	Field string
+	Err   error
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("cryptogram %s: %s", e.Field, e.Err.Error())
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+// envelope is a parsed cryptogram. Everything up to and including the nonce
+// is the header, which is authenticated along with the body. The body is laid
+// out as the cipher of the suite dictates.
+//
+//	magic | version | curve | kdf | cipher
+//	| u16 length | sender public key
+//	| u16 length | salt
+//	| u16 length | nonce
+//	| body
+type envelope struct {
+	version    uint8
+	suite      Suite
+	public_key []byte
+	salt       []byte
+	nonce      []byte
+	header     []byte
+	body       []byte
+	magic      []byte
+}
+
+// is_envelope reports whether the message is wrapped in an envelope, rather
+// than being a version 0 cryptogram
+func is_envelope(message []byte) bool {
+	return bytes.HasPrefix(message, envelope_magic)
+}
+
+// marshal_header encodes the header of the envelope, less the body
+func (e *envelope) marshal_header() []byte {
+	length := envelope_prefix_len + 3*envelope_length_len + len(e.public_key) + len(e.salt) + len(e.nonce)
+
+	header := make([]byte, 0, length)
+	header = append(header, e.magic...)
+	header = append(header, e.version, byte(e.suite.Curve), byte(e.suite.KDF), byte(e.suite.Cipher))
+	for _, field := range [][]byte{e.public_key, e.salt, e.nonce} {
+		header = binary.BigEndian.AppendUint16(header, uint16(len(field)))
+		header = append(header, field...)
+	}
+	return header
+}
+
+// authenticated_data returns everything authenticated alongside the message:
+// the header, then any associated data followed by its length as a big-endian
+// u64. The header delimits itself, so without associated data it is
+// authenticated alone, and cryptograms made without any are unchanged.
+func authenticated_data(header []byte, ad []byte) []byte {
+	if len(ad) == 0 {
+		return header
+	}
+
+	authenticated := make([]byte, 0, len(header)+len(ad)+8)
+	authenticated = append(authenticated, header...)
+	authenticated = append(authenticated, ad...)
+	return binary.BigEndian.AppendUint64(authenticated, uint64(len(ad)))
+}
+
+// parse_envelope splits a cryptogram starting with the given magic into its
+// fields, checking that the version and suite are supported and that every
+// field has the length the suite requires. A *FormatError is returned if not.
+func parse_envelope(message []byte, magic []byte) (*envelope, error) {
+	e, err := parse_header(message, magic)
+	if err != nil {
+		return nil, err
+	}
+
+	e.body = message[len(e.header):]
+
+	if err := e.suite.Cipher.validate_body(e.body); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// parse_header splits the header from the front of message into its fields,
+// as parse_envelope does. The header must start with the given magic, which
+// tells a cryptogram from a stream or a signed cryptogram.
+func parse_header(message []byte, magic []byte) (*envelope, error) {
+	if len(message) < envelope_prefix_len {
+		return nil, &FormatError{Field: "header", Err: ErrTruncated}
+	}
+
+	if !bytes.HasPrefix(message, magic) {
+		return nil, &FormatError{Field: "magic", Err: ErrUnsupportedVersion}
+	}
+
+	e := &envelope{
+		version: message[4],
+		suite: Suite{
+			Curve:  CurveID(message[5]),
+			KDF:    KDFID(message[6]),
+			Cipher: CipherID(message[7]),
+		},
+		magic: magic,
+	}
+
+	if e.version != envelope_version && e.version != envelope_version_1 {
+		return nil, &FormatError{Field: "version", Err: ErrUnsupportedVersion}
+	}
+
+	if err := e.suite.validate(); err != nil {
+		return nil, err
+	}
+
+	offset := envelope_prefix_len
+	fields := []struct {
+		name   string
+		into   *[]byte
+		length int
+	}{
+		{"public key", &e.public_key, e.suite.Curve.encapsulation_len()},
+		{"salt", &e.salt, e.suite.salt_len()},
+		{"nonce", &e.nonce, e.nonce_len()},
+	}
+
+	for _, field := range fields {
+		if len(message) < offset+envelope_length_len {
+			return nil, &FormatError{Field: field.name, Err: ErrTruncated}
+		}
+
+		length := int(binary.BigEndian.Uint16(message[offset:]))
+		offset += envelope_length_len
+
+		if length != field.length {
+			return nil, &FormatError{Field: field.name, Err: ErrInvalidLength}
+		}
+
+		if len(message) < offset+length {
+			return nil, &FormatError{Field: field.name, Err: ErrTruncated}
+		}
+
+		*field.into = message[offset : offset+length]
+		offset += length
+	}
+
+	e.header = message[:offset]
+
+	return e, nil
+}
+
+// nonce_len returns the length of the nonce field. for a stream, this is only
+// the prefix of each chunk's nonce.
+func (e *envelope) nonce_len() int {
+	if bytes.Equal(e.magic, stream_magic) {
+		return e.suite.Cipher.nonce_len() - stream_nonce_suffix_len
+	}
+	return e.suite.Cipher.nonce_len()
+}
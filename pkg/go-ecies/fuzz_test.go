@@ -0,0 +1,153 @@
+package goecies
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"testing"
+)
+
+// fuzz_receiver_key returns the same P-256 key every time, so that the seed
+// cryptograms can be opened and mutations of them get past key agreement
+func fuzz_receiver_key(t testing.TB) *PrivateKey {
+	receiver_key, err := NewECPrivateKeyFromBytes(bytes.Repeat([]byte{0x2a}, 32), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return receiver_key
+}
+
+// fuzz_seeds returns a cryptogram of every kind for the receiver, to start
+// the corpus from
+func fuzz_seeds(t testing.TB, receiver_key *PrivateKey) [][]byte {
+	message := []byte("MySuperSecretMessage")
+	receiver := receiver_key.PublicKey()
+
+	var seeds [][]byte
+	for _, cipher := range []CipherID{CIPHER_AES256_CBC_HMAC_SHA256, CIPHER_AES256_GCM, CIPHER_CHACHA20_POLY1305} {
+		cryptogram, err := EncryptEphemeral(receiver, message, &Options{Cipher: cipher, decrypt_only: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seeds = append(seeds, cryptogram)
+	}
+
+	other_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	multi, err := EncryptMultiEphemeral([]*PublicKey{other_key.PublicKey(), receiver}, message, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, signing_key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := EncryptAndSign(signing_key, receiver, message, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	w, err := EncryptStreamEphemeral(&stream, receiver, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(message)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// for another receiver, as the receiver is on P-256, but it still
+	// exercises parsing of the hybrid
+	hybrid_key, err := NewECPrivateKey(&Options{Curve: CURVE_X25519_MLKEM768})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hybrid, err := EncryptEphemeral(hybrid_key.PublicKey(), message, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// version 0 is the senders compressed public key, then a 32-byte tag, two
+	// 16-byte salts, a 16-byte iv and whole blocks of ciphertext
+	sender, err := other_key.PublicKey().Compress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	version_0 := append(sender, make([]byte, 32+16+16+16+32)...)
+
+	return append(seeds, multi, signed, stream.Bytes(), hybrid, version_0, nil, []byte("ECIE"))
+}
+
+// FuzzDecrypt checks that no input makes decryption panic, and that every
+// failure is either a *FormatError or ErrAuthFailed
+func FuzzDecrypt(f *testing.F) {
+	receiver_key := fuzz_receiver_key(f)
+	for _, seed := range fuzz_seeds(f, receiver_key) {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, message []byte) {
+		check := func(name string, err error) {
+			var format_error *FormatError
+			if err != nil && !errors.As(err, &format_error) && !errors.Is(err, ErrAuthFailed) {
+				t.Errorf("%s: unexpected error %v", name, err)
+			}
+		}
+
+		_, err := Decrypt(receiver_key, message)
+		check("Decrypt", err)
+
+		_, err = DecryptWithAD(receiver_key, message, []byte("associated data"))
+		check("DecryptWithAD", err)
+
+		_, _, err = DecryptAndVerify(receiver_key, message)
+		if !errors.Is(err, ErrInvalidSignature) {
+			check("DecryptAndVerify", err)
+		}
+
+		r, err := DecryptStream(bytes.NewReader(message), receiver_key)
+		if err == nil {
+			_, err = io.ReadAll(r)
+		}
+		check("DecryptStream", err)
+	})
+}
+
+// FuzzParseEnvelope checks that the envelope parser never panics, and that
+// anything it accepts has a header which marshals back to the same bytes
+func FuzzParseEnvelope(f *testing.F) {
+	for _, seed := range fuzz_seeds(f, fuzz_receiver_key(f)) {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, message []byte) {
+		for _, magic := range [][]byte{envelope_magic, stream_magic, signed_magic, multi_magic} {
+			e, err := parse_header(message, magic)
+			if err != nil {
+				var format_error *FormatError
+				if !errors.As(err, &format_error) {
+					t.Fatalf("unexpected error %v", err)
+				}
+				continue
+			}
+
+			if !bytes.Equal(e.marshal_header(), e.header) {
+				t.Fatalf("header %x marshalled as %x", e.header, e.marshal_header())
+			}
+		}
+
+		if e, err := parse_envelope(message, envelope_magic); err == nil {
+			if err := e.suite.Cipher.validate_body(e.body); err != nil {
+				t.Fatalf("accepted a body the cipher can't have made: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package goecies
+
+import (
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"errors"
+	"fmt"
+)
+
+const (
+	// domain separates the secret fed to the KDF by the hybrid, in the style
+	// of X-Wing
+	hybrid_label = "go-ecies X25519MLKEM768 v1\x00"
+)
+
+var (
+	errHybridAgree = errors.New("X25519MLKEM768 keys encapsulate a secret, rather than agree one")
+	errHybridMulti = errors.New("X25519MLKEM768 keys can't be used with many receivers")
+)
+
+// new_hybrid_private_key makes an X25519MLKEM768 private key from the X25519
+// scalar followed by the ML-KEM-768 seed
+func new_hybrid_private_key(k []byte) (*PrivateKey, error) {
+	if len(k) != CURVE_X25519_MLKEM768.scalar_len() {
+		err := fmt.Errorf("bytes d must be exactly %d-bits", 8*CURVE_X25519_MLKEM768.scalar_len())
+		return nil, err
+	}
+
+	key, err := ecdh.X25519().NewPrivateKey(k[:x25519_scalar_len])
+	if err != nil {
+		return nil, err
+	}
+
+	decapsulation_key, err := mlkem.NewDecapsulationKey768(k[x25519_scalar_len:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &PrivateKey{
+		public: &PublicKey{
+			curve: CURVE_X25519_MLKEM768,
+			key:   key.PublicKey(),
+			mlkem: decapsulation_key.EncapsulationKey(),
+		},
+		key:   key,
+		mlkem: decapsulation_key,
+	}, nil
+}
+
+// new_hybrid_public_key unmarshals an X25519MLKEM768 public key from the
+// X25519 public key followed by the ML-KEM-768 encapsulation key
+func new_hybrid_public_key(data []byte) (*PublicKey, error) {
+	if len(data) != CURVE_X25519_MLKEM768.public_key_len() {
+		err := errors.New("invalid key")
+		return nil, err
+	}
+
+	key, err := ecdh.X25519().NewPublicKey(data[:x25519_public_key_len])
+	if err != nil {
+		err := errors.New("invalid key")
+		return nil, err
+	}
+
+	encapsulation_key, err := mlkem.NewEncapsulationKey768(data[x25519_public_key_len:])
+	if err != nil {
+		err := errors.New("invalid key")
+		return nil, err
+	}
+
+	return &PublicKey{
+		curve: CURVE_X25519_MLKEM768,
+		key:   key,
+		mlkem: encapsulation_key,
+	}, nil
+}
+
+// hybrid_encapsulate agrees an X25519 secret between the sender and receiver,
+// and encapsulates an ML-KEM-768 secret to the receiver. returns both secrets
+// combined, and the senders X25519 public key followed by the ML-KEM
+// ciphertext. encapsulation always reads from crypto/rand.Reader.
+func hybrid_encapsulate(sender_key *PrivateKey, receiver_key *PublicKey) ([]byte, []byte, error) {
+	x25519_secret, err := sender_key.key.ECDH(receiver_key.key)
+	if err != nil {
+		err := errors.New("unable to validate keys")
+		return nil, nil, err
+	}
+
+	mlkem_secret, ciphertext := receiver_key.mlkem.Encapsulate()
+
+	sender := sender_key.key.PublicKey().Bytes()
+	encapsulation := append(sender[:len(sender):len(sender)], ciphertext...)
+
+	return hybrid_secret(mlkem_secret, x25519_secret, sender, receiver_key.key.Bytes()), encapsulation, nil
+}
+
+// hybrid_decapsulate recovers the combined secret made by hybrid_encapsulate
+// with the receivers key. A *FormatError is returned if the senders X25519
+// public key is invalid. ML-KEM rejects a tampered ciphertext implicitly, by
+// giving a different secret.
+func hybrid_decapsulate(receiver_key *PrivateKey, encapsulation []byte) ([]byte, error) {
+	sender, ciphertext := encapsulation[:x25519_public_key_len], encapsulation[x25519_public_key_len:]
+
+	sender_key, err := ecdh.X25519().NewPublicKey(sender)
+	if err != nil {
+		return nil, &FormatError{Field: "public key", Err: ErrMalformed}
+	}
+
+	// fails for low order points
+	x25519_secret, err := receiver_key.key.ECDH(sender_key)
+	if err != nil {
+		return nil, &FormatError{Field: "public key", Err: ErrMalformed}
+	}
+
+	// only fails for ciphertexts of the wrong length
+	mlkem_secret, err := receiver_key.mlkem.Decapsulate(ciphertext)
+	if err != nil {
+		return nil, &FormatError{Field: "public key", Err: ErrInvalidLength}
+	}
+
+	return hybrid_secret(mlkem_secret, x25519_secret, sender, receiver_key.key.PublicKey().Bytes()), nil
+}
+
+// hybrid_secret returns what is fed to the KDF for the hybrid: the label, both
+// shared secrets, then the senders and receivers X25519 public keys, as in
+// X-Wing. the ML-KEM ciphertext needn't be included, as ML-KEM is already
+// bound to it, and the whole header is authenticated besides.
+func hybrid_secret(mlkem_secret []byte, x25519_secret []byte, sender []byte, receiver []byte) []byte {
+	secret := make([]byte, 0, len(hybrid_label)+len(mlkem_secret)+len(x25519_secret)+len(sender)+len(receiver))
+	secret = append(secret, hybrid_label...)
+	secret = append(secret, mlkem_secret...)
+	secret = append(secret, x25519_secret...)
+	secret = append(secret, sender...)
+	return append(secret, receiver...)
+}
@@ -0,0 +1,174 @@
+package goecies
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestHybridRoundTrip(t *testing.T) {
+	receiver_key, err := NewECPrivateKey(&Options{Curve: CURVE_X25519_MLKEM768})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := []byte("MySuperSecretMessage")
+	for _, cipher := range []CipherID{CIPHER_AES256_GCM, CIPHER_CHACHA20_POLY1305} {
+		cryptogram, err := EncryptEphemeral(receiver_key.PublicKey(), message, &Options{Cipher: cipher})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := parse_envelope(cryptogram, envelope_magic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.suite.Curve != CURVE_X25519_MLKEM768 {
+			t.Fatalf("envelope records curve %v", e.suite.Curve)
+		}
+
+		plaintext, err := Decrypt(receiver_key, cryptogram)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plaintext, message) {
+			t.Fatalf("decrypt gave %q", plaintext)
+		}
+	}
+}
+
+func TestHybridTamper(t *testing.T) {
+	receiver_key, err := NewECPrivateKey(&Options{Curve: CURVE_X25519_MLKEM768})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cryptogram, err := EncryptEphemeral(receiver_key.PublicKey(), []byte("MySuperSecretMessage"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := parse_envelope(cryptogram, envelope_magic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := e.key(receiver_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the encapsulation is the senders X25519 public key, then the ML-KEM
+	// ciphertext. changing either must change the key, even before the
+	// header is authenticated.
+	offset := bytes.Index(cryptogram, e.public_key)
+	for name, i := range map[string]int{"X25519": 7, "ML-KEM": x25519_public_key_len + 100} {
+		t.Run(name, func(t *testing.T) {
+			tampered := bytes.Clone(cryptogram)
+			tampered[offset+i] ^= 0x40
+
+			if _, err := Decrypt(receiver_key, tampered); err == nil {
+				t.Fatal("decrypted a tampered cryptogram")
+			}
+
+			tampered_e, err := parse_envelope(tampered, envelope_magic)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tampered_key, err := tampered_e.key(receiver_key)
+			if err == nil && bytes.Equal(tampered_key, key) {
+				t.Fatal("tampering left the key unchanged")
+			}
+		})
+	}
+}
+
+func TestHybridHalfKeys(t *testing.T) {
+	receiver_key, err := NewECPrivateKey(&Options{Curve: CURVE_X25519_MLKEM768})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cryptogram, err := EncryptEphemeral(receiver_key.PublicKey(), []byte("MySuperSecretMessage"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other_key, err := NewECPrivateKey(&Options{Curve: CURVE_X25519_MLKEM768})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a receiver key with only one half right can't decrypt
+	right, wrong := receiver_key.Bytes(), other_key.Bytes()
+	for name, k := range map[string][]byte{
+		"X25519": append(bytes.Clone(right[:x25519_scalar_len]), wrong[x25519_scalar_len:]...),
+		"ML-KEM": append(bytes.Clone(wrong[:x25519_scalar_len]), right[x25519_scalar_len:]...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			half_key, err := NewECPrivateKeyFromBytes(k, &Options{Curve: CURVE_X25519_MLKEM768})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := Decrypt(half_key, cryptogram); !errors.Is(err, ErrAuthFailed) {
+				t.Fatalf("decrypting with only the %s half right gave %v", name, err)
+			}
+		})
+	}
+}
+
+func TestHybridKeys(t *testing.T) {
+	private_key, err := NewECPrivateKey(&Options{Curve: CURVE_X25519_MLKEM768})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &Options{Curve: CURVE_X25519_MLKEM768}
+	parsed, err := NewECPrivateKeyFromBytes(private_key.Bytes(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.PublicKey().Bytes(), private_key.PublicKey().Bytes()) {
+		t.Fatal("private key bytes gave a different public key")
+	}
+
+	public_key, err := NewECPublicKeyFromBytes(private_key.PublicKey().Bytes(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cryptogram, err := EncryptEphemeral(public_key, []byte("MySuperSecretMessage"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(parsed, cryptogram); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := private_key.Agree(public_key); err == nil {
+		t.Error("agreed a secret with a hybrid key")
+	}
+	if _, err := EncryptMultiEphemeral([]*PublicKey{public_key}, nil, nil); err == nil {
+		t.Error("encrypted to many hybrid receivers")
+	}
+	if _, err := private_key.MarshalPKCS8(); err == nil {
+		t.Error("marshalled a hybrid key as PKCS #8")
+	}
+	if _, err := public_key.MarshalJWK(); err == nil {
+		t.Error("marshalled a hybrid key as a JSON Web Key")
+	}
+
+	// mixing the hybrid with a classical key fails
+	x25519_key, err := NewECPrivateKey(&Options{Curve: CURVE_X25519})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Encrypt(x25519_key, public_key, nil, nil); err == nil {
+		t.Error("encrypted to a hybrid key from an X25519 key")
+	}
+	if _, err := Decrypt(x25519_key, cryptogram); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("decrypting with an X25519 key gave %v", err)
+	}
+}
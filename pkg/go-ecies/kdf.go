@@ -10,7 +10,6 @@ import (
 var (
 	default_kdf_params = KDFParams{
 		hash:       sha256.New,
-		key:        read_entropy(32),
 		iterations: 3000000,
 		length:     32,
 	}
@@ -34,9 +33,17 @@ type _KDF struct {
 }
 
 // NewDefaultKDF initialises a new instance of KDF using the default parameters
-// and a random key
-func NewDefaultKDF() *_KDF {
-	return NewKDF(default_kdf_params)
+// and a random key, read from the source of randomness chosen by opts, which
+// may be nil. An error is returned if a failure of the entropy source occurs.
+func NewDefaultKDF(opts *Options) (*_KDF, error) {
+	key, err := read_entropy(opts.rand(), default_kdf_params.length)
+	if err != nil {
+		return nil, err
+	}
+
+	params := default_kdf_params
+	params.key = key
+	return NewKDF(params), nil
 }
 
 // NewKDF initialises a new instance of KDF using the given parameters
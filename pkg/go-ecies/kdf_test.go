@@ -0,0 +1,58 @@
+package goecies
+
+import "testing"
+
+// benchmark_suites compares the original PBKDF2 key schedule with HKDF, on the
+// same curve and cipher
+var benchmark_suites = []struct {
+	name string
+	opts *Options
+}{
+	{"PBKDF2-SHA-256", &Options{KDF: KDF_PBKDF2_SHA256, Cipher: CIPHER_AES256_CBC_HMAC_SHA256, decrypt_only: true}},
+	{"HKDF-SHA-256", &Options{KDF: KDF_HKDF_SHA256, Cipher: CIPHER_AES256_CBC_HMAC_SHA256, decrypt_only: true}},
+	{"HKDF-SHA-256 AES-256-GCM", &Options{KDF: KDF_HKDF_SHA256, Cipher: CIPHER_AES256_GCM}},
+}
+
+// benchmark_message is a 1 KiB secret, about the size unus usually holds
+var benchmark_message = make([]byte, 1024)
+
+func BenchmarkEncrypt(b *testing.B) {
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, suite := range benchmark_suites {
+		b.Run(suite.name, func(b *testing.B) {
+			b.SetBytes(int64(len(benchmark_message)))
+			for i := 0; i < b.N; i++ {
+				if _, err := EncryptEphemeral(receiver_key.PublicKey(), benchmark_message, suite.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, suite := range benchmark_suites {
+		cryptogram, err := EncryptEphemeral(receiver_key.PublicKey(), benchmark_message, suite.opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(suite.name, func(b *testing.B) {
+			b.SetBytes(int64(len(benchmark_message)))
+			for i := 0; i < b.N; i++ {
+				if _, err := Decrypt(receiver_key, cryptogram); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
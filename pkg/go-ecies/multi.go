@@ -0,0 +1,187 @@
+package goecies
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// the number of recipients is a big-endian u16
+	multi_count_len = 2
+)
+
+var (
+	// marks a cryptogram for many recipients. it shares the layout of the
+	// envelope header, which is followed by the recipients.
+	multi_magic = []byte("ECMR")
+
+	errNoRecipients = errors.New("at least one, and at most 65535, receiver keys are needed")
+	errMixedCurves  = errors.New("receiver keys are not all on the same curve")
+	errDuplicateKey = errors.New("receiver keys are not all different")
+)
+
+// EncryptMultiEphemeral performs ECIES encryption of the message to each of
+// the receivers EC public keys, as EncryptMulti does, using an ephemeral key
+// pair for the sender
+func EncryptMultiEphemeral(receiver_keys []*PublicKey, message []byte, opts *Options) ([]byte, error) {
+	if len(receiver_keys) == 0 {
+		return nil, errNoRecipients
+	}
+
+	ephemeral_sender_key, err := NewECPrivateKey(&Options{Curve: receiver_keys[0].Curve(), Rand: opts.rand()})
+	if err != nil {
+		return nil, err
+	}
+
+	return EncryptMulti(ephemeral_sender_key, receiver_keys, message, opts)
+}
+
+// EncryptMulti performs ECIES encryption of the message so that it can be
+// decrypted by any one of the receivers. The message is encrypted once under
+// a random content key, which is then wrapped for each receiver under the key
+// agreed with them, as Encrypt would. Decrypt tries each wrapped key in turn,
+// so receivers are not named in the cryptogram. Every receiver key must be on
+// the same curve. Any receiver could make a new message under the same
+// wrapped keys, so a cryptogram for many receivers only shows that it came
+// from the sender or one of the other receivers. opts may be nil. Errors are
+// returned for the reasons given by Encrypt, if there are no receivers or
+// more than 65535, if any receiver is given twice, or if they are on the
+// X25519MLKEM768 hybrid.
+func EncryptMulti(sender_key *PrivateKey, receiver_keys []*PublicKey, message []byte, opts *Options) ([]byte, error) {
+	return EncryptMultiWithAD(sender_key, receiver_keys, message, nil, opts)
+}
+
+// EncryptMultiWithAD performs ECIES encryption of the message as EncryptMulti
+// does, additionally authenticating the associated data, ad, as EncryptWithAD
+// does
+func EncryptMultiWithAD(sender_key *PrivateKey, receiver_keys []*PublicKey, message []byte, ad []byte, opts *Options) ([]byte, error) {
+	if len(receiver_keys) == 0 || len(receiver_keys) > 0xffff {
+		return nil, errNoRecipients
+	}
+
+	// each receiver would need their own ML-KEM ciphertext
+	if receiver_keys[0].Curve() == CURVE_X25519_MLKEM768 {
+		return nil, errHybridMulti
+	}
+
+	// a receiver given twice would get two identical wrapped keys, showing
+	// that they had been
+	seen := make(map[string]bool, len(receiver_keys))
+	for _, receiver_key := range receiver_keys {
+		if receiver_key.Curve() != receiver_keys[0].Curve() {
+			return nil, errMixedCurves
+		}
+
+		public_key := string(receiver_key.Bytes())
+		if seen[public_key] {
+			return nil, errDuplicateKey
+		}
+		seen[public_key] = true
+	}
+
+	e, first_key, err := new_envelope(sender_key, receiver_keys[0], opts, multi_magic)
+	if err != nil {
+		return nil, err
+	}
+
+	// the content key is read after the salt and nonce
+	content_key, err := read_entropy(opts.rand(), e.suite.Cipher.key_len())
+	if err != nil {
+		return nil, err
+	}
+
+	header := e.marshal_header()
+
+	// wrap the content key for each receiver. every agreed secret is
+	// different, so the salt and nonce can be shared.
+	recipients := binary.BigEndian.AppendUint16(nil, uint16(len(receiver_keys)))
+	for i, receiver_key := range receiver_keys {
+		key := first_key
+		if i > 0 {
+			shared_secret, err := sender_key.agree_envelope(receiver_key)
+			if err != nil {
+				return nil, err
+			}
+			key = e.suite.derive_key(shared_secret, e.salt)
+		}
+
+		wrapped_key, err := e.suite.Cipher.seal(key, e.nonce, header, content_key)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append_length_prefixed(recipients, wrapped_key)
+	}
+
+	// encrypt, authenticating the header and recipients along with the
+	// message
+	authenticated := append(header[:len(header):len(header)], recipients...)
+	body, err := e.suite.Cipher.seal(content_key, e.nonce, authenticated_data(authenticated, ad), message)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(authenticated, body...), nil
+}
+
+// decrypt_multi decrypts a message made by EncryptMultiWithAD, unwrapping the
+// content key from whichever recipient it was wrapped for with the receivers
+// key
+func decrypt_multi(receiver_key *PrivateKey, message []byte, ad []byte) ([]byte, error) {
+	e, err := parse_header(message, multi_magic)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := e.key(receiver_key)
+	if err != nil {
+		return nil, err
+	}
+
+	rest := message[len(e.header):]
+	if len(rest) < multi_count_len {
+		return nil, &FormatError{Field: "recipients", Err: ErrTruncated}
+	}
+
+	count := int(binary.BigEndian.Uint16(rest))
+	rest = rest[multi_count_len:]
+	if count == 0 {
+		return nil, &FormatError{Field: "recipients", Err: ErrInvalidLength}
+	}
+
+	// every recipient is parsed, even after a match, to find the body
+	var content_key []byte
+	for i := 0; i < count; i++ {
+		var wrapped_key []byte
+		wrapped_key, rest, err = split_length_prefixed(rest, "recipients")
+		if err != nil {
+			return nil, err
+		}
+
+		if content_key != nil || e.suite.Cipher.validate_body(wrapped_key) != nil {
+			continue
+		}
+
+		unwrapped, err := e.suite.Cipher.open(key, e.nonce, e.header, wrapped_key)
+		if err == nil && len(unwrapped) == e.suite.Cipher.key_len() {
+			content_key = unwrapped
+		}
+	}
+
+	if content_key == nil {
+		return nil, ErrAuthFailed
+	}
+
+	if err := e.suite.Cipher.validate_body(rest); err != nil {
+		return nil, err
+	}
+
+	// verify and decrypt
+	authenticated := message[:len(message)-len(rest)]
+	return e.suite.Cipher.open(content_key, e.nonce, authenticated_data(authenticated, ad), rest)
+}
+
+// is_multi reports whether the message is a cryptogram for many recipients
+func is_multi(message []byte) bool {
+	return bytes.HasPrefix(message, multi_magic)
+}
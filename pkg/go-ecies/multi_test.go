@@ -0,0 +1,236 @@
+package goecies
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// new_receivers makes the given number of private keys on the curve,
+// returning them and their public keys
+func new_receivers(t *testing.T, curve CurveID, count int) ([]*PrivateKey, []*PublicKey) {
+	t.Helper()
+
+	private_keys := make([]*PrivateKey, count)
+	public_keys := make([]*PublicKey, count)
+	for i := range private_keys {
+		private_key, err := NewECPrivateKey(&Options{Curve: curve})
+		if err != nil {
+			t.Fatal(err)
+		}
+		private_keys[i] = private_key
+		public_keys[i] = private_key.PublicKey()
+	}
+	return private_keys, public_keys
+}
+
+// recipient_slots returns the offset of each wrapped key in a cryptogram for
+// many receivers, just past its length
+func recipient_slots(t *testing.T, cryptogram []byte) []int {
+	t.Helper()
+
+	e, err := parse_header(cryptogram, multi_magic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset := len(e.header)
+	count := int(binary.BigEndian.Uint16(cryptogram[offset:]))
+	offset += multi_count_len
+
+	slots := make([]int, count)
+	for i := range slots {
+		slots[i] = offset + envelope_length_len
+		offset = slots[i] + int(binary.BigEndian.Uint16(cryptogram[offset:]))
+	}
+	return slots
+}
+
+func TestMultiRoundTrip(t *testing.T) {
+	message := []byte("MySuperSecretMessage")
+	ad := []byte("associated data")
+
+	for _, curve := range []CurveID{CURVE_P256, CURVE_P384, CURVE_P521, CURVE_X25519} {
+		t.Run(curve.String(), func(t *testing.T) {
+			private_keys, public_keys := new_receivers(t, curve, 3)
+
+			cryptogram, err := EncryptMultiWithAD(private_keys[0], public_keys, message, ad, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// including the sender, who is also the first receiver
+			for i, private_key := range private_keys {
+				plaintext, err := DecryptWithAD(private_key, cryptogram, ad)
+				if err != nil {
+					t.Fatalf("receiver %d: %v", i, err)
+				}
+				if !bytes.Equal(plaintext, message) {
+					t.Fatalf("receiver %d: decrypt gave %q", i, plaintext)
+				}
+
+				if _, err := DecryptWithAD(private_key, cryptogram, []byte("other data")); !errors.Is(err, ErrAuthFailed) {
+					t.Fatalf("receiver %d: decrypt with other associated data gave %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMultiNotRecipient(t *testing.T) {
+	_, public_keys := new_receivers(t, CURVE_P256, 3)
+	others, _ := new_receivers(t, CURVE_P256, 1)
+
+	cryptogram, err := EncryptMultiEphemeral(public_keys, []byte("MySuperSecretMessage"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Decrypt(others[0], cryptogram); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("decrypt by a non-recipient gave %v", err)
+	}
+
+	// nor does a key on another curve get anywhere
+	x25519_others, _ := new_receivers(t, CURVE_X25519, 1)
+	if _, err := Decrypt(x25519_others[0], cryptogram); err == nil {
+		t.Fatal("decrypted with a key on another curve")
+	}
+}
+
+func TestMultiTamperedRecipient(t *testing.T) {
+	private_keys, public_keys := new_receivers(t, CURVE_P256, 3)
+
+	cryptogram, err := EncryptMultiEphemeral(public_keys, []byte("MySuperSecretMessage"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slots := recipient_slots(t, cryptogram)
+	if len(slots) != 3 {
+		t.Fatalf("cryptogram has %d recipients, want 3", len(slots))
+	}
+
+	for tampered_slot, offset := range slots {
+		tampered := bytes.Clone(cryptogram)
+		tampered[offset] ^= 0x01
+
+		// the receiver whose slot it is can no longer unwrap the content
+		// key, and the recipients are authenticated with the body, so no
+		// one else can decrypt it either
+		for i, private_key := range private_keys {
+			if _, err := Decrypt(private_key, tampered); !errors.Is(err, ErrAuthFailed) {
+				t.Fatalf("slot %d tampered, receiver %d: decrypt gave %v", tampered_slot, i, err)
+			}
+		}
+	}
+
+	// swapping slots is also caught
+	swapped := bytes.Clone(cryptogram)
+	slot_len := slots[1] - slots[0]
+	copy(swapped[slots[0]:], cryptogram[slots[1]:slots[1]+slot_len])
+	copy(swapped[slots[1]:], cryptogram[slots[0]:slots[0]+slot_len])
+	for i, private_key := range private_keys {
+		if _, err := Decrypt(private_key, swapped); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("slots swapped, receiver %d: decrypt gave %v", i, err)
+		}
+	}
+}
+
+func TestMultiMixedCurves(t *testing.T) {
+	_, p256_keys := new_receivers(t, CURVE_P256, 2)
+	_, p384_keys := new_receivers(t, CURVE_P384, 1)
+	_, x25519_keys := new_receivers(t, CURVE_X25519, 1)
+	_, hybrid_keys := new_receivers(t, CURVE_X25519_MLKEM768, 1)
+
+	tests := map[string][]*PublicKey{
+		"P-384 after P-256":          {p256_keys[0], p384_keys[0]},
+		"X25519 among P-256":         {p256_keys[0], x25519_keys[0], p256_keys[1]},
+		"P-256 after X25519":         {x25519_keys[0], p256_keys[0]},
+		"X25519MLKEM768 after P-256": {p256_keys[0], hybrid_keys[0]},
+	}
+
+	for name, receiver_keys := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := EncryptMultiEphemeral(receiver_keys, []byte("MySuperSecretMessage"), nil); !errors.Is(err, errMixedCurves) {
+				t.Fatalf("encrypt gave %v, want %v", err, errMixedCurves)
+			}
+		})
+	}
+
+	if _, err := EncryptMultiEphemeral(hybrid_keys, []byte("MySuperSecretMessage"), nil); !errors.Is(err, errHybridMulti) {
+		t.Fatalf("encrypt to an X25519MLKEM768 key gave %v, want %v", err, errHybridMulti)
+	}
+}
+
+func TestMultiDuplicateRecipient(t *testing.T) {
+	private_keys, public_keys := new_receivers(t, CURVE_P256, 2)
+
+	// the same key, whether or not it is the same value
+	copied, err := NewECPublicKeyFromBytes(public_keys[1].Bytes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]*PublicKey{
+		"repeated": {public_keys[0], public_keys[1], public_keys[1]},
+		"copied":   {public_keys[1], public_keys[0], copied},
+	}
+
+	for name, receiver_keys := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := EncryptMulti(private_keys[0], receiver_keys, []byte("MySuperSecretMessage"), nil); !errors.Is(err, errDuplicateKey) {
+				t.Fatalf("encrypt gave %v, want %v", err, errDuplicateKey)
+			}
+		})
+	}
+}
+
+func TestMultiRecipientCount(t *testing.T) {
+	private_keys, public_keys := new_receivers(t, CURVE_P256, 1)
+
+	if _, err := EncryptMultiEphemeral(nil, []byte("MySuperSecretMessage"), nil); !errors.Is(err, errNoRecipients) {
+		t.Fatalf("encrypt to no one gave %v", err)
+	}
+	if _, err := EncryptMulti(private_keys[0], []*PublicKey{}, []byte("MySuperSecretMessage"), nil); !errors.Is(err, errNoRecipients) {
+		t.Fatalf("encrypt to no one gave %v", err)
+	}
+
+	// the count is a u16, so no more keys than that can be listed. the keys
+	// needn't differ for the count to be checked first.
+	too_many := make([]*PublicKey, 0x10000)
+	for i := range too_many {
+		too_many[i] = public_keys[0]
+	}
+	if _, err := EncryptMulti(private_keys[0], too_many, []byte("MySuperSecretMessage"), nil); !errors.Is(err, errNoRecipients) {
+		t.Fatalf("encrypt to %d receivers gave %v", len(too_many), err)
+	}
+
+	// a single receiver is allowed, and a cryptogram listing none is refused
+	cryptogram, err := EncryptMulti(private_keys[0], public_keys, []byte("MySuperSecretMessage"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(private_keys[0], cryptogram); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := parse_header(cryptogram, multi_magic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	none := append(bytes.Clone(e.header), 0, 0)
+	none = append(none, cryptogram[len(e.header)+multi_count_len:]...)
+
+	var format_error *FormatError
+	if _, err := Decrypt(private_keys[0], none); !errors.As(err, &format_error) || !errors.Is(err, ErrInvalidLength) {
+		t.Fatalf("decrypt listing no recipients gave %v", err)
+	}
+
+	// nor may the count claim more recipients than are listed
+	more := bytes.Clone(cryptogram)
+	binary.BigEndian.PutUint16(more[len(e.header):], 0xffff)
+	if _, err := Decrypt(private_keys[0], more); !errors.As(err, &format_error) || !errors.Is(err, ErrTruncated) {
+		t.Fatalf("decrypt with too high a count gave %v", err)
+	}
+}
@@ -0,0 +1,307 @@
+package goecies
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	passphrase_header_version = 1
+	passphrase_seed_len       = 32
+
+	// bounds on the parameters accepted from a passphrase header, so that a
+	// forged header can't make us burn much more time or memory than
+	// DefaultPassphraseParams would. memory is in KiB, so 256 MiB.
+	max_passphrase_time    = 4
+	max_passphrase_memory  = 256 * 1024
+	max_passphrase_threads = 8
+)
+
+var (
+	// marks a cryptogram prefixed by a passphrase header. a bare cryptogram
+	// starts with a compressed public key, so 0x02 or 0x03, and can't be
+	// mistaken for one.
+	passphrase_header_magic = []byte("ECPW")
+
+	// DefaultPassphraseParams are the Argon2id costs recommended by RFC 9106
+	// for memory-constrained environments
+	DefaultPassphraseParams = PassphraseParams{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+	}
+)
+
+// PassphraseParams holds the Argon2id cost parameters used to stretch a
+// passphrase into a private key. Memory is given in KiB. Rand is the source of
+// randomness for the salt and the rest of the encryption, as Options.Rand is.
+// It isn't recorded in the passphrase header.
+type PassphraseParams struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	Rand    io.Reader
+}
+
+// validate returns an error if the parameters are zero or out of bounds
+func (params *PassphraseParams) validate() error {
+	if params.Time == 0 || params.Time > max_passphrase_time ||
+		params.Memory < 8*uint32(params.Threads) || params.Memory > max_passphrase_memory ||
+		params.Threads == 0 || params.Threads > max_passphrase_threads {
+		err := errors.New("invalid passphrase parameters")
+		return err
+	}
+	return nil
+}
+
+// NewPassphraseSalt generates a random salt for use with
+// NewECPrivateKeyFromPassphrase, read from source, or crypto/rand.Reader if
+// source is nil. An error is returned if a failure of the entropy source
+// occurs.
+func NewPassphraseSalt(source io.Reader) ([]byte, error) {
+	return read_entropy((&Options{Rand: source}).rand(), salt_len)
+}
+
+// NewECPrivateKeyFromPassphrase derives an EC private key on the NIST P-256
+// curve from the passphrase. The passphrase and salt are stretched with
+// Argon2id using the given parameters, then mapped to a valid scalar by
+// hashing with an incrementing counter until the result falls in [1, n-1].
+// The same passphrase, salt and parameters always give the same key. An error
+// is returned if the passphrase is empty, the salt is shorter than 128 bits
+// or the parameters are invalid.
+func NewECPrivateKeyFromPassphrase(passphrase []byte, salt []byte, params *PassphraseParams) (*PrivateKey, error) {
+	if len(passphrase) == 0 {
+		err := errors.New("passphrase must not be empty")
+		return nil, err
+	}
+
+	if len(salt) < salt_len {
+		err := errors.New("salt must be at least 128-bits")
+		return nil, err
+	}
+
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	seed := argon2.IDKey(passphrase, salt, params.Time, params.Memory, params.Threads, passphrase_seed_len)
+
+	return NewECPrivateKeyFromBytes(hash_to_scalar(ecdh.P256(), seed), nil)
+}
+
+// hash_to_scalar maps the seed to a scalar in [1, n-1] for the curve by
+// rejection sampling, hashing the seed with a 32-bit big-endian counter until
+// a hash falls in range. For P-256 a retry is needed with probability ~2^-32.
+// The scalar is returned as a fixed-width big-endian encoding.
+func hash_to_scalar(curve ecdh.Curve, seed []byte) []byte {
+	counter := make([]byte, 4)
+
+	for i := uint32(0); ; i++ {
+		binary.BigEndian.PutUint32(counter, i)
+
+		hash := sha256.New()
+		hash.Write(seed)
+		hash.Write(counter)
+		candidate := hash.Sum(nil)
+
+		if _, err := curve.NewPrivateKey(candidate); err == nil {
+			return candidate
+		}
+	}
+}
+
+// MarshalPassphraseHeader encodes the salt and parameters used to derive a
+// key from a passphrase, for storing alongside a cryptogram encrypted to it,
+// as magic | version | time | memory | threads | salt length | salt
+func MarshalPassphraseHeader(salt []byte, params *PassphraseParams) []byte {
+	header := make([]byte, 0, len(passphrase_header_magic)+12+len(salt))
+	header = append(header, passphrase_header_magic...)
+	header = append(header, passphrase_header_version)
+	header = binary.BigEndian.AppendUint32(header, params.Time)
+	header = binary.BigEndian.AppendUint32(header, params.Memory)
+	header = append(header, params.Threads)
+	header = append(header, byte(len(salt)))
+	header = append(header, salt...)
+	return header
+}
+
+// HasPassphraseHeader reports whether the message begins with a passphrase
+// header
+func HasPassphraseHeader(message []byte) bool {
+	return bytes.HasPrefix(message, passphrase_header_magic)
+}
+
+// ParsePassphraseHeader splits a passphrase header from the front of the
+// message, returning the salt, parameters and the remainder of the message.
+// A *FormatError is returned if the header is missing, truncated, of an
+// unknown version, has invalid parameters or a salt shorter than 128 bits.
+func ParsePassphraseHeader(message []byte) ([]byte, *PassphraseParams, []byte, error) {
+	if !HasPassphraseHeader(message) {
+		return nil, nil, nil, &FormatError{Field: "passphrase header", Err: ErrUnsupportedVersion}
+	}
+
+	offset := len(passphrase_header_magic)
+	if len(message) < offset+11 {
+		return nil, nil, nil, &FormatError{Field: "passphrase header", Err: ErrTruncated}
+	}
+
+	if message[offset] != passphrase_header_version {
+		return nil, nil, nil, &FormatError{Field: "passphrase header", Err: ErrUnsupportedVersion}
+	}
+	offset += 1
+
+	params := &PassphraseParams{
+		Time:    binary.BigEndian.Uint32(message[offset:]),
+		Memory:  binary.BigEndian.Uint32(message[offset+4:]),
+		Threads: message[offset+8],
+	}
+	offset += 9
+
+	if err := params.validate(); err != nil {
+		return nil, nil, nil, &FormatError{Field: "passphrase parameters", Err: ErrMalformed}
+	}
+
+	length := int(message[offset])
+	offset += 1
+	if length < salt_len {
+		return nil, nil, nil, &FormatError{Field: "salt", Err: ErrInvalidLength}
+	}
+	if len(message) < offset+length {
+		return nil, nil, nil, &FormatError{Field: "salt", Err: ErrTruncated}
+	}
+	salt := message[offset : offset+length]
+	offset += length
+
+	return salt, params, message[offset:], nil
+}
+
+// EncryptWithPassphrase performs ECIES encryption of the message to a key
+// derived from the passphrase under a fresh salt and the given parameters,
+// using an ephemeral key pair for the sender. The salt and parameters are
+// prefixed to the cryptogram as a passphrase header, so that only the
+// passphrase is needed to decrypt it.
+func EncryptWithPassphrase(passphrase []byte, message []byte, params *PassphraseParams) ([]byte, error) {
+	return EncryptWithPassphraseAD(passphrase, message, nil, params)
+}
+
+// EncryptWithPassphraseAD performs ECIES encryption of the message as
+// EncryptWithPassphrase does, additionally authenticating the associated
+// data, ad, as EncryptWithAD does.
+func EncryptWithPassphraseAD(passphrase []byte, message []byte, ad []byte, params *PassphraseParams) ([]byte, error) {
+	opts := &Options{Rand: params.Rand}
+
+	salt, err := NewPassphraseSalt(opts.rand())
+	if err != nil {
+		return nil, err
+	}
+
+	receiver_key, err := NewECPrivateKeyFromPassphrase(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral_sender_key, err := NewECPrivateKey(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	cryptogram, err := EncryptWithAD(ephemeral_sender_key, receiver_key.PublicKey(), message, ad, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(MarshalPassphraseHeader(salt, params), cryptogram...), nil
+}
+
+// EncryptWithPassphrases performs ECIES encryption of the message so that it
+// can be decrypted with any one of the passphrases, as EncryptMulti does. A
+// key is derived from each passphrase under the same fresh salt and the given
+// parameters, so the cryptogram has a single passphrase header and
+// DecryptWithPassphrase opens it as usual.
+func EncryptWithPassphrases(passphrases [][]byte, message []byte, params *PassphraseParams) ([]byte, error) {
+	return EncryptWithPassphrasesAD(passphrases, message, nil, params)
+}
+
+// EncryptWithPassphrasesAD performs ECIES encryption of the message as
+// EncryptWithPassphrases does, additionally authenticating the associated
+// data, ad, as EncryptWithAD does.
+func EncryptWithPassphrasesAD(passphrases [][]byte, message []byte, ad []byte, params *PassphraseParams) ([]byte, error) {
+	opts := &Options{Rand: params.Rand}
+
+	salt, err := NewPassphraseSalt(opts.rand())
+	if err != nil {
+		return nil, err
+	}
+
+	receiver_keys := make([]*PublicKey, 0, len(passphrases))
+	for _, passphrase := range passphrases {
+		receiver_key, err := NewECPrivateKeyFromPassphrase(passphrase, salt, params)
+		if err != nil {
+			return nil, err
+		}
+		receiver_keys = append(receiver_keys, receiver_key.PublicKey())
+	}
+
+	ephemeral_sender_key, err := NewECPrivateKey(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	cryptogram, err := EncryptMultiWithAD(ephemeral_sender_key, receiver_keys, message, ad, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(MarshalPassphraseHeader(salt, params), cryptogram...), nil
+}
+
+// DecryptWithPassphrase decrypts a cryptogram made by EncryptWithPassphrase,
+// or EncryptWithPassphrases, deriving the key from the passphrase with the
+// salt and parameters in its passphrase header. An error is returned if the
+// header is invalid, or if decryption fails for any of the reasons given by
+// Decrypt.
+func DecryptWithPassphrase(passphrase []byte, message []byte) ([]byte, error) {
+	return DecryptWithPassphraseAD(passphrase, message, nil)
+}
+
+// DecryptWithPassphraseAD decrypts a cryptogram made by
+// EncryptWithPassphraseAD, as DecryptWithPassphrase does. The associated
+// data, ad, must be the same as was given to EncryptWithPassphraseAD, else an
+// error is returned.
+func DecryptWithPassphraseAD(passphrase []byte, message []byte, ad []byte) ([]byte, error) {
+	salt, params, cryptogram, err := ParsePassphraseHeader(message)
+	if err != nil {
+		return nil, err
+	}
+
+	receiver_key, err := NewECPrivateKeyFromPassphrase(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecryptWithAD(receiver_key, cryptogram, ad)
+}
+
+// DecryptWithPassphraseCompat decrypts a cryptogram made by
+// EncryptWithPassphraseAD, as DecryptWithPassphraseAD does, and also those
+// made before passphrase headers existed, which were encrypted to the key
+// NewECPrivateKeyFromBytes makes from the passphrase itself. Those can't carry
+// associated data, so if ad isn't empty the header is required.
+func DecryptWithPassphraseCompat(passphrase []byte, message []byte, ad []byte) ([]byte, error) {
+	if HasPassphraseHeader(message) || len(ad) > 0 {
+		return DecryptWithPassphraseAD(passphrase, message, ad)
+	}
+
+	receiver_key, err := NewECPrivateKeyFromBytes(passphrase, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return Decrypt(receiver_key, message)
+}
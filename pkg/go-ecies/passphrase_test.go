@@ -0,0 +1,90 @@
+package goecies
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPassphraseParamBounds(t *testing.T) {
+	salt := make([]byte, salt_len)
+
+	tests := []struct {
+		name   string
+		params PassphraseParams
+		valid  bool
+	}{
+		{"default", DefaultPassphraseParams, true},
+		{"at the bounds", PassphraseParams{Time: max_passphrase_time, Memory: max_passphrase_memory, Threads: max_passphrase_threads}, true},
+		{"no time", PassphraseParams{Time: 0, Memory: 64 * 1024, Threads: 4}, false},
+		{"too much time", PassphraseParams{Time: max_passphrase_time + 1, Memory: 64 * 1024, Threads: 4}, false},
+		{"1 GiB of memory", PassphraseParams{Time: 3, Memory: 1024 * 1024, Threads: 4}, false},
+		{"too little memory for the threads", PassphraseParams{Time: 3, Memory: 8*4 - 1, Threads: 4}, false},
+		{"no threads", PassphraseParams{Time: 3, Memory: 64 * 1024, Threads: 0}, false},
+		{"too many threads", PassphraseParams{Time: 3, Memory: 64 * 1024, Threads: max_passphrase_threads + 1}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// parsing checks the bounds without deriving a key
+			header := MarshalPassphraseHeader(salt, &test.params)
+			_, _, _, err := ParsePassphraseHeader(append(header, "cryptogram"...))
+
+			if test.valid && err != nil {
+				t.Fatal(err)
+			}
+
+			var format_error *FormatError
+			if !test.valid && (!errors.As(err, &format_error) || !errors.Is(err, ErrMalformed)) {
+				t.Fatalf("header gave %v, want a malformed passphrase parameters error", err)
+			}
+		})
+	}
+}
+
+func TestDecryptWithPassphraseCompat(t *testing.T) {
+	passphrase := []byte("correct-horse-battery-staple-and-then-some")
+	params := &PassphraseParams{Time: 1, Memory: 1024, Threads: 1}
+	ad := []byte("associated data")
+
+	stretched, err := EncryptWithPassphraseAD(passphrase, []byte("MySuperSecretMessage"), ad, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as earlier versions of unus made them, with the passphrase as the key
+	legacy_key, err := NewECPrivateKeyFromBytes(passphrase, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := EncryptEphemeral(legacy_key.PublicKey(), []byte("MySuperSecretMessage"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, decrypt := range map[string]func() ([]byte, error){
+		"stretched": func() ([]byte, error) { return DecryptWithPassphraseCompat(passphrase, stretched, ad) },
+		"legacy":    func() ([]byte, error) { return DecryptWithPassphraseCompat(passphrase, legacy, nil) },
+	} {
+		message, err := decrypt()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(message) != "MySuperSecretMessage" {
+			t.Fatalf("%s: decrypt gave %q", name, message)
+		}
+	}
+
+	if _, err := DecryptWithPassphraseCompat([]byte("correct-horse-battery-staple-and-then-more"), stretched, ad); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("wrong passphrase gave %v, want %v", err, ErrAuthFailed)
+	}
+
+	if _, err := DecryptWithPassphraseCompat(passphrase, stretched, []byte("other data")); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("wrong associated data gave %v, want %v", err, ErrAuthFailed)
+	}
+
+	// the legacy key can't be used to skip the associated data
+	var format_error *FormatError
+	if _, err := DecryptWithPassphraseCompat(passphrase, legacy, ad); !errors.As(err, &format_error) {
+		t.Fatalf("legacy cryptogram with associated data gave %v, want a *FormatError", err)
+	}
+}
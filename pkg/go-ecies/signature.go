@@ -0,0 +1,313 @@
+package goecies
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+)
+
+const (
+	// domain separates detached signatures from those made in signcryption,
+	// so that neither can be passed off as the other. each ends in a NUL, so
+	// neither is a prefix of the other.
+	signature_context    = "go-ecies signature v1\x00"
+	signcryption_context = "go-ecies signcryption v1\x00"
+)
+
+var (
+	// marks a signed cryptogram. signed cryptograms share the layout of the
+	// envelope header, but can't be mistaken for a cryptogram, so Decrypt
+	// can't open one without checking its signature.
+	signed_magic = []byte("ECSG")
+
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// Sign signs the message with the signing key, which may be an
+// *ecdsa.PrivateKey on P-256, P-384 or P-521, as returned by
+// PrivateKey.ECDSA, or an ed25519.PrivateKey. ECDSA signatures are ASN.1
+// encoded, over the SHA-2 hash the size of the curve. The message is domain
+// separated, so the signature can only be checked with Verify. An error is
+// returned if the key is unsupported.
+func Sign(signing_key crypto.Signer, message []byte) ([]byte, error) {
+	return sign(signing_key, signature_context, message)
+}
+
+// Verify checks a signature made by Sign over the message, with the public
+// half of the signing key. ErrInvalidSignature is returned if the signature
+// doesn't match, or an error if the key is unsupported.
+func Verify(public_key crypto.PublicKey, message []byte, signature []byte) error {
+	return verify(public_key, signature_context, message, signature)
+}
+
+// EncryptAndSign signs the message with the signing key, as Sign does, then
+// performs ECIES encryption of the message and signature to the receivers EC
+// public key using an ephemeral key pair for the sender. The signature covers
+// the receivers public key as well as the message, so a signed cryptogram
+// can't be decrypted and passed on to someone else as though it were meant
+// for them. The senders public key travels inside the cryptogram, so only the
+// receiver learns who sent it. opts may be nil. Errors are returned for the
+// reasons given by Sign and Encrypt.
+func EncryptAndSign(signing_key crypto.Signer, receiver_key *PublicKey, message []byte, opts *Options) ([]byte, error) {
+	signer, err := x509.MarshalPKIXPublicKey(signing_key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	recipient, err := receiver_key.Compress()
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := sign(signing_key, signcryption_context, signed_data(signer, recipient, message))
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral_sender_key, err := NewECPrivateKey(&Options{Curve: receiver_key.Curve(), Rand: opts.rand()})
+	if err != nil {
+		return nil, err
+	}
+
+	e, key, err := new_envelope(ephemeral_sender_key, receiver_key, opts, signed_magic)
+	if err != nil {
+		return nil, err
+	}
+
+	// the signers public key and signature are sealed along with the message
+	plaintext := append_length_prefixed(nil, signer)
+	plaintext = append_length_prefixed(plaintext, signature)
+	plaintext = append(plaintext, message...)
+
+	header := e.marshal_header()
+	body, err := e.suite.Cipher.seal(key, e.nonce, header, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header, body...), nil
+}
+
+// DecryptAndVerify decrypts a message made by EncryptAndSign, using the
+// receive_key in the ECDH key agreement step, then checks its signature.
+// Returns the message and the senders public key, which is an
+// *ecdsa.PublicKey or an ed25519.PublicKey. The signature only proves that
+// the message came from the holder of that key, so the caller must still
+// decide whether to trust it, e.g. by comparing it with known keys using
+// their Equal method. If the message can't be parsed, a *FormatError is
+// returned. If it has been tampered with, an error is returned, and if the
+// signature doesn't match, ErrInvalidSignature is returned.
+func DecryptAndVerify(receiver_key *PrivateKey, message []byte) ([]byte, crypto.PublicKey, error) {
+	e, err := parse_envelope(message, signed_magic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := e.key(receiver_key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, err := e.suite.Cipher.open(key, e.nonce, e.header, e.body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signer, plaintext, err := split_length_prefixed(plaintext, "signer")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signature, plaintext, err := split_length_prefixed(plaintext, "signature")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sender_key, err := x509.ParsePKIXPublicKey(signer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	recipient, err := receiver_key.PublicKey().Compress()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := verify(sender_key, signcryption_context, signed_data(signer, recipient, plaintext), signature); err != nil {
+		return nil, nil, err
+	}
+
+	return plaintext, sender_key, nil
+}
+
+// ParseSigningKeyPEM parses a PEM encoded PKCS #8 private key which can be
+// used with Sign and EncryptAndSign. An error is returned if there's no
+// private key, or if the key is unsupported.
+func ParseSigningKeyPEM(data []byte) (crypto.Signer, error) {
+	der, err := decode_pem(data, PEM_PRIVATE_KEY)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	signing_key, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errUnsupportedKey
+	}
+
+	if _, err := signature_hash(signing_key.Public()); err != nil {
+		return nil, err
+	}
+
+	return signing_key, nil
+}
+
+// ParseVerifyingKeysPEM parses every PEM encoded SubjectPublicKeyInfo in
+// data, for use with Verify, skipping any other blocks. An error is returned
+// if there are none, or if any key is unsupported.
+func ParseVerifyingKeysPEM(data []byte) ([]crypto.PublicKey, error) {
+	var public_keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != PEM_PUBLIC_KEY {
+			continue
+		}
+
+		public_key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := signature_hash(public_key); err != nil {
+			return nil, err
+		}
+
+		public_keys = append(public_keys, public_key)
+	}
+
+	if len(public_keys) == 0 {
+		err := errors.New("no " + PEM_PUBLIC_KEY + " found")
+		return nil, err
+	}
+
+	return public_keys, nil
+}
+
+// sign signs the message, prefixed by the context, with the signing key
+func sign(signing_key crypto.Signer, context string, message []byte) ([]byte, error) {
+	hash, err := signature_hash(signing_key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return signing_key.Sign(rand.Reader, signature_digest(hash, context, message), hash)
+}
+
+// verify checks the signature over the message, prefixed by the context
+func verify(public_key crypto.PublicKey, context string, message []byte, signature []byte) error {
+	hash, err := signature_hash(public_key)
+	if err != nil {
+		return err
+	}
+
+	digest := signature_digest(hash, context, message)
+
+	valid := false
+	switch key := public_key.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(key, digest, signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, digest, signature)
+	}
+
+	if !valid {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// signature_hash returns the hash ECDSA signatures are made over for the
+// curve of the key, or zero for Ed25519, which hashes the message itself. An
+// error is returned for any other key.
+func signature_hash(public_key crypto.PublicKey) (crypto.Hash, error) {
+	switch key := public_key.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return crypto.SHA256, nil
+		case elliptic.P384():
+			return crypto.SHA384, nil
+		case elliptic.P521():
+			return crypto.SHA512, nil
+		}
+	case ed25519.PublicKey:
+		return 0, nil
+	}
+	return 0, errUnsupportedKey
+}
+
+// signature_digest returns what is signed: the context and message, hashed
+// unless hash is zero
+func signature_digest(hash crypto.Hash, context string, message []byte) []byte {
+	if hash == 0 {
+		return append([]byte(context), message...)
+	}
+
+	digest := hash.New()
+	digest.Write([]byte(context))
+	digest.Write(message)
+	return digest.Sum(nil)
+}
+
+// signed_data returns what is signed in a signed cryptogram: the signers and
+// receivers public keys, each prefixed by its length, then the message
+func signed_data(signer []byte, recipient []byte, message []byte) []byte {
+	data := append_length_prefixed(nil, signer)
+	data = append_length_prefixed(data, recipient)
+	return append(data, message...)
+}
+
+// append_length_prefixed appends the field to b, prefixed by its length as a
+// big-endian u16
+func append_length_prefixed(b []byte, field []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(field)))
+	return append(b, field...)
+}
+
+// split_length_prefixed splits a field made by append_length_prefixed from
+// the front of b, returning it and the rest of b. A *FormatError naming the
+// field is returned if b is too short.
+func split_length_prefixed(b []byte, name string) ([]byte, []byte, error) {
+	if len(b) < envelope_length_len {
+		return nil, nil, &FormatError{Field: name, Err: ErrTruncated}
+	}
+
+	length := int(binary.BigEndian.Uint16(b))
+	b = b[envelope_length_len:]
+	if len(b) < length {
+		return nil, nil, &FormatError{Field: name, Err: ErrTruncated}
+	}
+
+	return b[:length], b[length:], nil
+}
+
+// is_signed reports whether the message is a signed cryptogram
+func is_signed(message []byte) bool {
+	return bytes.HasPrefix(message, signed_magic)
+}
@@ -0,0 +1,274 @@
+package goecies
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"testing"
+)
+
+// signing_keys returns a signing key of each kind Sign accepts
+func signing_keys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+
+	keys := map[string]crypto.Signer{}
+	for name, curve := range map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()} {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key
+	}
+
+	_, ed25519_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys["Ed25519"] = ed25519_key
+
+	return keys
+}
+
+func TestSignAndVerify(t *testing.T) {
+	message := []byte("MySuperSecretMessage")
+	keys := signing_keys(t)
+
+	for name, signing_key := range keys {
+		t.Run(name, func(t *testing.T) {
+			signature, err := Sign(signing_key, message)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Verify(signing_key.Public(), message, signature); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Verify(signing_key.Public(), []byte("MySuperSecretMessagf"), signature); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("verify of another message gave %v", err)
+			}
+
+			tampered := bytes.Clone(signature)
+			tampered[len(tampered)-1] ^= 0x01
+			if err := Verify(signing_key.Public(), message, tampered); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("verify of a tampered signature gave %v", err)
+			}
+
+			for other_name, other_key := range keys {
+				if other_name == name {
+					continue
+				}
+				if err := Verify(other_key.Public(), message, signature); !errors.Is(err, ErrInvalidSignature) {
+					t.Fatalf("verify with the %s key gave %v", other_name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSignUnsupportedKey(t *testing.T) {
+	rsa_key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Sign(rsa_key, []byte("MySuperSecretMessage")); !errors.Is(err, errUnsupportedKey) {
+		t.Fatalf("sign with an RSA key gave %v", err)
+	}
+	if err := Verify(&rsa_key.PublicKey, []byte("MySuperSecretMessage"), []byte("signature")); !errors.Is(err, errUnsupportedKey) {
+		t.Fatalf("verify with an RSA key gave %v", err)
+	}
+}
+
+func TestEncryptAndSign(t *testing.T) {
+	message := []byte("MySuperSecretMessage")
+
+	for _, curve := range []CurveID{CURVE_P256, CURVE_P384, CURVE_P521, CURVE_X25519, CURVE_X25519_MLKEM768} {
+		t.Run(curve.String(), func(t *testing.T) {
+			receiver_key, err := NewECPrivateKey(&Options{Curve: curve})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, signing_key := range signing_keys(t) {
+				signed, err := EncryptAndSign(signing_key, receiver_key.PublicKey(), message, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				plaintext, sender_key, err := DecryptAndVerify(receiver_key, signed)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if !bytes.Equal(plaintext, message) {
+					t.Fatalf("%s: decrypt gave %q", name, plaintext)
+				}
+
+				equal, ok := sender_key.(interface{ Equal(crypto.PublicKey) bool })
+				if !ok || !equal.Equal(signing_key.Public()) {
+					t.Fatalf("%s: decrypt gave the wrong sender key", name)
+				}
+			}
+		})
+	}
+}
+
+func TestDecryptAndVerifyWrongReceiver(t *testing.T) {
+	_, signing_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := EncryptAndSign(signing_key, receiver_key.PublicKey(), []byte("MySuperSecretMessage"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := DecryptAndVerify(other_key, signed); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("decrypt by someone else gave %v", err)
+	}
+}
+
+func TestDecryptAndVerifyTampered(t *testing.T) {
+	_, signing_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := EncryptAndSign(signing_key, receiver_key.PublicKey(), []byte("MySuperSecretMessage"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := parse_envelope(signed, signed_magic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every byte of the body is authenticated before the signature is checked
+	for i := len(e.header); i < len(signed); i++ {
+		tampered := bytes.Clone(signed)
+		tampered[i] ^= 0x01
+
+		if _, _, err := DecryptAndVerify(receiver_key, tampered); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("flipping byte %d of the body gave %v", i, err)
+		}
+	}
+}
+
+func TestDecryptAndVerifyWrongSigner(t *testing.T) {
+	_, signing_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor_public_key, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := EncryptAndSign(signing_key, receiver_key.PublicKey(), []byte("MySuperSecretMessage"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// swap in another signer, then encrypt again so that only the signature
+	// can give it away
+	e, err := parse_envelope(signed, signed_magic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := e.key(receiver_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := e.suite.Cipher.open(key, e.nonce, e.header, e.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, rest, err := split_length_prefixed(plaintext, "signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor, err := x509.MarshalPKIXPublicKey(impostor_public_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := append(append_length_prefixed(nil, impostor), rest...)
+
+	body, err := e.suite.Cipher.seal(key, e.nonce, e.header, forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := DecryptAndVerify(receiver_key, append(bytes.Clone(e.header), body...)); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("decrypt with the wrong signer gave %v", err)
+	}
+}
+
+func TestSignedNotDecryptable(t *testing.T) {
+	_, signing_key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := []byte("MySuperSecretMessage")
+	signed, err := EncryptAndSign(signing_key, receiver_key.PublicKey(), message, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Decrypt would skip the signature, so mustn't open a signed cryptogram
+	var format_error *FormatError
+	if _, err := Decrypt(receiver_key, signed); !errors.As(err, &format_error) || !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("decrypt of a signed cryptogram gave %v", err)
+	}
+
+	// nor can an unsigned cryptogram pass for a signed one
+	cryptogram, err := EncryptEphemeral(receiver_key.PublicKey(), message, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecryptAndVerify(receiver_key, cryptogram); !errors.As(err, &format_error) {
+		t.Fatalf("decrypt and verify of an unsigned cryptogram gave %v", err)
+	}
+
+	// and a detached signature can't pass for one from a signed cryptogram
+	signature, err := Sign(signing_key, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(signing_key.Public(), signcryption_context, message, signature); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("detached signature verified in signcryption context: %v", err)
+	}
+}
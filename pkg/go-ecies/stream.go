@@ -0,0 +1,320 @@
+package goecies
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// plaintext is sealed in chunks of this many bytes, the last of which may
+	// be shorter
+	stream_chunk_len = 64 * 1024
+
+	// each chunk's nonce is the prefix from the header, a big-endian u32
+	// counter and a byte flagging the last chunk
+	stream_nonce_suffix_len = 5
+	stream_last_chunk       = 1
+)
+
+var (
+	// marks a stream. streams share the layout of the envelope header, but
+	// can't be mistaken for a cryptogram.
+	stream_magic = []byte("ECIS")
+
+	errStreamClosed  = errors.New("stream is closed")
+	errStreamTooLong = errors.New("stream is too long")
+	errStreamNotAEAD = errors.New("streams need an AEAD cipher")
+)
+
+// _StreamWriter encrypts everything written to it, writing chunks of the
+// stream to the underlying writer as they fill
+type _StreamWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	chunk  []byte
+	count  uint64
+	err    error
+}
+
+// _StreamReader decrypts a stream as it is read, returning only plaintext
+// from chunks which have been authenticated
+type _StreamReader struct {
+	r         *bufio.Reader
+	aead      cipher.AEAD
+	header    []byte
+	nonce     []byte
+	chunk     []byte
+	plaintext []byte
+	count     uint64
+	done      bool
+	err       error
+}
+
+// EncryptStreamEphemeral performs streaming ECIES encryption to the receivers
+// EC public key, as EncryptStream does, using an ephemeral key pair for the
+// sender
+func EncryptStreamEphemeral(w io.Writer, receiver_key *PublicKey, opts *Options) (io.WriteCloser, error) {
+	ephemeral_sender_key, err := NewECPrivateKey(&Options{Curve: receiver_key.Curve(), Rand: opts.rand()})
+	if err != nil {
+		return nil, err
+	}
+
+	return EncryptStream(w, ephemeral_sender_key, receiver_key, opts)
+}
+
+// EncryptStream performs ECIES encryption of everything written to the
+// returned writer, writing the stream to w. The plaintext is sealed in 64 KiB
+// chunks, each with its own nonce, so that memory use stays constant however
+// much is written. The last chunk is flagged, so that a stream cut short at a
+// chunk boundary fails to decrypt. Close must be called to write the last
+// chunk, and does not close w. An error is returned for any of the reasons
+// given by Encrypt.
+func EncryptStream(w io.Writer, sender_key *PrivateKey, receiver_key *PublicKey, opts *Options) (io.WriteCloser, error) {
+	e, key, err := new_envelope(sender_key, receiver_key, opts, stream_magic)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.suite.Cipher == CIPHER_AES256_CBC_HMAC_SHA256 {
+		return nil, errStreamNotAEAD
+	}
+
+	aead, err := e.suite.Cipher.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := e.marshal_header()
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &_StreamWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		nonce:  stream_nonce(e.nonce),
+		chunk:  make([]byte, 0, stream_chunk_len+aead.Overhead()),
+	}, nil
+}
+
+// Write encrypts p, writing out each chunk as it fills. The last chunk is
+// held back until Close.
+func (s *_StreamWriter) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// only seal a full chunk once we know it isn't the last
+		if len(s.chunk) == stream_chunk_len {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(s.chunk[len(s.chunk):stream_chunk_len], p)
+		s.chunk = s.chunk[:len(s.chunk)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals and writes the last chunk. The stream can't be written to
+// afterwards. The underlying writer is not closed.
+func (s *_StreamWriter) Close() error {
+	if s.err != nil {
+		return s.err
+	}
+
+	if err := s.flush(true); err != nil {
+		return err
+	}
+
+	s.err = errStreamClosed
+	return nil
+}
+
+// flush seals the buffered chunk and writes it out
+func (s *_StreamWriter) flush(last bool) error {
+	if err := set_stream_nonce(s.nonce, s.count, last); err != nil {
+		s.err = err
+		return err
+	}
+
+	sealed := s.aead.Seal(s.chunk[:0], s.nonce, s.chunk, s.header)
+	if _, err := s.w.Write(sealed); err != nil {
+		s.err = err
+		return err
+	}
+
+	s.chunk = s.chunk[:0]
+	s.count++
+	return nil
+}
+
+// DecryptStream decrypts a stream made by EncryptStream as it is read from r,
+// using the receive_key in the ECDH key agreement step. The header is read
+// straight away, and a *FormatError is returned if it can't be parsed.
+// Reads from the returned reader fail if a chunk has been tampered with or
+// reordered, or if the stream was cut short, so nothing read should be
+// trusted until it returns io.EOF.
+func DecryptStream(r io.Reader, receiver_key *PrivateKey) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+
+	header, err := read_stream_header(buffered)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := parse_header(header, stream_magic)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.suite.Cipher == CIPHER_AES256_CBC_HMAC_SHA256 {
+		return nil, &FormatError{Field: "cipher", Err: ErrUnsupportedSuite}
+	}
+
+	key, err := e.key(receiver_key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := e.suite.Cipher.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &_StreamReader{
+		r:      buffered,
+		aead:   aead,
+		header: header,
+		nonce:  stream_nonce(e.nonce),
+		chunk:  make([]byte, stream_chunk_len+aead.Overhead()),
+	}, nil
+}
+
+// Read decrypts the stream into p, one chunk at a time
+func (s *_StreamReader) Read(p []byte) (int, error) {
+	for len(s.plaintext) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+
+		if s.done {
+			return 0, io.EOF
+		}
+
+		if err := s.next(); err != nil {
+			s.err = err
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.plaintext)
+	s.plaintext = s.plaintext[n:]
+	return n, nil
+}
+
+// next reads, authenticates and decrypts the next chunk. a chunk is the last
+// if it is short, or if nothing follows it.
+func (s *_StreamReader) next() error {
+	n, err := io.ReadFull(s.r, s.chunk)
+	switch {
+	case errors.Is(err, io.EOF):
+		return &FormatError{Field: "body", Err: ErrTruncated}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		s.done = true
+	case err != nil:
+		return err
+	default:
+		_, err := s.r.Peek(1)
+		if errors.Is(err, io.EOF) {
+			s.done = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if n < s.aead.Overhead() {
+		return &FormatError{Field: "body", Err: ErrTruncated}
+	}
+
+	if err := set_stream_nonce(s.nonce, s.count, s.done); err != nil {
+		return err
+	}
+
+	plaintext, err := s.aead.Open(s.chunk[:0], s.nonce, s.chunk[:n], s.header)
+	if err != nil {
+		return ErrAuthFailed
+	}
+
+	s.plaintext = plaintext
+	s.count++
+	return nil
+}
+
+// read_stream_header reads the header from the front of a stream, following
+// the length of each field. the header is checked by parse_header.
+func read_stream_header(r io.Reader) ([]byte, error) {
+	header := make([]byte, envelope_prefix_len, 256)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, &FormatError{Field: "header", Err: ErrTruncated}
+	}
+
+	for _, field := range []string{"public key", "salt", "nonce"} {
+		length := make([]byte, envelope_length_len)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return nil, &FormatError{Field: field, Err: ErrTruncated}
+		}
+
+		value := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, &FormatError{Field: field, Err: ErrTruncated}
+		}
+
+		header = append(header, length...)
+		header = append(header, value...)
+	}
+
+	return header, nil
+}
+
+// is_stream reports whether the message is the start of a stream
+func is_stream(message []byte) bool {
+	return bytes.HasPrefix(message, stream_magic)
+}
+
+// stream_nonce returns a buffer for the nonce of each chunk, starting with
+// the given prefix
+func stream_nonce(prefix []byte) []byte {
+	nonce := make([]byte, len(prefix)+stream_nonce_suffix_len)
+	copy(nonce, prefix)
+	return nonce
+}
+
+// set_stream_nonce sets the counter and last chunk flag of the nonce. an error
+// is returned once the counter would overflow.
+func set_stream_nonce(nonce []byte, count uint64, last bool) error {
+	if count > 0xffffffff {
+		return errStreamTooLong
+	}
+
+	suffix := nonce[len(nonce)-stream_nonce_suffix_len:]
+	binary.BigEndian.PutUint32(suffix, uint32(count))
+	suffix[4] = 0
+	if last {
+		suffix[4] = stream_last_chunk
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package goecies
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+// encrypt_stream encrypts the message as a stream to the receiver, returning
+// the stream and the length of its header
+func encrypt_stream(t *testing.T, receiver_key *PrivateKey, message []byte, opts *Options) ([]byte, int) {
+	t.Helper()
+
+	var stream bytes.Buffer
+	w, err := EncryptStreamEphemeral(&stream, receiver_key.PublicKey(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := read_stream_header(bytes.NewReader(stream.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream.Bytes(), len(header)
+}
+
+// decrypt_stream reads the whole stream, returning the plaintext or the first
+// error met
+func decrypt_stream(receiver_key *PrivateKey, stream []byte) ([]byte, error) {
+	r, err := DecryptStream(bytes.NewReader(stream), receiver_key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// stream_chunks splits the body of a stream into its sealed chunks
+func stream_chunks(stream []byte, header_len int, overhead int) [][]byte {
+	var chunks [][]byte
+	body := stream[header_len:]
+	for len(body) > 0 {
+		n := min(len(body), stream_chunk_len+overhead)
+		chunks = append(chunks, body[:n])
+		body = body[n:]
+	}
+	return chunks
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := map[string]int{
+		"empty":             0,
+		"one byte":          1,
+		"one chunk":         stream_chunk_len,
+		"one chunk and one": stream_chunk_len + 1,
+		"several chunks":    3*stream_chunk_len + 100,
+	}
+
+	ciphers := map[string]CipherID{
+		"AES-GCM":           CIPHER_AES256_GCM,
+		"ChaCha20-Poly1305": CIPHER_CHACHA20_POLY1305,
+	}
+
+	for cipher_name, cipher := range ciphers {
+		for name, size := range sizes {
+			t.Run(cipher_name+"/"+name, func(t *testing.T) {
+				message := make([]byte, size)
+				rand.Read(message)
+
+				stream, _ := encrypt_stream(t, receiver_key, message, &Options{Cipher: cipher})
+
+				plaintext, err := decrypt_stream(receiver_key, stream)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(plaintext, message) {
+					t.Fatalf("decrypted %d bytes, want %d", len(plaintext), len(message))
+				}
+			})
+		}
+	}
+}
+
+func TestStreamSmallWrites(t *testing.T) {
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// chunks don't depend upon how the plaintext was written
+	message := make([]byte, 2*stream_chunk_len+7)
+	rand.Read(message)
+
+	var stream bytes.Buffer
+	w, err := EncryptStreamEphemeral(&stream, receiver_key.PublicKey(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(message); i += 1000 {
+		if _, err := w.Write(message[i:min(i+1000, len(message))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.Write(message); !errors.Is(err, errStreamClosed) {
+		t.Fatalf("write after close gave %v", err)
+	}
+
+	plaintext, err := decrypt_stream(receiver_key, stream.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, message) {
+		t.Fatal("decrypted the wrong plaintext")
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := make([]byte, 2*stream_chunk_len)
+	rand.Read(message)
+	stream, header_len := encrypt_stream(t, receiver_key, message, nil)
+	chunk_len := stream_chunk_len + 16
+
+	// cut after the first chunk, which is full and so looks like it could be
+	// the last, but wasn't sealed as the last
+	plaintext, err := decrypt_stream(receiver_key, stream[:header_len+chunk_len])
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("stream cut at a chunk boundary gave %v", err)
+	}
+	if len(plaintext) != 0 {
+		t.Fatalf("stream cut at a chunk boundary gave %d bytes of plaintext", len(plaintext))
+	}
+
+	// cut within the last chunk
+	if _, err := decrypt_stream(receiver_key, stream[:len(stream)-1]); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("stream cut within a chunk gave %v", err)
+	}
+
+	// cut before any chunk
+	var format_error *FormatError
+	if _, err := decrypt_stream(receiver_key, stream[:header_len]); !errors.As(err, &format_error) || !errors.Is(err, ErrTruncated) {
+		t.Fatalf("stream with no chunks gave %v", err)
+	}
+
+	// cut within the header
+	if _, err := decrypt_stream(receiver_key, stream[:header_len-1]); !errors.As(err, &format_error) || !errors.Is(err, ErrTruncated) {
+		t.Fatalf("stream cut within the header gave %v", err)
+	}
+}
+
+func TestStreamReordered(t *testing.T) {
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := make([]byte, 3*stream_chunk_len+100)
+	rand.Read(message)
+	stream, header_len := encrypt_stream(t, receiver_key, message, nil)
+
+	chunks := stream_chunks(stream, header_len, 16)
+	if len(chunks) != 4 {
+		t.Fatalf("stream has %d chunks, want 4", len(chunks))
+	}
+
+	tests := map[string][]int{
+		"swapped":               {1, 0, 2, 3},
+		"first repeated":        {0, 0, 1, 2, 3},
+		"middle repeated":       {0, 1, 1, 2, 3},
+		"last repeated":         {0, 1, 2, 3, 3},
+		"middle dropped":        {0, 2, 3},
+		"last moved to the end": {0, 1, 3, 2},
+	}
+
+	for name, order := range tests {
+		t.Run(name, func(t *testing.T) {
+			tampered := bytes.Clone(stream[:header_len])
+			for _, i := range order {
+				tampered = append(tampered, chunks[i]...)
+			}
+
+			if _, err := decrypt_stream(receiver_key, tampered); !errors.Is(err, ErrAuthFailed) {
+				t.Fatalf("decrypt gave %v, want %v", err, ErrAuthFailed)
+			}
+		})
+	}
+}
+
+func TestStreamTamperedHeader(t *testing.T) {
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := []byte("MySuperSecretMessage")
+	stream, header_len := encrypt_stream(t, receiver_key, message, nil)
+
+	// every byte of the header, from the magic to the nonce prefix, is either
+	// checked as it is parsed or authenticated with each chunk
+	for i := 0; i < header_len; i++ {
+		tampered := bytes.Clone(stream)
+		tampered[i] ^= 0x01
+
+		plaintext, err := decrypt_stream(receiver_key, tampered)
+		if err == nil {
+			t.Fatalf("decrypted a stream with byte %d of its header flipped", i)
+		}
+		if len(plaintext) != 0 {
+			t.Fatalf("flipping byte %d of the header gave %d bytes of plaintext", i, len(plaintext))
+		}
+	}
+
+	// as is every byte of the body
+	for i := header_len; i < len(stream); i++ {
+		tampered := bytes.Clone(stream)
+		tampered[i] ^= 0x01
+
+		if _, err := decrypt_stream(receiver_key, tampered); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("flipping byte %d of the body gave %v", i, err)
+		}
+	}
+}
+
+func TestStreamNotAEAD(t *testing.T) {
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = EncryptStreamEphemeral(io.Discard, receiver_key.PublicKey(), &Options{Cipher: CIPHER_AES256_CBC_HMAC_SHA256})
+	if !errors.Is(err, errDecryptOnly) {
+		t.Fatalf("encrypt with AES-CBC gave %v", err)
+	}
+
+	// even where the cipher is still allowed, streams need an AEAD
+	_, err = EncryptStreamEphemeral(io.Discard, receiver_key.PublicKey(), &Options{Cipher: CIPHER_AES256_CBC_HMAC_SHA256, decrypt_only: true})
+	if !errors.Is(err, errStreamNotAEAD) {
+		t.Fatalf("encrypt with AES-CBC gave %v", err)
+	}
+
+	// nor can a stream be passed off as a cryptogram, or the reverse
+	stream, _ := encrypt_stream(t, receiver_key, []byte("MySuperSecretMessage"), nil)
+	if _, err := Decrypt(receiver_key, stream); err == nil {
+		t.Fatal("decrypted a stream as a cryptogram")
+	}
+
+	cryptogram, err := EncryptEphemeral(receiver_key.PublicKey(), []byte("MySuperSecretMessage"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decrypt_stream(receiver_key, cryptogram); err == nil {
+		t.Fatal("decrypted a cryptogram as a stream")
+	}
+}
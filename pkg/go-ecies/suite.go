@@ -0,0 +1,443 @@
+package goecies
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// CurveID identifies the elliptic curve a cryptogram was made on
+type CurveID uint8
+
+// KDFID identifies how keys are derived from the agreed secret
+type KDFID uint8
+
+// CipherID identifies how the message is encrypted and authenticated
+type CipherID uint8
+
+const (
+	CURVE_P256   CurveID = 1
+	CURVE_P384   CurveID = 2
+	CURVE_P521   CurveID = 3
+	CURVE_X25519 CurveID = 4
+
+	// X25519 together with ML-KEM-768, so that a cryptogram stays secret
+	// unless both are broken, e.g. by a quantum computer recording it now.
+	// The senders X25519 public key and the ML-KEM ciphertext take the place
+	// of the senders public key, and both shared secrets go into the KDF.
+	CURVE_X25519_MLKEM768 CurveID = 5
+)
+
+const (
+	// one 256-bit key for each 128-bit salt, from PBKDF2-HMAC-SHA-256 with
+	// 310,000 iterations
+	KDF_PBKDF2_SHA256 KDFID = 1
+
+	// HKDF-SHA-256, as in RFC 5869, with a 256-bit salt. The agreed secret is
+	// already uniformly random, so needs no stretching.
+	KDF_HKDF_SHA256 KDFID = 2
+)
+
+const (
+	// AES-256-CBC with PKCS#7 padding, then HMAC-SHA-256 over the header and
+	// ciphertext. Only kept so that existing cryptograms can still be opened,
+	// new ones can't be made with it.
+	CIPHER_AES256_CBC_HMAC_SHA256 CipherID = 1
+
+	// AES-256-GCM, with the header as associated data
+	CIPHER_AES256_GCM CipherID = 2
+
+	// ChaCha20-Poly1305, with the header as associated data. Faster than
+	// AES-256-GCM on hardware without AES instructions.
+	CIPHER_CHACHA20_POLY1305 CipherID = 3
+)
+
+const (
+	pbkdf2_iterations = 310000
+	symmetric_key_len = 32
+	aead_tag_len      = 16
+	hkdf_salt_len     = 32
+
+	x25519_scalar_len     = 32
+	x25519_public_key_len = 32
+
+	// info strings separating the keys expanded by HKDF
+	hkdf_encryption_info     = "go-ecies encryption key"
+	hkdf_authentication_info = "go-ecies authentication key"
+)
+
+// Suite names the algorithms used to make a cryptogram, and is recorded in its
+// envelope so that Decrypt can pick them automatically
+type Suite struct {
+	Curve  CurveID
+	KDF    KDFID
+	Cipher CipherID
+}
+
+var (
+	errDecryptOnly = errors.New("AES-256-CBC with HMAC-SHA-256 can only decrypt existing cryptograms")
+)
+
+var (
+	// DefaultSuite is used by Encrypt and EncryptEphemeral unless their
+	// options say otherwise
+	DefaultSuite = Suite{
+		Curve:  CURVE_P256,
+		KDF:    KDF_HKDF_SHA256,
+		Cipher: CIPHER_AES256_GCM,
+	}
+)
+
+// Options holds the optional settings for Encrypt and EncryptEphemeral. The
+// zero value of each setting selects the default.
+type Options struct {
+	// Curve is the curve new keys are made on. If zero, DefaultSuite.Curve
+	// is used. Cryptograms are always made on the curve of the keys given.
+	Curve CurveID
+
+	// KDF derives the keys from the agreed secret. If zero, DefaultSuite.KDF
+	// is used.
+	KDF KDFID
+
+	// Cipher encrypts and authenticates the message. If zero,
+	// DefaultSuite.Cipher is used.
+	Cipher CipherID
+
+	// Rand is the source of randomness for new keys, salts and nonces. If
+	// nil, crypto/rand.Reader is used. Ephemeral keys are read first, then
+	// the salt, then the nonce, then the content key of a cryptogram for many
+	// receivers, so that known-answer tests can replay them. Signatures and
+	// ML-KEM encapsulation always use crypto/rand.Reader.
+	Rand io.Reader
+
+	// decrypt_only lets this package's tests make cryptograms with ciphers
+	// kept only to decrypt existing ones, so that they can still be checked
+	decrypt_only bool
+}
+
+// suite returns the suite selected by the options, which may be nil
+func (opts *Options) suite() Suite {
+	suite := DefaultSuite
+	if opts == nil {
+		return suite
+	}
+
+	if opts.KDF != 0 {
+		suite.KDF = opts.KDF
+	}
+	if opts.Cipher != 0 {
+		suite.Cipher = opts.Cipher
+	}
+	return suite
+}
+
+// rand returns the source of randomness selected by the options, which may be
+// nil
+func (opts *Options) rand() io.Reader {
+	if opts == nil || opts.Rand == nil {
+		return rand.Reader
+	}
+	return opts.Rand
+}
+
+// curve returns the curve selected by the options, which may be nil
+func (opts *Options) curve() CurveID {
+	if opts == nil || opts.Curve == 0 {
+		return DefaultSuite.Curve
+	}
+	return opts.Curve
+}
+
+// validate returns a *FormatError if any algorithm in the suite is unknown
+func (s Suite) validate() error {
+	if err := s.Curve.validate(); err != nil {
+		return err
+	}
+
+	switch {
+	case s.KDF != KDF_PBKDF2_SHA256 && s.KDF != KDF_HKDF_SHA256:
+		return &FormatError{Field: "kdf", Err: ErrUnsupportedSuite}
+	}
+
+	switch s.Cipher {
+	case CIPHER_AES256_CBC_HMAC_SHA256, CIPHER_AES256_GCM, CIPHER_CHACHA20_POLY1305:
+		return nil
+	}
+	return &FormatError{Field: "cipher", Err: ErrUnsupportedSuite}
+}
+
+// validate_encrypt returns an error if the suite can't make new cryptograms,
+// either as validate does or because its cipher is only kept for decryption,
+// unless opts allow it
+func (s Suite) validate_encrypt(opts *Options) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+
+	if s.Cipher == CIPHER_AES256_CBC_HMAC_SHA256 && (opts == nil || !opts.decrypt_only) {
+		return errDecryptOnly
+	}
+	return nil
+}
+
+// salt_len returns the length of the salt the kdf needs to derive the keys
+// for the cipher
+func (s Suite) salt_len() int {
+	if s.KDF == KDF_HKDF_SHA256 {
+		return hkdf_salt_len
+	}
+	return s.Cipher.key_len() / symmetric_key_len * salt_len
+}
+
+// derive_key derives the key for the cipher from the agreed secret and salt.
+// With HKDF, the secret and salt are extracted once, then the encryption key
+// and any authentication key are expanded under their own info strings. With
+// PBKDF2, each 256-bit part of the key is derived with its own 128-bit part
+// of the salt.
+func (s Suite) derive_key(shared_secret []byte, salt []byte) []byte {
+	if s.KDF == KDF_HKDF_SHA256 {
+		return derive_hkdf_key(shared_secret, salt, s.Cipher.key_len())
+	}
+
+	kdf := NewKDF(KDFParams{
+		key:        shared_secret,
+		hash:       sha256.New,
+		iterations: pbkdf2_iterations,
+		length:     symmetric_key_len,
+	})
+
+	key := make([]byte, 0, s.Cipher.key_len())
+	for offset := 0; offset < len(salt); offset += salt_len {
+		key = append(key, kdf.DeriveKey(salt[offset:offset+salt_len])...)
+	}
+	return key
+}
+
+// derive_hkdf_key expands length bytes of key from the agreed secret and salt,
+// one 256-bit key for each info string in turn
+func derive_hkdf_key(shared_secret []byte, salt []byte, length int) []byte {
+	pseudorandom_key := hkdf.Extract(sha256.New, shared_secret, salt)
+
+	key := make([]byte, length)
+	infos := []string{hkdf_encryption_info, hkdf_authentication_info}
+	for i := 0; i*symmetric_key_len < length; i++ {
+		expander := hkdf.Expand(sha256.New, pseudorandom_key, []byte(infos[i]))
+		// can only fail when asked for more than 255 hashes
+		io.ReadFull(expander, key[i*symmetric_key_len:(i+1)*symmetric_key_len])
+	}
+	return key
+}
+
+// validate returns a *FormatError if the curve is unknown
+func (c CurveID) validate() error {
+	switch c {
+	case CURVE_P256, CURVE_P384, CURVE_P521, CURVE_X25519, CURVE_X25519_MLKEM768:
+		return nil
+	}
+	return &FormatError{Field: "curve", Err: ErrUnsupportedSuite}
+}
+
+// curve returns the elliptic curve identified, or nil for X25519 and the
+// hybrid
+func (c CurveID) curve() elliptic.Curve {
+	switch c {
+	case CURVE_P256:
+		return elliptic.P256()
+	case CURVE_P384:
+		return elliptic.P384()
+	case CURVE_P521:
+		return elliptic.P521()
+	}
+	return nil
+}
+
+// String returns the name of the curve, as used by JSON Web Keys
+func (c CurveID) String() string {
+	switch c {
+	case CURVE_P256:
+		return "P-256"
+	case CURVE_P384:
+		return "P-384"
+	case CURVE_P521:
+		return "P-521"
+	case CURVE_X25519:
+		return "X25519"
+	case CURVE_X25519_MLKEM768:
+		return "X25519MLKEM768"
+	}
+	return fmt.Sprintf("CurveID(%d)", uint8(c))
+}
+
+// ecdh returns the crypto/ecdh curve identified, X25519 for the hybrid, or nil
+// if unknown
+func (c CurveID) ecdh() ecdh.Curve {
+	switch c {
+	case CURVE_P256:
+		return ecdh.P256()
+	case CURVE_P384:
+		return ecdh.P384()
+	case CURVE_P521:
+		return ecdh.P521()
+	case CURVE_X25519, CURVE_X25519_MLKEM768:
+		return ecdh.X25519()
+	}
+	return nil
+}
+
+// scalar_len returns the length in bytes of a private key on the curve. a
+// hybrid key is the X25519 scalar followed by the ML-KEM seed.
+func (c CurveID) scalar_len() int {
+	switch c {
+	case CURVE_P384:
+		return 48
+	case CURVE_P521:
+		return 66
+	case CURVE_X25519_MLKEM768:
+		return x25519_scalar_len + mlkem.SeedSize
+	}
+	return 32
+}
+
+// public_key_len returns the length of a compressed public key on the curve.
+// a hybrid key is the X25519 public key followed by the ML-KEM encapsulation
+// key.
+func (c CurveID) public_key_len() int {
+	switch c {
+	case CURVE_X25519:
+		return x25519_public_key_len
+	case CURVE_X25519_MLKEM768:
+		return x25519_public_key_len + mlkem.EncapsulationKeySize768
+	}
+	return 1 + c.scalar_len()
+}
+
+// encapsulation_len returns the length of the senders public key field of an
+// envelope made on the curve. for the hybrid, this is the X25519 public key
+// followed by the ML-KEM ciphertext.
+func (c CurveID) encapsulation_len() int {
+	if c == CURVE_X25519_MLKEM768 {
+		return x25519_public_key_len + mlkem.CiphertextSize768
+	}
+	return c.public_key_len()
+}
+
+// key_len returns the length of the key the cipher needs. AES-CBC with HMAC
+// needs one key for each.
+func (c CipherID) key_len() int {
+	if c == CIPHER_AES256_CBC_HMAC_SHA256 {
+		return 2 * symmetric_key_len
+	}
+	return symmetric_key_len
+}
+
+// nonce_len returns the length of the nonce, or iv, the cipher expects
+func (c CipherID) nonce_len() int {
+	switch c {
+	case CIPHER_AES256_GCM:
+		return 12
+	case CIPHER_CHACHA20_POLY1305:
+		return chacha20poly1305.NonceSize
+	}
+	return aes.BlockSize
+}
+
+// validate_body returns a *FormatError if the body can't have been made by
+// the cipher
+func (c CipherID) validate_body(body []byte) error {
+	if c != CIPHER_AES256_CBC_HMAC_SHA256 {
+		if len(body) < aead_tag_len {
+			return &FormatError{Field: "body", Err: ErrInvalidLength}
+		}
+		return nil
+	}
+
+	if len(body) < aes.BlockSize+hmac_sha256_len || (len(body)-hmac_sha256_len)%aes.BlockSize != 0 {
+		return &FormatError{Field: "body", Err: ErrInvalidLength}
+	}
+	return nil
+}
+
+// aead returns the AEAD for the cipher under key. It must not be called for
+// AES-CBC with HMAC.
+func (c CipherID) aead(key []byte) (cipher.AEAD, error) {
+	if c == CIPHER_CHACHA20_POLY1305 {
+		return chacha20poly1305.New(key)
+	}
+
+	cipher_block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(cipher_block)
+}
+
+// seal encrypts and authenticates the message, authenticating the given
+// authenticated data alongside it, returning the body of the envelope
+func (c CipherID) seal(key, nonce, authenticated, message []byte) ([]byte, error) {
+	if c == CIPHER_AES256_CBC_HMAC_SHA256 {
+		encryption_key, authentication_key := key[:symmetric_key_len], key[symmetric_key_len:]
+
+		ciphertext, err := aes_encrypt(encryption_key, nonce, message)
+		if err != nil {
+			return nil, err
+		}
+
+		tag := hmac_tag(authentication_key, authenticated, ciphertext)
+		return append(ciphertext, tag...), nil
+	}
+
+	aead, err := c.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, message, authenticated), nil
+}
+
+// open authenticates the authenticated data and body, then decrypts the body,
+// returning the original message. An error is returned if authentication
+// fails.
+func (c CipherID) open(key, nonce, authenticated, body []byte) ([]byte, error) {
+	if c == CIPHER_AES256_CBC_HMAC_SHA256 {
+		encryption_key, authentication_key := key[:symmetric_key_len], key[symmetric_key_len:]
+
+		split := len(body) - hmac_sha256_len
+		ciphertext, tag := body[:split], body[split:]
+
+		if !hmac.Equal(hmac_tag(authentication_key, authenticated, ciphertext), tag) {
+			return nil, ErrAuthFailed
+		}
+
+		return aes_decrypt(encryption_key, nonce, ciphertext)
+	}
+
+	aead, err := c.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := aead.Open(nil, nonce, body, authenticated)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return message, nil
+}
+
+// hmac_tag calculates HMAC-SHA-256 over each of the given parts in turn
+func hmac_tag(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
@@ -0,0 +1,208 @@
+package goecies
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// Everything in this file exists only to decrypt version 0 cryptograms, made
+// before the envelope, and to keep Agree as it was, and is never used to make
+// new cryptograms. Their key agreement hashed both coordinates of the shared
+// point, without leading zeroes, as math/big gave them. So did Agree, and with
+// it version 1 envelopes. crypto/ecdh only gives the x coordinate, so y is
+// recovered here with math/big arithmetic, which is not constant time.
+// Envelope cryptograms since version 2 hash the fixed-width x coordinate
+// alone, see agree_envelope.
+
+// read_out_components splits a version 0 ECIES-derived message into its
+// constituent parts, laid out as kP | tag | aes_salt | hmac_salt | iv |
+// message. A *FormatError is returned if the message is too short to hold
+// them, or the encrypted message isn't a whole number of blocks.
+func read_out_components(message []byte) ([]byte, []byte, []byte, []byte, []byte, []byte, error) {
+	header_length := compressed_ecpub_len + hmac_sha256_len + 2*salt_len + aes.BlockSize
+	if len(message) < header_length+aes.BlockSize {
+		return nil, nil, nil, nil, nil, nil, &FormatError{Field: "header", Err: ErrTruncated}
+	}
+
+	if (len(message)-header_length)%aes.BlockSize != 0 {
+		return nil, nil, nil, nil, nil, nil, &FormatError{Field: "body", Err: ErrInvalidLength}
+	}
+
+	offset := 0
+	length := compressed_ecpub_len
+	compressed_public_key := message[offset:length]
+
+	offset = length
+	length += hmac_sha256_len
+	tag := message[offset:length]
+
+	offset = length
+	length += salt_len
+	aes_salt := message[offset:length]
+
+	offset = length
+	length += salt_len
+	hmac_salt := message[offset:length]
+
+	offset = length
+	length += aes.BlockSize
+	iv := message[offset:length]
+
+	offset = length
+	encrypted_message := message[offset:]
+
+	return compressed_public_key, tag, aes_salt, hmac_salt, iv, encrypted_message, nil
+}
+
+// decrypt_v0 decrypts a message made before cryptograms were wrapped in an
+// envelope. The message contains the senders EC public key, the HMAC tag, a
+// salt each for deriving the AES and HMAC keys and the IV used in the AES
+// encryption step.
+func decrypt_v0(receiver_key *PrivateKey, message []byte) ([]byte, error) {
+	// slice up the cryptogram into the necessary chunks
+	compressed_public_key, tag, aes_salt, hmac_salt, iv, encrypted_message, err := read_out_components(message)
+	if err != nil {
+		return nil, err
+	}
+
+	// version 0 cryptograms were only ever made on P-256
+	if receiver_key.Curve() != CURVE_P256 {
+		return nil, ErrAuthFailed
+	}
+
+	// recreate the sender ephemeral public key
+	sender_public_key, err := unmarshal_public_key(CURVE_P256, compressed_public_key)
+	if err != nil {
+		return nil, &FormatError{Field: "public key", Err: ErrMalformed}
+	}
+
+	// perform ECDHKA, as it was before crypto/ecdh
+	shared_secret, err := receiver_key.agree_v0(sender_public_key)
+	if err != nil {
+		return nil, &FormatError{Field: "public key", Err: ErrMalformed}
+	}
+
+	// derive symmetric keys
+	suite := Suite{Curve: CURVE_P256, KDF: KDF_PBKDF2_SHA256, Cipher: CIPHER_AES256_CBC_HMAC_SHA256}
+	key := suite.derive_key(shared_secret, append(aes_salt[:len(aes_salt):len(aes_salt)], hmac_salt...))
+	aes_key, hmac_key := key[:symmetric_key_len], key[symmetric_key_len:]
+
+	// verify the tags match
+	if !hmac.Equal(hmac_tag(hmac_key, encrypted_message), tag) {
+		return nil, ErrAuthFailed
+	}
+
+	// decrypt
+	return aes_decrypt(aes_key, iv, encrypted_message)
+}
+
+// agree_v0 performs the key agreement of version 0 cryptograms, returning
+// SHA-256 of the x then y coordinates of the shared point, each without
+// leading zeroes. Only P-256 was used in version 0, but Agree gives the same
+// on every NIST curve.
+func (ecpriv *PrivateKey) agree_v0(ecpub *PublicKey) ([]byte, error) {
+	x, err := ecpriv.agree(ecpub)
+	if err != nil {
+		return nil, err
+	}
+
+	y, err := ecpriv.shared_y(ecpub, new(big.Int).SetBytes(x))
+	if err != nil {
+		err := errors.New("unable to validate keys")
+		return nil, err
+	}
+
+	raw := append(bytes.TrimLeft(x, "\x00"), y.Bytes()...)
+	hash := sha256.Sum256(raw)
+
+	return hash[:], nil
+}
+
+// shared_y recovers the y coordinate of the shared point S = dQ, of which
+// crypto/ecdh only gives x, so that the agreed key is as before. With
+// P = dG, our own public key, x(S + P) and x(S - P) are agreed with Q + G and
+// Q - G, and by the addition law
+//
+//	y(S) = (x(S - P) - x(S + P)) (x(S) - x(P))^2 / 4y(P)
+//
+// so every scalar multiplication is left to crypto/ecdh
+func (ecpriv *PrivateKey) shared_y(ecpub *PublicKey, x_s *big.Int) (*big.Int, error) {
+	curve_id := ecpriv.Curve()
+	params := curve_id.curve().Params()
+	p := params.P
+
+	q_x, q_y := ecpub.coordinates()
+	p_x, p_y := ecpriv.public.coordinates()
+
+	// Q is G or -G, so S is P or -P
+	if q_x.Cmp(params.Gx) == 0 {
+		if q_y.Cmp(params.Gy) == 0 {
+			return p_y, nil
+		}
+		return new(big.Int).Sub(p, p_y), nil
+	}
+
+	x_sum, err := ecpriv.agree_x(add_points(params, q_x, q_y, params.Gx, params.Gy))
+	if err != nil {
+		return nil, err
+	}
+
+	x_difference, err := ecpriv.agree_x(add_points(params, q_x, q_y, params.Gx, new(big.Int).Sub(p, params.Gy)))
+	if err != nil {
+		return nil, err
+	}
+
+	dx := new(big.Int).Sub(x_s, p_x)
+	dx.Mul(dx, dx)
+
+	denominator := new(big.Int).Lsh(p_y, 2)
+	denominator.ModInverse(denominator.Mod(denominator, p), p)
+
+	y := new(big.Int).Sub(x_difference, x_sum)
+	y.Mul(y, dx)
+	y.Mul(y, denominator)
+	return y.Mod(y, p), nil
+}
+
+// agree_x returns the x coordinate of the point agreed with (x, y)
+func (ecpriv *PrivateKey) agree_x(x *big.Int, y *big.Int) (*big.Int, error) {
+	public_key, err := ecpriv.Curve().ecdh().NewPublicKey(marshal_uncompressed(ecpriv.Curve(), x, y))
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := ecpriv.key.ECDH(public_key)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(shared), nil
+}
+
+// add_points adds two public points on the curve with distinct x coordinates
+func add_points(params *elliptic.CurveParams, x1, y1, x2, y2 *big.Int) (*big.Int, *big.Int) {
+	p := params.P
+
+	// lambda = (y2 - y1) / (x2 - x1)
+	lambda := new(big.Int).Sub(x2, x1)
+	lambda.ModInverse(lambda.Mod(lambda, p), p)
+	lambda.Mul(lambda, new(big.Int).Sub(y2, y1))
+	lambda.Mod(lambda, p)
+
+	// x3 = lambda^2 - x1 - x2, y3 = lambda (x1 - x3) - y1
+	x3 := new(big.Int).Mul(lambda, lambda)
+	x3.Sub(x3, x1)
+	x3.Sub(x3, x2)
+	x3.Mod(x3, p)
+
+	y3 := new(big.Int).Sub(x1, x3)
+	y3.Mul(y3, lambda)
+	y3.Sub(y3, y1)
+	y3.Mod(y3, p)
+
+	return x3, y3
+}
@@ -0,0 +1,117 @@
+package goecies
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"testing"
+)
+
+// reference_agree_v0 is the key agreement of version 0 cryptograms as it was
+// made with crypto/elliptic, hashing both coordinates without leading zeroes
+func reference_agree_v0(ecpriv *PrivateKey, ecpub *PublicKey) []byte {
+	curve := ecpriv.Curve().curve()
+	x, y := ecpub.coordinates()
+	x, y = curve.ScalarMult(x, y, ecpriv.Bytes())
+
+	hash := sha256.Sum256(append(x.Bytes(), y.Bytes()...))
+	return hash[:]
+}
+
+// encrypt_v0 makes a version 0 cryptogram as unus did before the envelope,
+// reading the salts and iv from source
+func encrypt_v0(t *testing.T, sender_key *PrivateKey, receiver_key *PublicKey, message []byte, source io.Reader) []byte {
+	t.Helper()
+
+	salts := make([]byte, 2*salt_len+16)
+	if _, err := io.ReadFull(source, salts); err != nil {
+		t.Fatal(err)
+	}
+	aes_salt, hmac_salt, iv := salts[:salt_len], salts[salt_len:2*salt_len], salts[2*salt_len:]
+
+	suite := Suite{Curve: CURVE_P256, KDF: KDF_PBKDF2_SHA256, Cipher: CIPHER_AES256_CBC_HMAC_SHA256}
+	key := suite.derive_key(reference_agree_v0(sender_key, receiver_key), salts[:2*salt_len])
+
+	encrypted_message, err := aes_encrypt(key[:symmetric_key_len], iv, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compressed, err := sender_key.PublicKey().Compress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cryptogram []byte
+	for _, part := range [][]byte{compressed, hmac_tag(key[symmetric_key_len:], encrypted_message), aes_salt, hmac_salt, iv, encrypted_message} {
+		cryptogram = append(cryptogram, part...)
+	}
+	return cryptogram
+}
+
+// short_coordinate_keys returns a pair of keys whose shared point has an x, or
+// else a y, coordinate starting with a zero byte
+func short_coordinate_keys(t *testing.T, source *drbg, short_x bool) (*PrivateKey, *PrivateKey) {
+	t.Helper()
+
+	curve := CURVE_P256.curve()
+	for i := 0; i < 1<<14; i++ {
+		sender_key, err := NewECPrivateKey(&Options{Rand: source})
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver_key, err := NewECPrivateKey(&Options{Rand: source})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x, y := receiver_key.PublicKey().coordinates()
+		x, y = curve.ScalarMult(x, y, sender_key.Bytes())
+		if (short_x && x.BitLen() <= 248) || (!short_x && y.BitLen() <= 248) {
+			return sender_key, receiver_key
+		}
+	}
+
+	t.Fatal("no shared point with a short coordinate found")
+	return nil, nil
+}
+
+func TestDecryptV0(t *testing.T) {
+	source := &drbg{seed: []byte("decrypt version 0")}
+
+	random_key := func() *PrivateKey {
+		key, err := NewECPrivateKey(&Options{Rand: source})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	short_x_sender, short_x_receiver := short_coordinate_keys(t, source, true)
+	short_y_sender, short_y_receiver := short_coordinate_keys(t, source, false)
+
+	tests := []struct {
+		name         string
+		sender_key   *PrivateKey
+		receiver_key *PrivateKey
+	}{
+		{"leading zero receiver key", random_key(), leading_zero_key(t, CURVE_P256, source)},
+		{"leading zero sender key", leading_zero_key(t, CURVE_P256, source), random_key()},
+		{"short shared x", short_x_sender, short_x_receiver},
+		{"short shared y", short_y_sender, short_y_receiver},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cryptogram := encrypt_v0(t, test.sender_key, test.receiver_key.PublicKey(), []byte("MySuperSecretMessage"), source)
+
+			message, err := Decrypt(test.receiver_key, cryptogram)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(message, []byte("MySuperSecretMessage")) {
+				t.Fatalf("decrypt gave %q", message)
+			}
+		})
+	}
+}
@@ -0,0 +1,529 @@
+package goecies
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	vectors_path = "testdata/vectors.json"
+
+	// version 1 envelopes, made before their key agreement changed. they are
+	// only decrypted, as nothing makes them any more.
+	vectors_v1_path = "testdata/vectors_v1.json"
+)
+
+var update = flag.Bool("update", false, "regenerate "+vectors_path)
+
+// hex_bytes is marshalled as a lower case hex string
+type hex_bytes []byte
+
+func (b hex_bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+func (b *hex_bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	decoded, err := hex.DecodeString(s)
+	*b = decoded
+	return err
+}
+
+// vector is a known-answer test. The randomness an encryption reads is given
+// in the order it is read: the passphrase salt, if any, the ephemeral private
+// key, the salt, the nonce and, for many receivers, the content key. Receiver
+// keys made from a passphrase are given too, for those without Argon2id.
+type vector struct {
+	Description      string      `json:"description"`
+	Curve            CurveID     `json:"curve"`
+	KDF              KDFID       `json:"kdf"`
+	Cipher           CipherID    `json:"cipher"`
+	Passphrase       string      `json:"passphrase,omitempty"`
+	PassphraseParams *vector_kdf `json:"argon2id,omitempty"`
+	PassphraseSalt   hex_bytes   `json:"passphrase_salt,omitempty"`
+	ReceiverKeys     []hex_bytes `json:"receiver_private_keys"`
+	EphemeralKey     hex_bytes   `json:"ephemeral_private_key"`
+	Salt             hex_bytes   `json:"salt"`
+	Nonce            hex_bytes   `json:"nonce"`
+	ContentKey       hex_bytes   `json:"content_key,omitempty"`
+	AssociatedData   hex_bytes   `json:"associated_data"`
+	Message          hex_bytes   `json:"message"`
+	Cryptogram       hex_bytes   `json:"cryptogram"`
+}
+
+type vector_kdf struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+// randomness returns everything the encryption reads from its source of
+// randomness, in order
+func (v *vector) randomness() []byte {
+	var randomness []byte
+	for _, field := range [][]byte{v.PassphraseSalt, v.EphemeralKey, v.Salt, v.Nonce, v.ContentKey} {
+		randomness = append(randomness, field...)
+	}
+	return randomness
+}
+
+// encrypt makes the cryptogram for the vector, reading randomness from source
+func (v *vector) encrypt(source *bytes.Reader) ([]byte, error) {
+	// the AES-CBC vectors check existing cryptograms still decrypt
+	opts := &Options{Curve: v.Curve, KDF: v.KDF, Cipher: v.Cipher, Rand: source, decrypt_only: true}
+
+	if v.Passphrase != "" {
+		params := &PassphraseParams{
+			Time:    v.PassphraseParams.Time,
+			Memory:  v.PassphraseParams.Memory,
+			Threads: v.PassphraseParams.Threads,
+			Rand:    source,
+		}
+		return EncryptWithPassphraseAD([]byte(v.Passphrase), v.Message, v.AssociatedData, params)
+	}
+
+	receiver_keys := make([]*PublicKey, len(v.ReceiverKeys))
+	for i, raw := range v.ReceiverKeys {
+		receiver_key, err := NewECPrivateKeyFromBytes(raw, &Options{Curve: v.Curve})
+		if err != nil {
+			return nil, err
+		}
+		receiver_keys[i] = receiver_key.PublicKey()
+	}
+
+	ephemeral_sender_key, err := NewECPrivateKey(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(receiver_keys) > 1 {
+		return EncryptMultiWithAD(ephemeral_sender_key, receiver_keys, v.Message, v.AssociatedData, opts)
+	}
+	return EncryptWithAD(ephemeral_sender_key, receiver_keys[0], v.Message, v.AssociatedData, opts)
+}
+
+// decrypt opens the cryptogram with the vector's first receiver key, or its
+// passphrase
+func (v *vector) decrypt() ([]byte, error) {
+	if v.Passphrase != "" {
+		return DecryptWithPassphraseAD([]byte(v.Passphrase), v.Cryptogram, v.AssociatedData)
+	}
+
+	receiver_key, err := NewECPrivateKeyFromBytes(v.ReceiverKeys[0], &Options{Curve: v.Curve})
+	if err != nil {
+		return nil, err
+	}
+	return DecryptWithAD(receiver_key, v.Cryptogram, v.AssociatedData)
+}
+
+// read_vectors reads the vectors from the file at path
+func read_vectors(t *testing.T, path string) []*vector {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vectors []*vector
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	return vectors
+}
+
+func TestVectors(t *testing.T) {
+	if *update {
+		write_vectors(t)
+	}
+
+	for _, v := range read_vectors(t, vectors_path) {
+		v := v
+		t.Run(v.Description, func(t *testing.T) {
+			source := bytes.NewReader(v.randomness())
+			cryptogram, err := v.encrypt(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(cryptogram, v.Cryptogram) {
+				t.Errorf("encrypt gave %x, want %x", cryptogram, v.Cryptogram)
+			}
+
+			if source.Len() != 0 {
+				t.Errorf("%d bytes of randomness left unread", source.Len())
+			}
+
+			message, err := v.decrypt()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(message, v.Message) {
+				t.Errorf("decrypt gave %x, want %x", message, v.Message)
+			}
+		})
+	}
+}
+
+func TestVectorsV1(t *testing.T) {
+	for _, v := range read_vectors(t, vectors_v1_path) {
+		v := v
+		t.Run(v.Description, func(t *testing.T) {
+			message, err := v.decrypt()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(message, v.Message) {
+				t.Errorf("decrypt gave %x, want %x", message, v.Message)
+			}
+
+			// the version is authenticated, so can't be changed to have the
+			// cryptogram opened with the other key agreement
+			if v.Passphrase == "" {
+				cryptogram := bytes.Clone(v.Cryptogram)
+				cryptogram[4] = envelope_version
+				v.Cryptogram = cryptogram
+				if _, err := v.decrypt(); !errors.Is(err, ErrAuthFailed) {
+					t.Errorf("decrypt as version %d gave %v", envelope_version, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecryptOnlyCipher(t *testing.T) {
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hybrid_key, err := NewECPrivateKey(&Options{Curve: CURVE_X25519_MLKEM768})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the vectors check that existing AES-CBC cryptograms still decrypt, but
+	// no new ones can be made
+	message := []byte("MySuperSecretMessage")
+	for _, kdf := range []KDFID{KDF_PBKDF2_SHA256, KDF_HKDF_SHA256} {
+		opts := &Options{KDF: kdf, Cipher: CIPHER_AES256_CBC_HMAC_SHA256}
+		if _, err := EncryptEphemeral(receiver_key.PublicKey(), message, opts); !errors.Is(err, errDecryptOnly) {
+			t.Fatalf("encrypt gave %v, want %v", err, errDecryptOnly)
+		}
+		if _, err := EncryptMultiEphemeral([]*PublicKey{receiver_key.PublicKey()}, message, opts); !errors.Is(err, errDecryptOnly) {
+			t.Fatalf("encrypt to many receivers gave %v, want %v", err, errDecryptOnly)
+		}
+		if _, err := EncryptEphemeral(hybrid_key.PublicKey(), message, opts); !errors.Is(err, errDecryptOnly) {
+			t.Fatalf("encrypt to an X25519MLKEM768 key gave %v, want %v", err, errDecryptOnly)
+		}
+	}
+}
+
+func TestEntropyFailure(t *testing.T) {
+	receiver_key, err := NewECPrivateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// enough for the ephemeral key, but not the salt
+	opts := &Options{Rand: bytes.NewReader(make([]byte, 32))}
+	if _, err := EncryptEphemeral(receiver_key.PublicKey(), []byte("message"), opts); err == nil {
+		t.Fatal("encrypted with an exhausted source of randomness")
+	}
+
+	if _, err := NewECPrivateKey(&Options{Rand: bytes.NewReader(nil)}); err == nil {
+		t.Fatal("made a key with an exhausted source of randomness")
+	}
+}
+
+// drbg is a deterministic stream of bytes, SHA-256 of the seed and a counter,
+// used to regenerate the same vectors every time
+type drbg struct {
+	seed    []byte
+	counter uint64
+	buffer  []byte
+}
+
+func (d *drbg) Read(p []byte) (int, error) {
+	for len(d.buffer) < len(p) {
+		block := sha256.Sum256(binary.BigEndian.AppendUint64(append([]byte(nil), d.seed...), d.counter))
+		d.buffer = append(d.buffer, block[:]...)
+		d.counter++
+	}
+
+	n := copy(p, d.buffer)
+	d.buffer = d.buffer[n:]
+	return n, nil
+}
+
+// write_vectors regenerates the vectors with randomness from a drbg seeded by
+// each description
+func write_vectors(t *testing.T) {
+	argon2id := &vector_kdf{Time: 1, Memory: 1024, Threads: 1}
+	vectors := []*vector{
+		{Description: "P-256, HKDF-SHA-256, AES-256-GCM", Curve: CURVE_P256, KDF: KDF_HKDF_SHA256, Cipher: CIPHER_AES256_GCM},
+		{Description: "P-384, HKDF-SHA-256, AES-256-GCM", Curve: CURVE_P384, KDF: KDF_HKDF_SHA256, Cipher: CIPHER_AES256_GCM},
+		{Description: "P-521, HKDF-SHA-256, AES-256-GCM", Curve: CURVE_P521, KDF: KDF_HKDF_SHA256, Cipher: CIPHER_AES256_GCM},
+		{Description: "X25519, HKDF-SHA-256, AES-256-GCM", Curve: CURVE_X25519, KDF: KDF_HKDF_SHA256, Cipher: CIPHER_AES256_GCM},
+		{Description: "P-256, HKDF-SHA-256, ChaCha20-Poly1305", Curve: CURVE_P256, KDF: KDF_HKDF_SHA256, Cipher: CIPHER_CHACHA20_POLY1305},
+		{Description: "X25519, HKDF-SHA-256, ChaCha20-Poly1305, associated data", Curve: CURVE_X25519, KDF: KDF_HKDF_SHA256, Cipher: CIPHER_CHACHA20_POLY1305, AssociatedData: []byte("associated data")},
+		{Description: "P-256, HKDF-SHA-256, AES-256-CBC with HMAC-SHA-256", Curve: CURVE_P256, KDF: KDF_HKDF_SHA256, Cipher: CIPHER_AES256_CBC_HMAC_SHA256},
+		{Description: "P-256, PBKDF2-SHA-256, AES-256-CBC with HMAC-SHA-256", Curve: CURVE_P256, KDF: KDF_PBKDF2_SHA256, Cipher: CIPHER_AES256_CBC_HMAC_SHA256},
+		{Description: "P-256, HKDF-SHA-256, AES-256-GCM, associated data", Curve: CURVE_P256, KDF: KDF_HKDF_SHA256, Cipher: CIPHER_AES256_GCM, AssociatedData: []byte("associated data")},
+		{Description: "P-256, HKDF-SHA-256, AES-256-GCM, three receivers", Curve: CURVE_P256, KDF: KDF_HKDF_SHA256, Cipher: CIPHER_AES256_GCM},
+		{Description: "P-256, HKDF-SHA-256, AES-256-GCM, passphrase", Curve: CURVE_P256, KDF: KDF_HKDF_SHA256, Cipher: CIPHER_AES256_GCM, Passphrase: "correct-horse-battery-staple", PassphraseParams: argon2id, AssociatedData: []byte("associated data")},
+	}
+
+	for _, v := range vectors {
+		source := &drbg{seed: []byte(v.Description)}
+		v.Message = []byte("MySuperSecretMessage")
+
+		receivers := 1
+		if v.Description == vectors[9].Description {
+			receivers = 3
+		}
+
+		if v.Passphrase != "" {
+			salt, err := NewPassphraseSalt(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v.PassphraseSalt = salt
+
+			params := &PassphraseParams{Time: argon2id.Time, Memory: argon2id.Memory, Threads: argon2id.Threads}
+			receiver_key, err := NewECPrivateKeyFromPassphrase([]byte(v.Passphrase), salt, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v.ReceiverKeys = []hex_bytes{receiver_key.Bytes()}
+		} else {
+			for i := 0; i < receivers; i++ {
+				receiver_key, err := NewECPrivateKey(&Options{Curve: v.Curve, Rand: source})
+				if err != nil {
+					t.Fatal(err)
+				}
+				v.ReceiverKeys = append(v.ReceiverKeys, receiver_key.Bytes())
+			}
+		}
+
+		ephemeral_key, err := random_scalar(source, v.Curve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.EphemeralKey = ephemeral_key
+
+		suite := Suite{Curve: v.Curve, KDF: v.KDF, Cipher: v.Cipher}
+		e := &envelope{suite: suite, magic: envelope_magic}
+		for _, field := range []struct {
+			into   *hex_bytes
+			length int
+		}{
+			{&v.Salt, suite.salt_len()},
+			{&v.Nonce, e.nonce_len()},
+		} {
+			if *field.into, err = read_entropy(source, field.length); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if receivers > 1 {
+			if v.ContentKey, err = read_entropy(source, suite.Cipher.key_len()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if v.Cryptogram, err = v.encrypt(bytes.NewReader(v.randomness())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := json.MarshalIndent(vectors, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll("testdata", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(vectors_path, append(data, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rfc_vector is an ECDH known-answer test from an RFC, independent of this
+// package: the receiver's key pair, the sender's and the shared x, or u,
+// coordinate. Public keys are compressed, as they appear in the envelope.
+type rfc_vector struct {
+	name            string
+	curve           CurveID
+	receiver_key    string
+	receiver_public string
+	sender_key      string
+	sender_public   string
+	shared          string
+}
+
+var rfc_vectors = []rfc_vector{
+	// RFC 7748, section 6.1, with Alice as the receiver
+	{
+		name:            "X25519",
+		curve:           CURVE_X25519,
+		receiver_key:    "77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a",
+		receiver_public: "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a",
+		sender_key:      "5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb",
+		sender_public:   "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f",
+		shared:          "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742",
+	},
+	// RFC 5903, section 8.1, with the initiator as the receiver
+	{
+		name:            "P-256",
+		curve:           CURVE_P256,
+		receiver_key:    "c88f01f510d9ac3f70a292daa2316de544e9aab8afe84049c62a9c57862d1433",
+		receiver_public: "03dad0b65394221cf9b051e1feca5787d098dfe637fc90b9ef945d0c3772581180",
+		sender_key:      "c6ef9c5d78ae012a011164acb397ce2088685d8f06bf9be0b283ab46476bee53",
+		sender_public:   "03d12dfb5289c8d4f81208b70270398c342296970a0bccb74c736fc7554494bf63",
+		shared:          "d6840f6b42f6edafd13116e0e12565202fef8e9ece7dce03812464d04b9442de",
+	},
+	// RFC 5903, section 8.2
+	{
+		name:            "P-384",
+		curve:           CURVE_P384,
+		receiver_key:    "099f3c7034d4a2c699884d73a375a67f7624ef7c6b3c0f160647b67414dce655e35b538041e649ee3faef896783ab194",
+		receiver_public: "02667842d7d180ac2cde6f74f37551f55755c7645c20ef73e31634fe72b4c55ee6de3ac808acb4bdb4c88732aee95f41aa",
+		sender_key:      "41cb0779b4bdb85d47846725fbec3c9430fab46cc8dc5060855cc9bda0aa2942e0308312916b8ed2960e4bd55a7448fc",
+		sender_public:   "02e558dbef53eecde3d3fccfc1aea08a89a987475d12fd950d83cfa41732bc509d0d1ac43a0336def96fda41d0774a3571",
+		shared:          "11187331c279962d93d604243fd592cb9d0a926f422e47187521287e7156c5c4d603135569b9e9d09cf5d4a270f59746",
+	},
+	// RFC 5903, section 8.3
+	{
+		name:            "P-521",
+		curve:           CURVE_P521,
+		receiver_key:    "0037ade9319a89f4dabdb3ef411aaccca5123c61acab57b5393dce47608172a095aa85a30fe1c2952c6771d937ba9777f5957b2639bab072462f68c27a57382d4a52",
+		receiver_public: "020015417e84dbf28c0ad3c278713349dc7df153c897a1891bd98bab4357c9ecbee1e3bf42e00b8e380aeae57c2d107564941885942af5a7f4601723c4195d176ced3e",
+		sender_key:      "0145ba99a847af43793fdd0e872e7cdfa16be30fdc780f97bccc3f078380201e9c677d600b343757a3bdbf2a3163e4c2f869cca7458aa4a4effc311f5cb151685eb9",
+		sender_public:   "0200d0b3975ac4b799f5bea16d5e13e9af971d5e9b984c9f39728b5e5739735a219b97c356436adc6e95bb0352f6be64a6c2912d4ef2d0433ced2b6171640012d9460f",
+		shared:          "01144c7d79ae6956bc8edb8e7c787c4521cb086fa64407f97894e5e6b2d79b04d1427e73ca4baa240a34786859810c06b3c715a3a8cc3151f2bee417996d19f3ddea",
+	},
+}
+
+// expected_cryptogram builds the envelope for the vector by hand, from the
+// shared coordinate, with HKDF-SHA-256 and AES-256-GCM
+func (v *rfc_vector) expected_cryptogram(t *testing.T, salt []byte, nonce []byte, message []byte) []byte {
+	t.Helper()
+
+	shared_secret := sha256.Sum256(must_decode_hex(t, v.shared))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared_secret[:], salt, []byte("go-ecies encryption key")), key); err != nil {
+		t.Fatal(err)
+	}
+
+	// magic, version 2, the curve, HKDF-SHA-256 and AES-256-GCM, then each
+	// field after its big-endian u16 length
+	header := append([]byte("ECIE"), 2, byte(v.curve), 2, 2)
+	for _, field := range [][]byte{must_decode_hex(t, v.sender_public), salt, nonce} {
+		header = binary.BigEndian.AppendUint16(header, uint16(len(field)))
+		header = append(header, field...)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead.Seal(header, nonce, message, header)
+}
+
+func must_decode_hex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestRFCVectors(t *testing.T) {
+	message := []byte("MySuperSecretMessage")
+	salt := make([]byte, 32)
+	nonce := make([]byte, 12)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	for i := range nonce {
+		nonce[i] = byte(0xa0 + i)
+	}
+
+	for _, v := range rfc_vectors {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			receiver_key, err := NewECPrivateKeyFromBytes(must_decode_hex(t, v.receiver_key), &Options{Curve: v.curve})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sender_key, err := NewECPrivateKeyFromBytes(must_decode_hex(t, v.sender_key), &Options{Curve: v.curve})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, pair := range []struct {
+				key  *PrivateKey
+				want string
+			}{{receiver_key, v.receiver_public}, {sender_key, v.sender_public}} {
+				public_key, err := pair.key.PublicKey().Compress()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hex.EncodeToString(public_key) != pair.want {
+					t.Fatalf("public key %x, want %s", public_key, pair.want)
+				}
+			}
+
+			shared_secret, err := receiver_key.agree_envelope(sender_key.PublicKey())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := sha256.Sum256(must_decode_hex(t, v.shared)); !bytes.Equal(shared_secret, want[:]) {
+				t.Fatalf("agree_envelope gave %x, want %x", shared_secret, want)
+			}
+
+			opts := &Options{Curve: v.curve, KDF: KDF_HKDF_SHA256, Cipher: CIPHER_AES256_GCM, Rand: bytes.NewReader(append(append([]byte(nil), salt...), nonce...))}
+			cryptogram, err := Encrypt(sender_key, receiver_key.PublicKey(), message, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := v.expected_cryptogram(t, salt, nonce, message); !bytes.Equal(cryptogram, want) {
+				t.Fatalf("encrypt gave %x, want %x", cryptogram, want)
+			}
+
+			decrypted, err := Decrypt(receiver_key, cryptogram)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, message) {
+				t.Fatalf("decrypt gave %q", decrypted)
+			}
+		})
+	}
+}